@@ -15,9 +15,12 @@ type inMemoryCache struct {
 	c map[string]value
 	Stat
 	//isFull bool
-	ttl   time.Duration
-	lsm   *persistence.Lsm
-	mutex sync.RWMutex
+	ttl time.Duration
+	lsm *persistence.Lsm
+	// deleting counts the deletes of every key which are looking for it in lsm or writing its tombstone,
+	// the key is a miss and isn't switched meanwhile.
+	deleting map[string]int
+	mutex    sync.RWMutex
 }
 
 type value struct {
@@ -27,17 +30,22 @@ type value struct {
 }
 
 func newInMemoryCache(ttl int) *inMemoryCache {
-	configure := conf.LoadConfigure()
+	return openInMemoryCache(conf.LoadConfigure(), ttl)
+}
+
+// openInMemoryCache return a cache which switches its keys to the lsm configure.Persistence sets
+func openInMemoryCache(configure conf.Conf, ttl int) *inMemoryCache {
 	lsm, err := persistence.New(configure.Persistence)
 	if err != nil {
 		logrus.Fatalf("init: create lsm error: %v", err)
 	}
 	c := &inMemoryCache{
-		c:     make(map[string]value),
-		lsm:   lsm,
-		Stat:  Stat{},
-		ttl:   time.Duration(ttl) * time.Second,
-		mutex: sync.RWMutex{},
+		c:        make(map[string]value),
+		lsm:      lsm,
+		Stat:     Stat{},
+		ttl:      time.Duration(ttl) * time.Second,
+		deleting: make(map[string]int),
+		mutex:    sync.RWMutex{},
 	}
 	if ttl > 0 {
 		go c.expirer()
@@ -75,7 +83,7 @@ func (c *inMemoryCache) Get(k string) ([]byte, error) {
 	if key, ok := c.c[k]; ok {
 		atomic.AddUint64(&key.frequency, 1)
 		return c.c[k].v, nil
-	} else {
+	} else if _, ok = c.deleting[k]; !ok {
 		res, exist := c.lsm.Get([]byte(k))
 		if exist {
 			return res, nil
@@ -86,17 +94,38 @@ func (c *inMemoryCache) Get(k string) ([]byte, error) {
 
 func (c *inMemoryCache) Del(k string) error {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
 	v, exist := c.c[k]
 	if exist {
 		delete(c.c, k)
 		c.del(k, v.v)
 	}
+	// a key switched to lsm is hidden there by a tombstone. lsm is looked up and the tombstone written
+	// without the lock, the key is a miss meanwhile and the switcher leaves it alone, so no switched
+	// value lands behind it. a key which isn't in lsm takes no tombstone.
+	c.deleting[k]++
+	c.mutex.Unlock()
+
+	if _, ok := c.lsm.Get([]byte(k)); ok {
+		c.lsm.Delete([]byte(k))
+	}
+
+	c.mutex.Lock()
+	if c.deleting[k]--; c.deleting[k] == 0 {
+		delete(c.deleting, k)
+	}
+	c.mutex.Unlock()
 	return nil
 }
 
 func (c *inMemoryCache) GetStat() Stat {
-	return c.Stat
+	s := c.Stat
+	blocks := c.lsm.CacheStats()
+	s.BlockCacheHits, s.BlockCacheMisses = blocks.Hits, blocks.Misses
+	writes := c.lsm.WriteStats()
+	s.WriteSlowdowns, s.WriteStalls, s.WriteStallTime = writes.Slowdowns, writes.Stalls, writes.StallTime
+	evictions := c.lsm.EvictionStats()
+	s.EvictedTables, s.EvictedBytes = evictions.Tables, evictions.Bytes
+	return s
 }
 
 type pair struct {
@@ -113,19 +142,40 @@ type inMemoryScanner struct {
 func (c *inMemoryCache) NewScanner() Scanner {
 	pairCh := make(chan *pair)
 	closeCh := make(chan struct{})
+	// keys are switched to lsm and deleted under the write lock, so the copy of memory and the lsm
+	// snapshot taken together hold every key once, whatever is written while the scan goes on.
+	c.mutex.RLock()
+	pairs := make([]*pair, 0, len(c.c))
+	for k, v := range c.c {
+		pairs = append(pairs, &pair{k, v.v})
+	}
+	snapshot := c.lsm.NewSnapshot()
+	c.mutex.RUnlock()
 	go func() {
 		defer close(pairCh)
-		c.mutex.RLock()
-		for k, v := range c.c {
-			c.mutex.RUnlock()
+		defer snapshot.Release()
+		inMemory := make(map[string]bool, len(pairs))
+		for _, p := range pairs {
+			inMemory[p.k] = true
 			select {
 			case <-closeCh:
 				return
-			case pairCh <- &pair{k, v.v}:
+			case pairCh <- p:
 			}
-			c.mutex.RLock()
 		}
-		c.mutex.RUnlock()
+		// keys switched to lsm follow, a key in memory has been seen already
+		snapshot.Scan(nil, nil, func(key, value []byte) bool {
+			k := string(key)
+			if inMemory[k] {
+				return true
+			}
+			select {
+			case <-closeCh:
+				return false
+			case pairCh <- &pair{k, append([]byte{}, value...)}:
+				return true
+			}
+		})
 	}()
 	return &inMemoryScanner{
 		pair{},
@@ -174,6 +224,7 @@ func (c *inMemoryCache) monit(memoryThreshold, interval int, cache *inMemoryCach
 }
 
 func (c *inMemoryCache) switcher() {
+	c.mutex.RLock()
 	total := int(c.Stat.Count / 10)
 	var avg uint64
 	var sum, counter uint64
@@ -187,19 +238,69 @@ func (c *inMemoryCache) switcher() {
 		}
 	}
 	avg = sum / counter
-
-	i := 0
+	candidates := make([]string, 0, total)
 	for key, val := range c.c {
-		if i < total {
-			if val.frequency < avg {
-				c.lsm.Set([]byte(key), val.v)
-				c.Del(key)
-				i++
-			}
-		} else {
+		if len(candidates) >= total {
 			break
 		}
+		if val.frequency < avg {
+			candidates = append(candidates, key)
+		}
+	}
+	c.mutex.RUnlock()
+
+	// the keys are switched in batches as large as lsm takes at once
+	for len(candidates) > 0 {
+		candidates = c.spill(candidates)
+	}
+}
+
+// spill switch the keys at the head of candidates to lsm in a single batch and return the ones left.
+// the batch is built and committed under the lock, so a key which is set or deleted meanwhile
+// is never overwritten by an older value. a key which is gone from memory or being deleted is skipped.
+func (c *inMemoryCache) spill(candidates []string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	batch := c.lsm.NewWriteBatch()
+	keys := make([]string, 0)
+	for ; len(candidates) > 0; candidates = candidates[1:] {
+		key := candidates[0]
+		val, ok := c.c[key]
+		if !ok {
+			continue
+		}
+		if _, ok = c.deleting[key]; ok {
+			continue
+		}
+		size := persistence.EntrySize([]byte(key), val.v)
+		if c.ttl > 0 {
+			size += persistence.ExpirySize
+		}
+		if size > c.lsm.MaxBatchSize() {
+			// the key fits in no batch, so it's kept in memory
+			continue
+		}
+		if batch.Size()+size > c.lsm.MaxBatchSize() {
+			break
+		}
+		// a switched key expires when it would have expired in memory
+		if c.ttl > 0 {
+			batch.PutExpiring([]byte(key), val.v, val.created.Add(c.ttl))
+		} else {
+			batch.Put([]byte(key), val.v)
+		}
+		keys = append(keys, key)
+	}
+	if err := batch.Commit(); err != nil {
+		logrus.Errorf("switcher: unable to switch %d keys to lsm %v", len(keys), err)
+		return nil
+	}
+	for _, key := range keys {
+		v := c.c[key]
+		delete(c.c, key)
+		c.del(key, v.v)
 	}
+	return candidates
 }
 
 func (s *inMemoryScanner) Close() {
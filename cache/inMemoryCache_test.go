@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
 )
 
 func clean() {
@@ -23,13 +26,27 @@ func clean() {
 	os.Remove("./11.fza")
 	os.Remove("./12.fza")
 	os.Remove("./metadata")
+	os.Remove("./MANIFEST")
 	os.Remove("./filter")
+	segments, _ := filepath.Glob("./*.wal")
+	for _, segment := range segments {
+		os.Remove(segment)
+	}
 }
 
 func TestClean(t *testing.T) {
 	clean()
 }
 
+// newTestCache return a cache whose lsm lives in a temporary directory of t
+func newTestCache(t *testing.T, ttl int) *inMemoryCache {
+	configure := conf.LoadConfigure()
+	configure.Persistence.Path = t.TempDir()
+	m := openInMemoryCache(configure, ttl)
+	t.Cleanup(m.lsm.Close)
+	return m
+}
+
 func produceEntry(m *inMemoryCache, start, end int) {
 	for i := start; i <= end; i++ {
 		_ = m.Set(fmt.Sprintf("key %s", strconv.Itoa(i)), []byte(fmt.Sprintf("%d", i)))
@@ -37,7 +54,7 @@ func produceEntry(m *inMemoryCache, start, end int) {
 }
 
 func TestInMemoryCache_Get(t *testing.T) {
-	m := newInMemoryCache(30)
+	m := newTestCache(t, 30)
 	produceEntry(m, 0, 1<<8)
 	for i := 0; i <= 1<<8; i++ {
 		val, _ := m.Get(fmt.Sprintf("key %s", strconv.Itoa(i)))
@@ -48,9 +65,8 @@ func TestInMemoryCache_Get(t *testing.T) {
 }
 
 func TestInMemoryCache_Concurrent(t *testing.T) {
-	clean()
 	var wg sync.WaitGroup
-	m := newInMemoryCache(30)
+	m := newTestCache(t, 30)
 	produceEntry(m, 0, 1<<8)
 	wg.Add(32)
 	for i := 0; i < 32; i++ {
@@ -66,3 +82,78 @@ func TestInMemoryCache_Concurrent(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestInMemoryCache_Scanner(t *testing.T) {
+	m := newTestCache(t, 30)
+	produceEntry(m, 0, 99)
+	// half of the keys are switched to lsm, the scanner sees both halves once
+	switched := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		switched = append(switched, fmt.Sprintf("key %d", i))
+	}
+	for len(switched) > 0 {
+		switched = m.spill(switched)
+	}
+	m.lsm.Set([]byte("key 50"), []byte("stale"))
+	seen := make(map[string]string)
+	s := m.NewScanner()
+	// the scanner reads the keys as they were when it was created
+	_ = m.Set("key 0", []byte("new"))
+	_ = m.Del("key 99")
+	for s.Scan() {
+		if _, ok := seen[s.Key()]; ok {
+			t.Fatalf("key %s is scanned twice", s.Key())
+		}
+		seen[s.Key()] = string(s.Value())
+	}
+	s.Close()
+	if len(seen) != 100 {
+		t.Fatalf("expected 100 keys but got %d", len(seen))
+	}
+	for i := 0; i < 100; i++ {
+		if v := seen[fmt.Sprintf("key %d", i)]; v != strconv.Itoa(i) {
+			t.Fatalf("expected value %d of key %d but got %s", i, i, v)
+		}
+	}
+}
+
+func TestInMemoryCache_DelSwitched(t *testing.T) {
+	m := newTestCache(t, 30)
+	_ = m.Set("Phenom", []byte("Xonlab"))
+	_ = m.Set("Frozra", []byte("Xonlab"))
+	m.spill([]string{"Phenom"})
+	if _, ok := m.c["Phenom"]; ok {
+		t.Fatal("expected the switched key to leave memory")
+	}
+	_ = m.Del("Phenom")
+	if val, _ := m.Get("Phenom"); val != nil {
+		t.Fatalf("expected the switched key to be deleted but got %s", val)
+	}
+	// a key which never left memory is deleted without a tombstone
+	sequence := m.lsm.NewSnapshot().Sequence()
+	_ = m.Del("Frozra")
+	if now := m.lsm.NewSnapshot().Sequence(); now != sequence {
+		t.Fatalf("expected no write to lsm but the sequence went from %d to %d", sequence, now)
+	}
+	// a key deleted before the switcher reaches it isn't written back
+	m.spill([]string{"Frozra"})
+	if _, ok := m.lsm.Get([]byte("Frozra")); ok {
+		t.Fatal("expected the deleted key not to be switched")
+	}
+}
+
+func TestInMemoryCache_DelSwitchedBeforeRestart(t *testing.T) {
+	configure := conf.LoadConfigure()
+	configure.Persistence.Path = t.TempDir()
+	m := openInMemoryCache(configure, 30)
+	_ = m.Set("Phenom", []byte("Xonlab"))
+	m.spill([]string{"Phenom"})
+	m.lsm.Close()
+	// the reopened cache finds the key in lsm although it never switched it
+	m = openInMemoryCache(configure, 30)
+	t.Cleanup(m.lsm.Close)
+	_ = m.Del("Phenom")
+	if val, _ := m.Get("Phenom"); val != nil {
+		t.Fatalf("expected the switched key to be deleted but got %s", val)
+	}
+}
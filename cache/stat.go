@@ -1,9 +1,23 @@
 package cache
 
+import "time"
+
 type Stat struct {
 	Count     int64
 	KeySize   int64
 	ValueSize int64
+	// BlockCacheHits and BlockCacheMisses count the lookups of keys switched to lsm
+	// which were served by its block cache and the ones which read a table
+	BlockCacheHits   uint64
+	BlockCacheMisses uint64
+	// WriteSlowdowns and WriteStalls count the writes to lsm held back because its memory tables
+	// weren't flushed fast enough, WriteStallTime is how long they were held in total
+	WriteSlowdowns uint64
+	WriteStalls    uint64
+	WriteStallTime time.Duration
+	// EvictedTables and EvictedBytes count the tables of lsm evicted to keep it within its disk quota
+	EvictedTables uint64
+	EvictedBytes  uint64
 }
 
 func (s *Stat) add(k string, v []byte) {
@@ -0,0 +1,20 @@
+// frozra-migrate upgrade the files of a data directory to the format of this release in place,
+// the node using the directory must be stopped first.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/Pheomenon/frozra/v1/persistence"
+)
+
+func main() {
+	path := flag.String("path", "./", "data directory to upgrade")
+	flag.Parse()
+	upgraded, err := persistence.Migrate(*path)
+	if err != nil {
+		log.Fatalf("migrate %s: %v", *path, err)
+	}
+	log.Printf("%d files of %s upgraded to format version %d", len(upgraded), *path, persistence.FormatVersion)
+}
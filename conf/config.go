@@ -8,10 +8,24 @@ import (
 )
 
 type Persistence struct {
-	L0Capacity      int    `yaml:"l0Capacity"`
-	MemoryTableSize int    `yaml:"memoryTableSize"`
-	L1TableSize     int    `yaml:"l1TableSize"`
-	Path            string `yaml:"path"`
+	L0Capacity          int     `yaml:"l0Capacity"`
+	MemoryTableSize     int     `yaml:"memoryTableSize"`
+	L1TableSize         int     `yaml:"l1TableSize"`
+	Path                string  `yaml:"path"`
+	WalSyncMode         string  `yaml:"walSyncMode"`
+	SortedTable         bool    `yaml:"sortedTable"`
+	MaxLevels           int     `yaml:"maxLevels"`
+	LevelSizeMultiplier int     `yaml:"levelSizeMultiplier"`
+	CompactionPolicy    string  `yaml:"compactionPolicy"`
+	Compression         string  `yaml:"compression"`
+	TableCacheSize      int     `yaml:"tableCacheSize"`
+	BlockCacheSize      int     `yaml:"blockCacheSize"`
+	MaxImmutableTables  int     `yaml:"maxImmutableTables"`
+	ValueThreshold      int     `yaml:"valueThreshold"`
+	ValueLogFileSize    int     `yaml:"valueLogFileSize"`
+	ValueLogGCRatio     float64 `yaml:"valueLogGCRatio"`
+	DiskQuota           int     `yaml:"diskQuota"`
+	EvictionPolicy      string  `yaml:"evictionPolicy"`
 }
 
 type Inmemory struct {
@@ -36,5 +50,8 @@ func LoadConfigure() Conf {
 	}
 	C.MemoryTableSize <<= 20
 	C.L1TableSize <<= 20
+	C.BlockCacheSize <<= 20
+	C.ValueLogFileSize <<= 20
+	C.DiskQuota <<= 20
 	return C
 }
@@ -6,7 +6,9 @@ import (
 
 	"github.com/Pheomenon/frozra/v1/cache"
 	"github.com/Pheomenon/frozra/v1/cluster"
+	"github.com/Pheomenon/frozra/v1/conf"
 	"github.com/Pheomenon/frozra/v1/http"
+	"github.com/Pheomenon/frozra/v1/persistence"
 	"github.com/Pheomenon/frozra/v1/tcp"
 )
 
@@ -14,7 +16,16 @@ func main() {
 	ttl := flag.Int("ttl", 30, "cache time to live")
 	node := flag.String("node", "127.0.0.1", "node address")
 	clus := flag.String("cluster", "", "cluster address")
+	rebuild := flag.Bool("recover", false, "rebuild the metadata of the data directory from its tables before starting")
 	flag.Parse()
+	if *rebuild {
+		path := conf.LoadConfigure().Persistence.Path
+		r, err := persistence.Recover(path)
+		if err != nil {
+			log.Fatalf("recover %s: %v", path, err)
+		}
+		log.Printf("%d tables of %s recovered, removed %v, quarantined %v", r.Tables, path, r.Removed, r.Quarantined)
+	}
 	log.Println("ttl is", *ttl)
 	log.Println("node is", *node)
 	log.Println("cluster is", *clus)
@@ -0,0 +1,99 @@
+package persistence
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrBatchTooLarge is returned by Commit for a batch which doesn't fit in a memory table
+var ErrBatchTooLarge = errors.New("lsm: the batch doesn't fit in a memory table")
+
+// batchEntry is a write of a batch, a deleted one writes a tombstone
+type batchEntry struct {
+	key     []byte
+	value   []byte
+	deleted bool
+	expires int64 // unix nanoseconds the write expires at, 0 never expires
+}
+
+// size return the bytes the entry takes in a memory table
+func (e batchEntry) size() int {
+	if e.expires != 0 {
+		return EntrySize(e.key, e.value) + ExpirySize
+	}
+	return EntrySize(e.key, e.value)
+}
+
+// WriteBatch collect writes to commit them together. a committed batch is logged to the wal
+// and applied to the memory table at once, readers see either all of its writes or none of them
+// and a crash never keeps some of them without the others.
+type WriteBatch struct {
+	lsm     *Lsm
+	entries []batchEntry
+	size    int
+}
+
+// NewWriteBatch return an empty batch of writes to l
+func (l *Lsm) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{lsm: l}
+}
+
+// MaxBatchSize return the largest size a batch can be committed with, see WriteBatch.Size
+func (l *Lsm) MaxBatchSize() int {
+	return l.setting.MemoryTableSize
+}
+
+// EntrySize return the size a write of key and value takes in a memory table and adds to a batch,
+// lengths(8) + key + value + sequence(8)
+func EntrySize(key, value []byte) int {
+	return 16 + len(key) + len(value)
+}
+
+// ExpirySize is what an expiry adds to the size of a write, see EntrySize
+const ExpirySize = expirySize
+
+// Put add a write of value to key, both of them are copied
+func (b *WriteBatch) Put(key, value []byte) {
+	b.add(batchEntry{key: append([]byte{}, key...), value: append([]byte{}, value...)})
+}
+
+// PutExpiring add a write of value to key which expires at expires, see Lsm.SetExpiring
+func (b *WriteBatch) PutExpiring(key, value []byte, expires time.Time) {
+	b.add(batchEntry{key: append([]byte{}, key...), value: append([]byte{}, value...), expires: expiryOf(expires)})
+}
+
+// Delete add a tombstone of key, key is copied
+func (b *WriteBatch) Delete(key []byte) {
+	b.add(batchEntry{key: append([]byte{}, key...), deleted: true})
+}
+
+func (b *WriteBatch) add(e batchEntry) {
+	b.entries = append(b.entries, e)
+	b.size += e.size()
+}
+
+// Len return the number of writes in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Size return the bytes the batch takes in a memory table
+func (b *WriteBatch) Size() int {
+	return b.size
+}
+
+// Commit apply every write of the batch and return once they're logged as the wal sync mode makes them,
+// the batches committed at the same time are synced together. the batch is empty afterwards,
+// a batch which is refused is dropped as well.
+func (b *WriteBatch) Commit() error {
+	if len(b.entries) == 0 {
+		return nil
+	}
+	entries, size := b.entries, b.size
+	b.entries, b.size = nil, 0
+	if size > b.lsm.MaxBatchSize() {
+		return ErrBatchTooLarge
+	}
+	b.lsm.submit(&request{entries: entries})
+	return nil
+}
@@ -0,0 +1,76 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
+)
+
+func TestWriteBatch(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.MemoryTableSize = 64 << 10
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Set([]byte("deleted"), []byte("Phenom"))
+	// batches committed at the same time are logged together
+	var wg sync.WaitGroup
+	for b := 0; b < 8; b++ {
+		wg.Add(1)
+		go func(b int) {
+			defer wg.Done()
+			batch := l.NewWriteBatch()
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("key %d", b*100+i))
+				batch.Put(key, key)
+				// the batch holds its own copy
+				key[0] = 'x'
+			}
+			if b == 0 {
+				batch.Delete([]byte("deleted"))
+			}
+			if err := batch.Commit(); err != nil || batch.Len() != 0 {
+				t.Errorf("expected batch %d to be committed but got %v", b, err)
+			}
+		}(b)
+	}
+	wg.Wait()
+	check := func() {
+		for i := 0; i < 800; i++ {
+			key := []byte(fmt.Sprintf("key %d", i))
+			if val, _ := l.Get(key); !bytes.Equal(val, key) {
+				t.Fatalf("expected value %s but got %s", key, val)
+			}
+		}
+		if _, ok := l.Get([]byte("deleted")); ok {
+			t.Fatal("expected the key deleted by the batch to be gone")
+		}
+	}
+	check()
+
+	batch := l.NewWriteBatch()
+	batch.Put([]byte("large"), make([]byte, l.MaxBatchSize()))
+	if err = batch.Commit(); err != ErrBatchTooLarge {
+		t.Fatalf("expected a batch larger than a memory table to be refused but got %v", err)
+	}
+	// the refused batch is dropped, so the batch takes writes again
+	batch.Put([]byte("small"), []byte("froza"))
+	if err = batch.Commit(); err != nil {
+		t.Fatalf("expected the batch to be committed after a refused one but got %v", err)
+	}
+	if val, ok := l.Get([]byte("small")); !ok || string(val) != "froza" {
+		t.Fatalf("expected the write of the batch but got %q", val)
+	}
+	l.Close()
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	l.Close()
+}
@@ -0,0 +1,120 @@
+package persistence
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// blockCacheShards is the number of shards of the block cache, each of them is locked on its own
+const blockCacheShards = 16
+
+// CacheStats count the blocks the lookups found in the block cache and the ones read from tables,
+// Size is the bytes of blocks the cache holds.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int64
+}
+
+// blockKey is the block of table starting at start in the uncompressed data
+type blockKey struct {
+	table uint32
+	start uint32
+}
+
+// blockCache keep the blocks lookups read lately verified and decompressed, up to a budget of bytes
+// split evenly over its shards. every shard evicts its least recently used blocks.
+// the blocks of a table are dropped once the table is removed, so they don't take the budget of live ones.
+type blockCache struct {
+	shards [blockCacheShards]*blockShard
+	hits   uint64
+	misses uint64
+}
+
+type blockShard struct {
+	capacity int64
+	size     int64
+	lru      *list.List // of *cachedBlock, the most recently used first
+	blocks   map[blockKey]*list.Element
+	sync.Mutex
+}
+
+type cachedBlock struct {
+	key   blockKey
+	block []byte
+}
+
+func newBlockCache(capacity int) *blockCache {
+	c := &blockCache{}
+	for i := range c.shards {
+		c.shards[i] = &blockShard{
+			capacity: int64(capacity / blockCacheShards),
+			lru:      list.New(),
+			blocks:   map[blockKey]*list.Element{},
+		}
+	}
+	return c
+}
+
+func (c *blockCache) shard(key blockKey) *blockShard {
+	return c.shards[(key.table*31+key.start/blockSize)%blockCacheShards]
+}
+
+// get return the block of key, the block must not be modified
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.blocks[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	s.lru.MoveToFront(e)
+	return e.Value.(*cachedBlock).block, true
+}
+
+// put cache block as the block of key, a block larger than a shard isn't cached
+func (c *blockCache) put(key blockKey, block []byte) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.blocks[key]; ok || int64(len(block)) > s.capacity {
+		return
+	}
+	s.blocks[key] = s.lru.PushFront(&cachedBlock{key: key, block: block})
+	s.size += int64(len(block))
+	for s.size > s.capacity {
+		evicted := s.lru.Remove(s.lru.Back()).(*cachedBlock)
+		delete(s.blocks, evicted.key)
+		s.size -= int64(len(evicted.block))
+	}
+}
+
+// removeTable drop the blocks of table
+func (c *blockCache) removeTable(table uint32) {
+	for _, s := range c.shards {
+		s.Lock()
+		for key, e := range s.blocks {
+			if key.table != table {
+				continue
+			}
+			s.lru.Remove(e)
+			delete(s.blocks, key)
+			s.size -= int64(len(e.Value.(*cachedBlock).block))
+		}
+		s.Unlock()
+	}
+}
+
+func (c *blockCache) stats() CacheStats {
+	stats := CacheStats{Hits: atomic.LoadUint64(&c.hits), Misses: atomic.LoadUint64(&c.misses)}
+	for _, s := range c.shards {
+		s.Lock()
+		stats.Size += s.size
+		s.Unlock()
+	}
+	return stats
+}
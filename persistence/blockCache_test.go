@@ -0,0 +1,67 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	c := newBlockCache(blockCacheShards * 100)
+	key := blockKey{table: 1, start: 0}
+	if _, ok := c.get(key); ok {
+		t.Fatal("expected an empty cache to miss")
+	}
+	c.put(key, make([]byte, 60))
+	if _, ok := c.get(key); !ok {
+		t.Fatal("expected the block to be cached")
+	}
+	// the shard of key holds 100 bytes, the block read last is kept
+	c.put(blockKey{table: 1 + blockCacheShards, start: 0}, make([]byte, 60))
+	if _, ok := c.get(key); ok {
+		t.Fatal("expected the least recently used block to be evicted")
+	}
+	c.put(blockKey{table: 2, start: 0}, make([]byte, 101))
+	if stats := c.stats(); stats.Hits != 1 || stats.Misses != 2 || stats.Size != 60 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestBlockCacheRemoveTable(t *testing.T) {
+	c := newBlockCache(blockCacheShards * 1000)
+	for start := uint32(0); start < 4*blockSize; start += blockSize {
+		c.put(blockKey{table: 1, start: start}, make([]byte, 10))
+		c.put(blockKey{table: 2, start: start}, make([]byte, 10))
+	}
+	c.removeTable(1)
+	if _, ok := c.get(blockKey{table: 1, start: blockSize}); ok {
+		t.Fatal("expected the blocks of table 1 to be dropped")
+	}
+	if _, ok := c.get(blockKey{table: 2, start: blockSize}); !ok {
+		t.Fatal("expected the blocks of table 2 to be kept")
+	}
+	if stats := c.stats(); stats.Size != 40 {
+		t.Fatalf("expected 40 bytes to be cached but got %d", stats.Size)
+	}
+}
+
+func TestLsm_BlockCache(t *testing.T) {
+	dir := t.TempDir()
+	l := initLSM(t, dir)
+	produceEntry(l, 0, 1000)
+	l.Close()
+	l = initLSM(t, dir)
+	defer l.Close()
+	for round := 0; round < 2; round++ {
+		for i := 0; i <= 1000; i++ {
+			val, _ := l.Get([]byte(fmt.Sprintf("key %d", i)))
+			if !bytes.Equal(val, []byte(fmt.Sprintf("%d", i))) {
+				t.Fatalf("expected value %d but got %s", i, val)
+			}
+		}
+	}
+	stats := l.CacheStats()
+	if stats.Misses == 0 || stats.Hits < 1000 || stats.Size == 0 {
+		t.Fatalf("expected the second round to be served by the block cache but got %+v", stats)
+	}
+}
@@ -0,0 +1,119 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// blockSize is the amount of data a block index handle covers in a sorted table
+const blockSize = 4 << 10
+
+// blockIndex keep the first key of every block of a sorted table,
+// a scan seeks the block its start key falls in and reads on from there.
+// it's saved between the hash index and the file info as
+// count(4) + (offset(4) + klen(4) + key) for every block.
+type blockIndex struct {
+	keys    [][]byte
+	offsets []uint32
+}
+
+func newBlockIndex() *blockIndex {
+	return &blockIndex{
+		keys:    make([][]byte, 0),
+		offsets: make([]uint32, 0),
+	}
+}
+
+// add start a new block at offset once the last one is full,
+// entries have to be added in ascending key order.
+func (b *blockIndex) add(key []byte, offset uint32) {
+	if len(b.offsets) > 0 && offset-b.offsets[len(b.offsets)-1] < blockSize {
+		return
+	}
+	b.keys = append(b.keys, append([]byte{}, key...))
+	b.offsets = append(b.offsets, offset)
+}
+
+// seek return the offset of the block which may hold key
+func (b *blockIndex) seek(key []byte) uint32 {
+	// first block whose first key isn't less than key, key starts in the block before it
+	// unless it's the first one. the versions of a key may go on across blocks.
+	i := sort.Search(len(b.keys), func(i int) bool {
+		return bytes.Compare(b.keys[i], key) >= 0
+	})
+	if i == 0 {
+		return 0
+	}
+	return b.offsets[i-1]
+}
+
+func (b *blockIndex) encode() []byte {
+	buf := new(bytes.Buffer)
+	head := make([]byte, 8)
+	binary.BigEndian.PutUint32(head[0:4], uint32(len(b.keys)))
+	buf.Write(head[0:4])
+	for i, key := range b.keys {
+		binary.BigEndian.PutUint32(head[0:4], b.offsets[i])
+		binary.BigEndian.PutUint32(head[4:8], uint32(len(key)))
+		buf.Write(head)
+		buf.Write(key)
+	}
+	return buf.Bytes()
+}
+
+func decodeBlockIndex(buf []byte) (*blockIndex, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("block index: %d bytes are too short", len(buf))
+	}
+	count := binary.BigEndian.Uint32(buf[0:4])
+	buf = buf[4:]
+	b := newBlockIndex()
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < 8 {
+			return nil, fmt.Errorf("block index: handle %d is truncated", i)
+		}
+		offset := binary.BigEndian.Uint32(buf[0:4])
+		keyLength := binary.BigEndian.Uint32(buf[4:8])
+		buf = buf[8:]
+		if uint32(len(buf)) < keyLength {
+			return nil, fmt.Errorf("block index: key of handle %d is truncated", i)
+		}
+		b.keys = append(b.keys, buf[:keyLength])
+		b.offsets = append(b.offsets, offset)
+		buf = buf[keyLength:]
+	}
+	return b, nil
+}
+
+// sortEntries copy the entries the index points to in ascending key order,
+// it returns the new content along with its hash index and block index.
+func sortEntries(data []byte, idx *hashIndex) ([]byte, *hashIndex, *blockIndex) {
+	type entry struct{ hash, position uint32 }
+	entries := make([]entry, 0, idx.len())
+	idx.forEach(func(hash uint32, position uint32) {
+		entries = append(entries, entry{hash, position})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		ki, _, _ := decodeEntry(data, entries[i].position)
+		kj, _, _ := decodeEntry(data, entries[j].position)
+		if cmp := bytes.Compare(ki, kj); cmp != 0 {
+			return cmp < 0
+		}
+		// the versions of a key stay from the newest to the oldest
+		return sequenceAt(data, entries[i].position) > sequenceAt(data, entries[j].position)
+	})
+	content := new(bytes.Buffer)
+	content.Grow(len(data))
+	offsets := newHashIndex()
+	blocks := newBlockIndex()
+	for _, e := range entries {
+		key, _, _ := decodeEntry(data, e.position)
+		offset := uint32(content.Len())
+		offsets.insert(e.hash, offset)
+		blocks.add(key, offset)
+		content.Write(entryAt(data, e.position))
+	}
+	return content.Bytes(), offsets, blocks
+}
@@ -0,0 +1,63 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// bitsPerKey is the size of a table's bloom filter for every entry, it lets about 1% of the misses through
+const bitsPerKey = 10
+
+// tableFilter is the bloom filter of a table's checksums, it's saved in the table's footer
+// behind the block handles as probes(4) + bits and probed right where it's read from.
+// every probe is derived from the checksum by double hashing, like leveldb does.
+// an empty filter is the one of a table written before there were filters, it may contain anything.
+type tableFilter []byte
+
+// newTableFilter return the filter of every checksum in keys
+func newTableFilter(keys tableKeys) tableFilter {
+	bits := keys.len() * bitsPerKey
+	// a tiny filter has a high false positive rate
+	if bits < 64 {
+		bits = 64
+	}
+	// ln(2) * bitsPerKey probes make the fewest false positives
+	probes := uint32(bitsPerKey * 69 / 100)
+	f := make(tableFilter, 4+(bits+7)/8)
+	binary.BigEndian.PutUint32(f[0:4], probes)
+	bits = (len(f) - 4) * 8
+	keys.forEach(func(hash uint32, _ uint32) {
+		delta := hash>>17 | hash<<15
+		for i := uint32(0); i < probes; i++ {
+			bit := hash % uint32(bits)
+			f[4+bit/8] |= 1 << (bit % 8)
+			hash += delta
+		}
+	})
+	return f
+}
+
+func decodeTableFilter(buf []byte) (tableFilter, error) {
+	if len(buf) < 5 {
+		return nil, fmt.Errorf("bloom filter: %d bytes are too short", len(buf))
+	}
+	return tableFilter(buf), nil
+}
+
+// mayContain report whether the table may hold an entry of hash
+func (f tableFilter) mayContain(hash uint32) bool {
+	if len(f) == 0 {
+		return true
+	}
+	probes := binary.BigEndian.Uint32(f[0:4])
+	bits := uint32(len(f)-4) * 8
+	delta := hash>>17 | hash<<15
+	for i := uint32(0); i < probes; i++ {
+		bit := hash % bits
+		if f[4+bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		hash += delta
+	}
+	return true
+}
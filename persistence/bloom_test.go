@@ -0,0 +1,39 @@
+package persistence
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+func TestTableFilter(t *testing.T) {
+	hashMap := newHashMap(1 << 20)
+	for i := 0; i < 10000; i++ {
+		hashMap.Set([]byte(fmt.Sprintf("key %d", i)), []byte("Phenom"))
+	}
+	hashMap.persistence("./", 1)
+	tb := readTable("./", 1)
+	defer removeTestTable(1)
+	if len(tb.filter) == 0 {
+		t.Fatal("expected the table to have a bloom filter")
+	}
+	for i := 0; i < 10000; i++ {
+		if !tb.filter.mayContain(util.Hashing([]byte(fmt.Sprintf("key %d", i)))) {
+			t.Fatalf("expected key %d to pass the filter", i)
+		}
+	}
+	passed := 0
+	for i := 10000; i < 20000; i++ {
+		if tb.filter.mayContain(util.Hashing([]byte(fmt.Sprintf("key %d", i)))) {
+			passed++
+		}
+	}
+	if passed > 200 {
+		t.Fatalf("expected about 1%% of the missing keys to pass the filter but %d did", passed)
+	}
+	// a table written before there were filters may contain anything
+	if !tableFilter(nil).mayContain(1) {
+		t.Fatal("expected an empty filter to let every checksum through")
+	}
+}
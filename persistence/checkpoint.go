@@ -0,0 +1,131 @@
+package persistence
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+// Checkpoint write a copy of the node as it is now to dir, which opens with New as a data directory
+// of its own. the memory tables are flushed first, then compaction and the value log gc are paused
+// while a manifest of the current tables is written and the tables and value log segments are
+// hard linked into dir. they are copied when dir is on another file system.
+// dir must be empty or not exist yet, writes go on meanwhile but only the ones before the call are kept.
+func (l *Lsm) Checkpoint(dir string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(absDir, 0755); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(absDir)
+	if err != nil {
+		return err
+	}
+	if len(infos) > 0 {
+		return fmt.Errorf("checkpoint: %s is not empty", absDir)
+	}
+	l.vlogMutex.Lock()
+	defer l.vlogMutex.Unlock()
+	l.flush()
+	l.compactMutex.Lock()
+	defer l.compactMutex.Unlock()
+	files, err := l.metadata.checkpoint(absDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err = linkFile(util.TablePath(l.absPath, f.Index), util.TablePath(absDir, f.Index)); err != nil {
+			return err
+		}
+	}
+	if err = l.vlog.link(absDir); err != nil {
+		return err
+	}
+	return syncDir(absDir)
+}
+
+// flush swap the memory table out and wait until every memory table swapped so far is flushed
+func (l *Lsm) flush() {
+	l.submit(&request{flush: true})
+	l.Lock()
+	defer l.Unlock()
+	if len(l.immutables) == 0 {
+		return
+	}
+	// memory tables are flushed in the order they are swapped
+	last := l.immutables[len(l.immutables)-1]
+	for queued(l.immutables, last) {
+		l.flushed.Wait()
+	}
+}
+
+func queued(immutables []*hashMap, h *hashMap) bool {
+	for _, immutable := range immutables {
+		if immutable == h {
+			return true
+		}
+	}
+	return false
+}
+
+// checkpoint write a manifest of the metadata to dir and return every table of it
+func (m *metadata) checkpoint(dir string) ([]tableMetadata, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if _, err := m.writeManifest(dir); err != nil {
+		return nil, err
+	}
+	files := make([]tableMetadata, 0)
+	for _, level := range m.Levels {
+		files = append(files, level...)
+	}
+	return files, nil
+}
+
+// link seal the head segment and hard link every segment into dir, so none of them changes anymore
+func (v *valueLog) link(dir string) error {
+	v.Lock()
+	defer v.Unlock()
+	if v.head != nil {
+		if err := v.head.Sync(); err != nil {
+			return err
+		}
+		v.head = nil
+	}
+	for segment := range v.segments {
+		if err := linkFile(vlogPath(v.absPath, segment), vlogPath(dir, segment)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkFile hard link src to dst, src is copied if it can't be linked
+func linkFile(src, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
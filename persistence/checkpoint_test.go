@@ -0,0 +1,59 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
+)
+
+func TestCheckpoint(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.ValueThreshold = 64
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	produceEntry(l, 0, 100)
+	l.Close()
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keys only the memory table holds are flushed by the checkpoint
+	produceEntry(l, 101, 200)
+	large := bytes.Repeat([]byte("Phenom"), 100)
+	l.Set([]byte("large"), large)
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	if err = l.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Checkpoint(dir); err == nil {
+		t.Fatal("expected a checkpoint into a directory which isn't empty to be refused")
+	}
+	produceEntry(l, 201, 300)
+	l.Delete([]byte("key 0"))
+	l.Close()
+
+	setting.Persistence.Path = dir
+	c, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= 200; i++ {
+		val, _ := c.Get([]byte(fmt.Sprintf("key %d", i)))
+		if !bytes.Equal(val, []byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("expected value %d but got %s", i, val)
+		}
+	}
+	if val, _ := c.Get([]byte("large")); !bytes.Equal(val, large) {
+		t.Fatalf("expected the value kept in the value log but got %.20s", val)
+	}
+	if _, ok := c.Get([]byte("key 201")); ok {
+		t.Fatal("expected the writes after the checkpoint to be left out")
+	}
+	c.Close()
+}
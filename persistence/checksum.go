@@ -0,0 +1,41 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// corruptionError report a table whose content doesn't match its checksums
+type corruptionError struct {
+	index  uint32
+	reason string
+}
+
+func (e *corruptionError) Error() string {
+	return fmt.Sprintf("table %d.fza is corrupt: %s", e.index, e.reason)
+}
+
+// corruptTable return the index of the table err reports corrupt
+func corruptTable(err error) (uint32, bool) {
+	var c *corruptionError
+	if errors.As(err, &c) {
+		return c.index, true
+	}
+	return 0, false
+}
+
+// footerChecksum return the CRC of a table's footer, which is everything behind its data:
+// the indexes, the block handles and the file info without its own checksum.
+func footerChecksum(footer []byte) uint32 {
+	c := crc32.New(CrcTable)
+	_, _ = c.Write(footer[:len(footer)-20])
+	_, _ = c.Write(footer[len(footer)-16:])
+	return c.Sum32()
+}
+
+// sealFooter save the checksum of footer in its file info, which is its last 32 bytes
+func sealFooter(footer []byte) {
+	binary.BigEndian.PutUint32(footer[len(footer)-20:len(footer)-16], footerChecksum(footer))
+}
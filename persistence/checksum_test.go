@@ -0,0 +1,62 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// corruptTestTable flip a byte of table idx, offset counts from the end of the file when it's negative
+func corruptTestTable(t *testing.T, idx uint32, offset int) {
+	name := fmt.Sprintf("./%d.fza", idx)
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset < 0 {
+		offset += len(content)
+	}
+	content[offset] ^= 0xff
+	err = ioutil.WriteFile(name, content, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptBlock(t *testing.T) {
+	tb := testTable("phenom", "frozra", 0, 1000, 1)
+	defer removeTestTable(1)
+	first, _, _ := tb.entry(0)
+	first = append([]byte{}, first...)
+	last, _, _ := tb.entry(tb.handles.handles[len(tb.handles.handles)-1].start)
+	last = append([]byte{}, last...)
+	tb.close()
+	tb.release()
+	corruptTestTable(t, 1, 10)
+	tb = readTable("./", 1)
+	// only the first block is corrupt, the others are still readable
+	if _, _, ok, err := searchKey(tb, last, latest); err != nil || !ok {
+		t.Fatalf("expected an intact block to be read but got %v", err)
+	}
+	_, _, _, err := searchKey(tb, first, latest)
+	if index, ok := corruptTable(err); !ok || index != 1 {
+		t.Fatalf("expected table 1 to be corrupt but got %v", err)
+	}
+	// the table stays corrupt for every later read
+	if _, _, _, err = searchKey(tb, last, latest); err == nil {
+		t.Fatal("expected the corrupt table to fail every read")
+	}
+}
+
+func TestCorruptFooter(t *testing.T) {
+	tb := testTable("phenom", "frozra", 0, 100, 1)
+	tb.close()
+	tb.release()
+	defer removeTestTable(1)
+	// a byte of the block handles right before the file info
+	corruptTestTable(t, 1, -33)
+	_, err := openTable("./", 1)
+	if _, ok := corruptTable(err); !ok {
+		t.Fatalf("expected a corrupt footer to be reported but got %v", err)
+	}
+}
@@ -13,24 +13,32 @@ type compactionStrategy struct {
 	tableIDs []uint32
 }
 
-func (m *metadata) l1Status(victim tableMetadata) compactionStrategy {
+// levelStatus decide how victim of level is pushed down to the next level.
+// NOTUNION means no table of the next level overlaps victim, UNION means a single one covers it
+// and OVERLAPPING means victim has to be merged with every table it overlaps.
+func (m *metadata) levelStatus(level int, victim tableMetadata) compactionStrategy {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 	cs := compactionStrategy{
 		tableIDs: make([]uint32, 0),
 		strategy: NOTUNION,
 	}
-
-	for _, l1File := range m.L1Files {
-		// If there is a union, will merge both directly
-		if (l1File.MinRange <= victim.MinRange && l1File.MaxRange >= victim.MaxRange) || (l1File.MinRange >= victim.MinRange && l1File.MaxRange <= victim.MaxRange) {
-			cs.strategy = UNION
-			cs.tableIDs = append(cs.tableIDs, l1File.Index)
-			return cs
-		} else if (l1File.MinRange <= victim.MinRange && l1File.MaxRange > victim.MinRange) || (l1File.MinRange < victim.MaxRange && l1File.MaxRange >= victim.MaxRange) {
-			cs.strategy = OVERLAPPING
-			cs.tableIDs = append(cs.tableIDs, l1File.Index)
+	if level+1 >= len(m.Levels) {
+		return cs
+	}
+	covered := false
+	for _, file := range m.Levels[level+1] {
+		if file.MinRange > victim.MaxRange || file.MaxRange < victim.MinRange {
+			continue
 		}
+		cs.tableIDs = append(cs.tableIDs, file.Index)
+		covered = file.MinRange <= victim.MinRange && file.MaxRange >= victim.MaxRange
+	}
+	switch {
+	case len(cs.tableIDs) == 1 && covered:
+		cs.strategy = UNION
+	case len(cs.tableIDs) > 0:
+		cs.strategy = OVERLAPPING
 	}
 	return cs
 }
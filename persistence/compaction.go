@@ -1,89 +1,305 @@
 package persistence
 
 import (
-	"hash/crc32"
+	"bytes"
+	"container/heap"
+	"fmt"
+	"sort"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/Pheomenon/frozra/v1/persistence/util"
 )
 
-func (l *Lsm) notUnion(l0f tableMetadata) {
-	newTable := readTable(l.absPath, l0f.Index)
-	l.l1Maintainer.addTable(newTable)
-	l.l0Maintainer.delTable(l0f.Index)
-	l.metadata.addL1File(uint32(newTable.fileInfo.entries), newTable.fileInfo.minRange, newTable.fileInfo.maxRange, int(newTable.size), l0f.Index)
-	l.metadata.delL0File(l0f.Index)
-	logrus.Info("compaction: NOT UNION found so simply pushing the l0 file to l1")
+// shadowed report whether a table out of the ones being compacted may still hold a value of hash
+// which a tombstone written at level has to hide. those are the l0 tables, which are pushed
+// down later, and the tables of the deeper levels.
+func (l *Lsm) shadowed(level int, compacting ...uint32) func(hash uint32) bool {
+	return func(hash uint32) bool {
+		return l.l0Maintainer.mayContain(hash, compacting...) || l.metadata.mayContain(level+1, hash)
+	}
+}
+
+// compact run c, the victims are merged with the tables they overlap in the output level.
+// a single victim which overlaps nothing is moved as it is. a corrupt table is quarantined and
+// the rest of the plan goes on without it, any other failure leaves the levels as they are and is returned.
+func (l *Lsm) compact(c Compaction) error {
+	// an earlier compaction of the same plan may have taken some victims
+	victims := make([]tableMetadata, 0, len(c.Victims))
+	for _, idx := range c.Victims {
+		if f, ok := l.metadata.file(c.Level, idx); ok {
+			victims = append(victims, f)
+		}
+	}
+	if len(victims) == 0 {
+		return nil
+	}
+	overlapped := make([]uint32, 0)
+	if c.Output > c.Level {
+		span := victims[0]
+		for _, f := range victims[1:] {
+			if f.MinRange < span.MinRange {
+				span.MinRange = f.MinRange
+			}
+			if f.MaxRange > span.MaxRange {
+				span.MaxRange = f.MaxRange
+			}
+		}
+		cs := l.metadata.levelStatus(c.Level, span)
+		if cs.strategy == NOTUNION && len(victims) == 1 {
+			return l.move(c.Level, victims[0])
+		}
+		switch cs.strategy {
+		case NOTUNION:
+			logrus.Infof("compaction: NOT UNION found, merge %d level %d files into level %d", len(victims), c.Level, c.Output)
+		case UNION:
+			logrus.Infof("compaction: UNION SET found, merge %d level %d files with level %d %d.fza", len(victims), c.Level, c.Output, cs.tableIDs[0])
+		default:
+			logrus.Infof("compaction: OVERLAPPING found, merge %d level %d files with %d level %d files", len(victims), c.Level, len(cs.tableIDs), c.Output)
+		}
+		overlapped = cs.tableIDs
+	} else {
+		logrus.Infof("compaction: merge %d level %d files into one", len(victims), c.Level)
+	}
+	indexes := make([]uint32, 0, len(victims)+len(overlapped))
+	for _, f := range victims {
+		indexes = append(indexes, f.Index)
+	}
+	indexes = append(indexes, overlapped...)
+	tables := make([]*table, 0, len(indexes))
+	defer func() {
+		for _, t := range tables {
+			t.close()
+			t.release()
+		}
+	}()
+	for _, idx := range indexes {
+		t, err := openTable(l.absPath, idx)
+		if err != nil {
+			// nothing has been written yet
+			return l.dropCorrupt(err)
+		}
+		tables = append(tables, t)
+	}
+	edit := &versionEdit{}
+	if err := l.merge(c.Output, tables, edit); err != nil {
+		return l.dropCorrupt(err)
+	}
+	for _, f := range victims {
+		edit.del(c.Level, f.Index)
+	}
+	for _, idx := range overlapped {
+		edit.del(c.Output, idx)
+	}
+	// the new tables replace the compacted ones in a single edit, a crash leaves either of them
+	l.commit(edit)
+	l.install(edit)
+	return nil
+}
+
+// move push victim down to the next level as it is, no table there overlaps it. see compact for its errors.
+func (l *Lsm) move(level int, victim tableMetadata) error {
+	t, err := openTable(l.absPath, victim.Index)
+	if err != nil {
+		return l.dropCorrupt(err)
+	}
+	t.close()
+	t.release()
+	edit := &versionEdit{}
+	edit.add(level+1, victim)
+	edit.del(level, victim.Index)
+	l.commit(edit)
+	l.install(edit)
+	logrus.Infof("compaction: NOT UNION found so simply pushing level %d %d.fza to level %d", level, victim.Index, level+1)
+	return nil
 }
 
-func (l *Lsm) union(cs compactionStrategy, l0f tableMetadata) {
-	t1, t2 := readTable(l.absPath, l0f.Index), readTable(l.absPath, cs.tableIDs[0])
-	l.merge(t1, t2)
-	logrus.Infof("compaction: UNION SET found, merge l0 %d.fza minimum checksum: %d maximum checksum: %d with l1 %d.fza minimum checksum: %d maximum checksum: %d then pushed to l1", t1.ID(), t1.fileInfo.minRange, t1.fileInfo.maxRange, t2.ID(), t2.fileInfo.minRange, t2.fileInfo.maxRange)
-	t1.close()
-	l.l0Maintainer.delTable(t1.ID())
-	l.metadata.delL0File(t1.ID())
-	util.RemoveTable(l.absPath, t1.ID())
-	logrus.Infof("compaction: l0 file has been deleted %d", t1.ID())
-	t2.close()
-	l.l1Maintainer.delTable(t2.ID())
-	l.metadata.delL1File(t2.ID())
-	util.RemoveTable(l.absPath, t2.ID())
-	logrus.Infof("compaction: l1 file has been deleted %d", t2.ID())
+// merge write the entries of tables into new tables of level, tables are listed from the newest
+// to the oldest and a newer entry overrides the older ones of its key. new tables are cut at the max
+// table size at every level and don't overlap each other, so neither a new table nor the memory a merge
+// takes grows with its input, a sorted table is kept in memory until it's written.
+// the new tables are added to edit, nothing is added when the merge fails and its error is returned.
+func (l *Lsm) merge(level int, tables []*table, edit *versionEdit) error {
+	return l.stream(level, tables, uint32(l.setting.L1TableSize), edit)
 }
 
-//TODO: need to optimize!
-func (l *Lsm) overlapping(cs compactionStrategy, l0f tableMetadata) {
-	logrus.Infof("compaction: OVERLAPPING found")
-	mergers := []*tableMerger{}
-	// if the the value is not in the range, we'll create a new file and append everything in it
-	var extraBuilder *tableMerger
-	for _, idx := range cs.tableIDs {
-		t := readTable(l.absPath, idx)
-		t.SeekBegin()
-		merger := newTableMerger(int(t.size))
-		// mergers will load all l1 file to memory ......
-		merger.append(t.fp, int64(t.fileInfo.metaOffset))
-		merger.merge(t.offsetMap, 0)
-		mergers = append(mergers, merger)
-	}
-	toCompacT := readTable(l.absPath, l0f.Index)
-	iter := toCompacT.iter()
-	for iter.hasNext() {
-		kl, vl, key, val := iter.next()
-		c := crc32.New(CrcTable)
-		c.Write(key)
-		hash := c.Sum32()
-		for _, builder := range mergers {
-			if hash >= builder.Min() && hash <= builder.Max() {
-				c := crc32.New(CrcTable)
-				c.Write(key)
-				hash := c.Sum32()
-				builder.add(kl, vl, key, val, hash)
-				continue
+// stream read the live entries of tables in checksum order and write the newest entry of every key
+// to new tables of level as it goes, so a merge holds a single entry of every table in memory.
+// the older versions of a key which a live snapshot sees are written behind its newest entry.
+// a new table is started once the last one holds limit bytes of entries, 0 means there is no limit,
+// the entries of one checksum always stay in one table. see merge.
+func (l *Lsm) stream(level int, tables []*table, limit uint32, edit *versionEdit) error {
+	h := make(mergeHeap, 0, len(tables))
+	compacting := make([]uint32, 0, len(tables))
+	for age, t := range tables {
+		compacting = append(compacting, t.ID())
+		c := &mergeCursor{t: t, reader: t.reader(), age: age}
+		if c.next() {
+			h = append(h, c)
+		}
+		if err := t.corruption(); err != nil {
+			return err
+		}
+	}
+	heap.Init(&h)
+	shadowed := l.shadowed(level, compacting...)
+	sequence := l.metadata.newest(compacting...)
+	written := make([]*tableWriter, 0)
+	var w *tableWriter
+	// a table written before the merge fails is left to Recover, it's never committed
+	fail := func(err error) error {
+		if w != nil {
+			w.abort()
+		}
+		for _, w := range written {
+			util.RemoveTable(l.absPath, w.index)
+		}
+		return err
+	}
+	var lastKey []byte
+	var lastHash uint32
+	var lastSequence uint64
+	pinned := l.snapshots.sequences()
+	// an expired entry is either dropped or kept as a tombstone, they're counted apart
+	dropped, expiredDropped, expiredKept := 0, 0, 0
+	for h.Len() > 0 {
+		c := h[0]
+		// the newest entry of a key comes first, an older one is only kept for a snapshot which sees it
+		newest := lastKey == nil || c.hash != lastHash || !bytes.Equal(c.key, lastKey)
+		if newest || retained(pinned, lastSequence, c.sequence) {
+			lastKey, lastHash = append(lastKey[:0], c.key...), c.hash
+			entry := c.entry
+			_, _, deleted := decodeEntry(entry, 0)
+			lapsed := deleted && entryExpiry(entry) != 0
+			if lapsed {
+				// an expired entry only stays as a tombstone which hides the older entries of its key
+				entry = expire(entry)
 			}
-			if extraBuilder == nil {
-				extraBuilder = newTableMerger(10000000)
+			switch {
+			case newest && deleted && hidden(pinned, c.sequence) && !shadowed(c.hash):
+				// nothing out of this merge is left for the tombstone to hide
+				if lapsed {
+					expiredDropped++
+				} else {
+					dropped++
+				}
+			case w != nil && limit > 0 && w.size >= limit && c.hash != w.max:
+				if err := w.finish(); err != nil {
+					return fail(fmt.Errorf("unable to write new level %d table %d.fza %v", level, w.index, err))
+				}
+				written = append(written, w)
+				w = nil
+				fallthrough
+			default:
+				if w == nil {
+					var err error
+					w, err = newTableWriter(l.absPath, l.metadata.nextFileID(), l.codec, l.setting.SortedTable)
+					if err != nil {
+						return fail(fmt.Errorf("unable to create new level %d table %v", level, err))
+					}
+				}
+				if err := w.add(entry, c.hash); err != nil {
+					return fail(fmt.Errorf("unable to write new level %d table %d.fza %v", level, w.index, err))
+				}
+				if lapsed {
+					expiredKept++
+				}
 			}
-			c := crc32.New(CrcTable)
-			c.Write(key)
-			hash := c.Sum32()
-			extraBuilder.add(kl, vl, key, val, hash)
 		}
+		lastSequence = c.sequence
+		if c.next() {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+		if err := c.t.corruption(); err != nil {
+			return fail(err)
+		}
+	}
+	if w != nil {
+		if err := w.finish(); err != nil {
+			return fail(fmt.Errorf("unable to write new level %d table %d.fza %v", level, w.index, err))
+		}
+		written = append(written, w)
+	}
+	if dropped > 0 {
+		logrus.Infof("compaction: %d tombstones dropped", dropped)
+	}
+	if expiredDropped > 0 {
+		logrus.Infof("compaction: %d expired entries dropped", expiredDropped)
+	}
+	if expiredKept > 0 {
+		logrus.Infof("compaction: %d expired entries kept as tombstones", expiredKept)
+	}
+	for _, w := range written {
+		l.addTable(level, w.index, sequence, edit)
 	}
-	for _, builder := range mergers {
-		l.saveL1Table(builder.setTableInfo())
+	return nil
+}
+
+// addTable add the new table index of level and sequence to edit,
+// it's only readable once edit is committed and installed.
+func (l *Lsm) addTable(level int, index uint32, sequence uint32, edit *versionEdit) {
+	newTable := readTable(l.absPath, index)
+	edit.add(level, tableMetadata{
+		Records:  uint32(newTable.fileInfo.entries),
+		MinRange: newTable.fileInfo.minRange,
+		MaxRange: newTable.fileInfo.maxRange,
+		Size:     uint32(newTable.size),
+		Index:    index,
+		Sequence: sequence,
+	})
+	newTable.close()
+	newTable.release()
+	logrus.Infof("comapction: new level %d file has beed added %d.fza", level, index)
+}
+
+// install swap the tables of the committed edit into the levels and delete the tables it removes from disk.
+// the tables of a level are swapped under one lock, so a lookup never sees the new tables next to the ones
+// they replace. the deepest level goes first, a key pushed down is readable above until it's found below.
+func (l *Lsm) install(edit *versionEdit) {
+	dels := make(map[int][]uint32)
+	for _, del := range edit.dels {
+		dels[del.level] = append(dels[del.level], del.file.Index)
+	}
+	adds := make(map[int][]tableMetadata)
+	added := make(map[uint32]bool)
+	for _, add := range edit.adds {
+		adds[add.level] = append(adds[add.level], add.file)
+		added[add.file.Index] = true
+	}
+	touched := make([]int, 0, len(dels)+len(adds))
+	for level := range dels {
+		touched = append(touched, level)
 	}
-	if extraBuilder != nil {
-		l.saveL1Table(extraBuilder.setTableInfo())
+	for level := range adds {
+		if _, ok := dels[level]; !ok {
+			touched = append(touched, level)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(touched)))
+	for _, level := range touched {
+		tables := make([]*table, 0, len(adds[level]))
+		sequences := make([]uint32, 0, len(adds[level]))
+		for _, f := range adds[level] {
+			tables = append(tables, readTable(l.absPath, f.Index))
+			sequences = append(sequences, f.Sequence)
+		}
+		if level == 0 {
+			l.l0Maintainer.replace(dels[level], tables, sequences)
+		} else {
+			l.levels[level].replace(dels[level], tables)
+		}
+		for _, t := range tables {
+			t.close()
+			t.release()
+		}
 	}
-	for _, idx := range cs.tableIDs {
-		l.l1Maintainer.delTable(idx)
-		util.RemoveTable(l.absPath, idx)
-		l.metadata.delL1File(idx)
+	// a moved table is deleted from one level and added to another one
+	for _, del := range edit.dels {
+		if !added[del.file.Index] {
+			l.tableCache.remove(del.file.Index)
+			util.RemoveTable(l.absPath, del.file.Index)
+		}
 	}
-	l.l0Maintainer.delTable(l0f.Index)
-	util.RemoveTable(l.absPath, l0f.Index)
-	l.metadata.delL0File(l0f.Index)
 }
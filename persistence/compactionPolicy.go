@@ -0,0 +1,227 @@
+package persistence
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	// CompactionPushDown push every l0 table down on its own once level 0 is full,
+	// a table nothing overlaps in level 1 is moved without being rewritten.
+	CompactionPushDown = "pushDown"
+	// CompactionLeveled merge the whole level 0 into level 1 at once and walk every
+	// other level round robin by checksum range, it keeps read amplification low.
+	CompactionLeveled = "leveled"
+	// CompactionSizeTiered merge l0 tables of a similar size with each other and push them
+	// down once they are as large as a level 1 table, it keeps write amplification low.
+	CompactionSizeTiered = "sizeTiered"
+)
+
+// CompactionPolicy decide which tables are compacted together and into which level,
+// Lsm merges them with whatever they overlap in that level. a policy is picked by name from
+// Setting.CompactionPolicy, it's one of the policies above or one added by RegisterCompactionPolicy.
+type CompactionPolicy interface {
+	// Plan return the compactions which have to run now, they run one after another. Tables and
+	// Levels of l describe the levels, only flushed tables are added to level 0 while a plan is made or run.
+	Plan(l *Lsm) []Compaction
+}
+
+// Compaction merge Victims of Level into Output, which is either Level or the next level.
+// Victims are listed from the newest to the oldest.
+type Compaction struct {
+	Level   int
+	Victims []uint32
+	Output  int
+}
+
+// TableInfo is a table of a level. a table whose Sequence is larger holds newer entries,
+// the one whose Index is larger of two tables of the same Sequence.
+type TableInfo struct {
+	Level    int
+	Index    uint32
+	Sequence uint32
+	Size     uint32
+	Records  uint32
+	MinRange uint32
+	MaxRange uint32
+}
+
+func tableInfo(level int, f tableMetadata) TableInfo {
+	return TableInfo{
+		Level:    level,
+		Index:    f.Index,
+		Sequence: f.Sequence,
+		Size:     f.Size,
+		Records:  f.Records,
+		MinRange: f.MinRange,
+		MaxRange: f.MaxRange,
+	}
+}
+
+// Levels return the number of levels, level 0 included
+func (l *Lsm) Levels() int {
+	return len(l.levels)
+}
+
+// Tables return the tables of level
+func (l *Lsm) Tables(level int) []TableInfo {
+	files := l.metadata.copyLevel(level)
+	tables := make([]TableInfo, 0, len(files))
+	for _, f := range files {
+		tables = append(tables, tableInfo(level, f))
+	}
+	return tables
+}
+
+var (
+	policiesMutex sync.RWMutex
+	policies      = map[string]func() CompactionPolicy{}
+)
+
+// RegisterCompactionPolicy make newPolicy selectable by name from Setting.CompactionPolicy,
+// every Lsm opened with that name takes a policy of its own. a name is registered once and the names
+// of the policies above are taken.
+func RegisterCompactionPolicy(name string, newPolicy func() CompactionPolicy) {
+	policiesMutex.Lock()
+	defer policiesMutex.Unlock()
+	switch _, ok := policies[name]; {
+	case ok, name == "", name == CompactionPushDown, name == CompactionLeveled, name == CompactionSizeTiered:
+		panic(fmt.Sprintf("compaction: policy %q is taken", name))
+	}
+	policies[name] = newPolicy
+}
+
+func newCompactionPolicy(name string) (CompactionPolicy, error) {
+	switch name {
+	case "", CompactionPushDown:
+		return &pushDownPolicy{}, nil
+	case CompactionLeveled:
+		return &leveledPolicy{pointers: map[int]uint32{}}, nil
+	case CompactionSizeTiered:
+		return &sizeTieredPolicy{}, nil
+	}
+	policiesMutex.RLock()
+	defer policiesMutex.RUnlock()
+	if newPolicy, ok := policies[name]; ok {
+		return newPolicy(), nil
+	}
+	return nil, fmt.Errorf("compaction: unknown policy %q", name)
+}
+
+// byAge sort files from the oldest to the newest
+func byAge(files []tableMetadata) []tableMetadata {
+	sort.Slice(files, func(i, j int) bool {
+		return newer(files[j].Sequence, files[j].Index, files[i].Sequence, files[i].Index)
+	})
+	return files
+}
+
+// oversized return the compaction of the oldest table of every level which outgrows its target,
+// the last level has no target.
+func oversized(l *Lsm) []Compaction {
+	plan := make([]Compaction, 0)
+	for level := 1; level < len(l.levels)-1; level++ {
+		if l.metadata.levelSize(level) <= l.levelTarget(level) {
+			continue
+		}
+		files := byAge(l.metadata.copyLevel(level))
+		plan = append(plan, Compaction{Level: level, Victims: []uint32{files[0].Index}, Output: level + 1})
+	}
+	return plan
+}
+
+type pushDownPolicy struct{}
+
+func (p *pushDownPolicy) Plan(l *Lsm) []Compaction {
+	plan := make([]Compaction, 0)
+	if l.metadata.levelLen(0) >= l.setting.L0Capacity {
+		// older tables go first, so the newer ones are merged over them
+		for _, f := range byAge(l.metadata.copyLevel(0)) {
+			plan = append(plan, Compaction{Level: 0, Victims: []uint32{f.Index}, Output: 1})
+		}
+	}
+	return append(plan, oversized(l)...)
+}
+
+type leveledPolicy struct {
+	// pointers keep the checksum next to the maximum one compacted last time at every level
+	pointers map[int]uint32
+}
+
+func (p *leveledPolicy) Plan(l *Lsm) []Compaction {
+	plan := make([]Compaction, 0)
+	if l.metadata.levelLen(0) >= l.setting.L0Capacity {
+		files := byAge(l.metadata.copyLevel(0))
+		victims := make([]uint32, 0, len(files))
+		for i := len(files) - 1; i >= 0; i-- {
+			victims = append(victims, files[i].Index)
+		}
+		plan = append(plan, Compaction{Level: 0, Victims: victims, Output: 1})
+	}
+	for level := 1; level < len(l.levels)-1; level++ {
+		if l.metadata.levelSize(level) <= l.levelTarget(level) {
+			continue
+		}
+		files := l.metadata.copyLevel(level)
+		sort.Slice(files, func(i, j int) bool { return files[i].MinRange < files[j].MinRange })
+		// the first table behind the pointer, start over from the smallest checksum at the end
+		victim := files[0]
+		for _, f := range files {
+			if f.MinRange >= p.pointers[level] {
+				victim = f
+				break
+			}
+		}
+		p.pointers[level] = victim.MaxRange + 1
+		plan = append(plan, Compaction{Level: level, Victims: []uint32{victim.Index}, Output: level + 1})
+	}
+	return plan
+}
+
+type sizeTieredPolicy struct{}
+
+// plan merge the newest l0 tables once l0Capacity of them are within twice the size of each other.
+// only the newest ones are merged, so the merged table is still newer than every table left in level 0.
+func (p *sizeTieredPolicy) Plan(l *Lsm) []Compaction {
+	plan := make([]Compaction, 0)
+	files := byAge(l.metadata.copyLevel(0))
+	// a table which grew as large as a level 1 table is pushed down together with every older one,
+	// level 0 is drained as well when tiers pile up in it. a merge cuts its tables at that size, so
+	// the tables being drained are left out of the tier, a tier merge would only cut them again.
+	drain := len(files) - l.setting.L0Capacity*l.setting.LevelSizeMultiplier
+	for i, f := range files {
+		if f.Size >= uint32(l.setting.L1TableSize) {
+			drain = i + 1
+		}
+	}
+	if drain < 0 {
+		drain = 0
+	}
+	for i := 0; i < drain; i++ {
+		plan = append(plan, Compaction{Level: 0, Victims: []uint32{files[i].Index}, Output: 1})
+	}
+	tier := make([]uint32, 0)
+	smallest, largest := uint32(0), uint32(0)
+	merged := true // the tables of one merge share its sequence, they're merged already
+	for i := len(files) - 1; i >= drain; i-- {
+		size := files[i].Size
+		if len(tier) > 0 && (size > smallest*2 || size*2 < largest) {
+			break
+		}
+		if len(tier) == 0 || size < smallest {
+			smallest = size
+		}
+		if size > largest {
+			largest = size
+		}
+		if len(tier) > 0 && files[i].Sequence != files[len(files)-1].Sequence {
+			merged = false
+		}
+		tier = append(tier, files[i].Index)
+	}
+	if len(tier) >= l.setting.L0Capacity && len(tier) > 1 && !merged {
+		plan = append(plan, Compaction{Level: 0, Victims: tier, Output: 0})
+	}
+	return append(plan, oversized(l)...)
+}
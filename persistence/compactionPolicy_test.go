@@ -0,0 +1,105 @@
+package persistence
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
+)
+
+func policyLsm(levels ...[]tableMetadata) *Lsm {
+	return &Lsm{
+		setting: conf.Persistence{L0Capacity: 3, L1TableSize: 100, LevelSizeMultiplier: 2},
+		metadata: &metadata{
+			Levels: levels,
+		},
+		levels: make([]*levelMaintainer, len(levels)),
+	}
+}
+
+func TestSizeTieredPolicy(t *testing.T) {
+	p, _ := newCompactionPolicy(CompactionSizeTiered)
+	// only the three newest tables are of a similar size
+	l := policyLsm([]tableMetadata{{Index: 1, Size: 90, Sequence: 1}, {Index: 2, Size: 10, Sequence: 2}, {Index: 3, Size: 12, Sequence: 3}, {Index: 4, Size: 11, Sequence: 4}}, nil)
+	plan := p.Plan(l)
+	if fmt.Sprint(plan) != fmt.Sprint([]Compaction{{Level: 0, Victims: []uint32{4, 3, 2}, Output: 0}}) {
+		t.Fatalf("unexpected plan %v", plan)
+	}
+	// the tables of one merge aren't merged again
+	l = policyLsm([]tableMetadata{{Index: 1, Size: 90, Sequence: 1}, {Index: 2, Size: 10, Sequence: 4}, {Index: 3, Size: 12, Sequence: 4}, {Index: 4, Size: 11, Sequence: 4}}, nil)
+	if plan = p.Plan(l); len(plan) != 0 {
+		t.Fatalf("unexpected plan %v", plan)
+	}
+	// a table as large as a level 1 table is pushed down with the older ones
+	l = policyLsm([]tableMetadata{{Index: 1, Size: 10}, {Index: 2, Size: 120}, {Index: 3, Size: 10}}, nil)
+	plan = p.Plan(l)
+	if fmt.Sprint(plan) != fmt.Sprint([]Compaction{{Level: 0, Victims: []uint32{1}, Output: 1}, {Level: 0, Victims: []uint32{2}, Output: 1}}) {
+		t.Fatalf("unexpected plan %v", plan)
+	}
+}
+
+func TestLeveledPolicy(t *testing.T) {
+	p, _ := newCompactionPolicy(CompactionLeveled)
+	l := policyLsm(
+		[]tableMetadata{{Index: 5}, {Index: 7}, {Index: 6}},
+		[]tableMetadata{{Index: 1, MinRange: 0, MaxRange: 9, Size: 100}, {Index: 2, MinRange: 10, MaxRange: 19, Size: 100}, {Index: 3, MinRange: 20, MaxRange: 29, Size: 100}},
+		nil,
+	)
+	plan := p.Plan(l)
+	if fmt.Sprint(plan) != fmt.Sprint([]Compaction{{Level: 0, Victims: []uint32{7, 6, 5}, Output: 1}, {Level: 1, Victims: []uint32{1}, Output: 2}}) {
+		t.Fatalf("unexpected plan %v", plan)
+	}
+	// level 1 is walked round robin
+	for _, victim := range []uint32{2, 3, 1} {
+		plan = p.Plan(l)
+		if plan[1].Victims[0] != victim {
+			t.Fatalf("expected table %d to be compacted but got %d", victim, plan[1].Victims[0])
+		}
+	}
+}
+
+func TestUnknownPolicy(t *testing.T) {
+	if _, err := newCompactionPolicy("tiered"); err == nil {
+		t.Fatal("expected an unknown policy to be refused")
+	}
+}
+
+type levelZeroPolicy struct{}
+
+// Plan merge level 0 into one table once it holds two
+func (p *levelZeroPolicy) Plan(l *Lsm) []Compaction {
+	tables := l.Tables(0)
+	if len(tables) < 2 {
+		return nil
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Sequence != tables[j].Sequence {
+			return tables[i].Sequence > tables[j].Sequence
+		}
+		return tables[i].Index > tables[j].Index
+	})
+	victims := make([]uint32, 0, len(tables))
+	for _, t := range tables {
+		victims = append(victims, t.Index)
+	}
+	return []Compaction{{Level: 0, Victims: victims, Output: 0}}
+}
+
+func TestRegisterCompactionPolicy(t *testing.T) {
+	RegisterCompactionPolicy("levelZero", func() CompactionPolicy { return &levelZeroPolicy{} })
+	l := policyLsm([]tableMetadata{{Index: 1, Sequence: 1}, {Index: 2, Sequence: 2}}, nil)
+	p, err := newCompactionPolicy("levelZero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan := p.Plan(l); fmt.Sprint(plan) != fmt.Sprint([]Compaction{{Level: 0, Victims: []uint32{2, 1}, Output: 0}}) {
+		t.Fatalf("unexpected plan %v", plan)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a taken name to be refused")
+		}
+	}()
+	RegisterCompactionPolicy(CompactionLeveled, func() CompactionPolicy { return &levelZeroPolicy{} })
+}
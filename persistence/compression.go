@@ -0,0 +1,146 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// CompressionNone write the entries of a table as they are
+	CompressionNone = "none"
+	// CompressionSnappy compress every block of a table with snappy
+	CompressionSnappy = "snappy"
+)
+
+// codec is the compression a table is written with, it's recorded in the table's file info
+type codec uint32
+
+const (
+	noCompression codec = iota
+	snappyCompression
+)
+
+func newCodec(name string) (codec, error) {
+	switch name {
+	case "", CompressionNone:
+		return noCompression, nil
+	case CompressionSnappy:
+		return snappyCompression, nil
+	}
+	return noCompression, fmt.Errorf("compression: unknown codec %q", name)
+}
+
+func (c codec) compress(block []byte) []byte {
+	switch c {
+	case snappyCompression:
+		return snappy.Encode(nil, block)
+	}
+	return block
+}
+
+func (c codec) decompress(block []byte) ([]byte, error) {
+	switch c {
+	case noCompression:
+		return block, nil
+	case snappyCompression:
+		return snappy.Decode(nil, block)
+	}
+	return nil, fmt.Errorf("compression: unknown codec %d", c)
+}
+
+// blockHandle locate a compressed block in the table file,
+// start is where the block's entries begin in the uncompressed data
+// and checksum is the CRC of the block as it's saved.
+type blockHandle struct {
+	start    uint32
+	offset   uint32
+	length   uint32
+	checksum uint32
+}
+
+// blockHandles list the compressed blocks of a table in order, the positions kept by
+// the table's indexes are positions in the uncompressed data, size is its length.
+// it's saved between the indexes and the file info as
+// count(4) + size(4) + (start(4) + offset(4) + length(4) + checksum(4)) for every block.
+// tables which aren't compressed are cut into blocks as well, so every block is checksummed.
+type blockHandles struct {
+	handles []blockHandle
+	size    uint32
+}
+
+// compressBlocks cut data into blocks of whole entries of about blockSize, then compress and checksum them one by one
+func compressBlocks(data []byte, c codec) ([]byte, *blockHandles) {
+	compressed := new(bytes.Buffer)
+	handles := &blockHandles{handles: make([]blockHandle, 0), size: uint32(len(data))}
+	start, end := 0, 0
+	for end < len(data) {
+		end += len(entryAt(data, uint32(end)))
+		if end-start < blockSize && end < len(data) {
+			continue
+		}
+		block := c.compress(data[start:end])
+		handles.handles = append(handles.handles, blockHandle{
+			start:    uint32(start),
+			offset:   uint32(compressed.Len()),
+			length:   uint32(len(block)),
+			checksum: crc32.Checksum(block, CrcTable),
+		})
+		compressed.Write(block)
+		start = end
+	}
+	return compressed.Bytes(), handles
+}
+
+// find return the handle of the block holding position
+func (b *blockHandles) find(position uint32) blockHandle {
+	i := sort.Search(len(b.handles), func(i int) bool {
+		return b.handles[i].start > position
+	})
+	if i == 0 {
+		return b.handles[0]
+	}
+	return b.handles[i-1]
+}
+
+// encodedLen return the length of the encoded handles
+func (b *blockHandles) encodedLen() int {
+	return 8 + 16*len(b.handles)
+}
+
+func (b *blockHandles) encode() []byte {
+	buf := make([]byte, b.encodedLen())
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(b.handles)))
+	binary.BigEndian.PutUint32(buf[4:8], b.size)
+	for i, h := range b.handles {
+		binary.BigEndian.PutUint32(buf[8+16*i:], h.start)
+		binary.BigEndian.PutUint32(buf[12+16*i:], h.offset)
+		binary.BigEndian.PutUint32(buf[16+16*i:], h.length)
+		binary.BigEndian.PutUint32(buf[20+16*i:], h.checksum)
+	}
+	return buf
+}
+
+func decodeBlockHandles(buf []byte) (*blockHandles, error) {
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("block handles: %d bytes are too short", len(buf))
+	}
+	count := binary.BigEndian.Uint32(buf[0:4])
+	if uint32(len(buf)-8)/16 < count {
+		return nil, fmt.Errorf("block handles: %d handles don't fit in %d bytes", count, len(buf))
+	}
+	b := &blockHandles{handles: make([]blockHandle, count), size: binary.BigEndian.Uint32(buf[4:8])}
+	for i := range b.handles {
+		b.handles[i] = blockHandle{
+			start:    binary.BigEndian.Uint32(buf[8+16*i:]),
+			offset:   binary.BigEndian.Uint32(buf[12+16*i:]),
+			length:   binary.BigEndian.Uint32(buf[16+16*i:]),
+			checksum: binary.BigEndian.Uint32(buf[20+16*i:]),
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,197 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+const (
+	// EvictOldest evict the table holding the oldest entries first
+	EvictOldest = "oldest"
+	// EvictColdest evict the table read the fewest times since the node started first,
+	// the oldest one of the tables read as often.
+	EvictColdest = "coldest"
+)
+
+// EvictionPolicy decide which table is evicted first once the tables outgrow the disk quota. a policy is
+// picked by name from Setting.EvictionPolicy, it's one of the policies above or one added by RegisterEvictionPolicy.
+type EvictionPolicy interface {
+	// Order sort the tables which may be evicted from the first one to evict, TableReads of l
+	// tells how often each of them was read
+	Order(l *Lsm, tables []TableInfo)
+}
+
+// EvictionStats count the tables evicted to keep the tables within the disk quota and their bytes
+type EvictionStats struct {
+	Tables uint64
+	Bytes  uint64
+}
+
+var (
+	evictionPoliciesMutex sync.RWMutex
+	evictionPolicies      = map[string]func() EvictionPolicy{}
+)
+
+// RegisterEvictionPolicy make newPolicy selectable by name from Setting.EvictionPolicy,
+// every Lsm opened with that name takes a policy of its own. a name is registered once and the names
+// of the policies above are taken.
+func RegisterEvictionPolicy(name string, newPolicy func() EvictionPolicy) {
+	evictionPoliciesMutex.Lock()
+	defer evictionPoliciesMutex.Unlock()
+	switch _, ok := evictionPolicies[name]; {
+	case ok, name == "", name == EvictOldest, name == EvictColdest:
+		panic(fmt.Sprintf("eviction: policy %q is taken", name))
+	}
+	evictionPolicies[name] = newPolicy
+}
+
+func newEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "", EvictOldest:
+		return &oldestPolicy{}, nil
+	case EvictColdest:
+		return &coldestPolicy{}, nil
+	}
+	evictionPoliciesMutex.RLock()
+	defer evictionPoliciesMutex.RUnlock()
+	if newPolicy, ok := evictionPolicies[name]; ok {
+		return newPolicy(), nil
+	}
+	return nil, fmt.Errorf("eviction: unknown policy %q", name)
+}
+
+// TableReads return the lookups of table index since the node started
+func (l *Lsm) TableReads(index uint32) uint64 {
+	return l.tableCache.readCount(index)
+}
+
+// olderFile report whether a holds older entries than b
+func olderFile(a, b TableInfo) bool {
+	return newer(b.Sequence, b.Index, a.Sequence, a.Index)
+}
+
+type oldestPolicy struct{}
+
+func (p *oldestPolicy) Order(l *Lsm, files []TableInfo) {
+	sort.Slice(files, func(i, j int) bool { return olderFile(files[i], files[j]) })
+}
+
+type coldestPolicy struct{}
+
+func (p *coldestPolicy) Order(l *Lsm, files []TableInfo) {
+	reads := make(map[uint32]uint64, len(files))
+	for _, f := range files {
+		reads[f.Index] = l.TableReads(f.Index)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if ri, rj := reads[files[i].Index], reads[files[j].Index]; ri != rj {
+			return ri < rj
+		}
+		return olderFile(files[i], files[j])
+	})
+}
+
+// evictable return the tables no older table may hold a key of, those are the tables which
+// overlap nothing in the deeper levels and, in level 0, no older table either. evicting one of
+// them loses its keys but never brings an older value of them back.
+func (l *Lsm) evictable() []TableInfo {
+	files := make([]TableInfo, 0)
+	l0 := l.metadata.copyLevel(0)
+	for _, f := range l0 {
+		if l.metadata.overlaps(1, f.MinRange, f.MaxRange) {
+			continue
+		}
+		covered := false
+		for _, other := range l0 {
+			if newer(f.Sequence, f.Index, other.Sequence, other.Index) && f.MinRange <= other.MaxRange && other.MinRange <= f.MaxRange {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			files = append(files, tableInfo(0, f))
+		}
+	}
+	for level := 1; level < len(l.levels); level++ {
+		for _, f := range l.metadata.copyLevel(level) {
+			if !l.metadata.overlaps(level+1, f.MinRange, f.MaxRange) {
+				files = append(files, tableInfo(level, f))
+			}
+		}
+	}
+	return files
+}
+
+// logSize return the bytes the value log and wal segments take on disk
+func (l *Lsm) logSize() uint64 {
+	infos, err := ioutil.ReadDir(l.absPath)
+	if err != nil {
+		logrus.Warnf("eviction: unable to list the segments %s", err.Error())
+		return 0
+	}
+	size := uint64(0)
+	for _, info := range infos {
+		if !info.IsDir() && (strings.HasSuffix(info.Name(), ".vlog") || strings.HasSuffix(info.Name(), ".wal")) {
+			size += uint64(info.Size())
+		}
+	}
+	return size
+}
+
+// enforceQuota evict tables in the order of the eviction policy until the tables, the value log and the wal
+// fit in the disk quota, compaction must be paused by the caller. the versions a snapshot sees are evicted as well.
+// only the bytes of the tables are reclaimed by eviction, the segments are taken as they are: the values of an
+// evicted table are dropped from the value log by its gc later. nothing is evicted once the segments alone
+// outgrow the quota, dropping every table wouldn't close the gap then.
+func (l *Lsm) enforceQuota() {
+	quota := uint64(l.setting.DiskQuota)
+	if quota == 0 {
+		return
+	}
+	logs := l.logSize()
+	if logs >= quota {
+		logrus.Warnf("eviction: the value log and wal take %d bytes which outgrow the disk quota of %d bytes, no table is evicted", logs, quota)
+		return
+	}
+	for l.metadata.totalSize() > quota-logs {
+		files := l.evictable()
+		if len(files) == 0 {
+			return
+		}
+		l.eviction.Order(l, files)
+		l.evict(files[0])
+	}
+}
+
+// evict drop a table from its level and disk, its keys are lost
+func (l *Lsm) evict(f TableInfo) {
+	if f.Level == 0 {
+		l.l0Maintainer.delTable(f.Index)
+	} else {
+		l.levels[f.Level].delTable(f.Index)
+	}
+	edit := &versionEdit{}
+	edit.del(f.Level, f.Index)
+	l.commit(edit)
+	l.tableCache.remove(f.Index)
+	util.RemoveTable(l.absPath, f.Index)
+	atomic.AddUint64(&l.evictions.Tables, 1)
+	atomic.AddUint64(&l.evictions.Bytes, uint64(f.Size))
+	logrus.Infof("eviction: level %d %d.fza is evicted, the tables outgrew the disk quota", f.Level, f.Index)
+}
+
+// EvictionStats return the tables evicted since the node started to keep within the disk quota
+func (l *Lsm) EvictionStats() EvictionStats {
+	return EvictionStats{
+		Tables: atomic.LoadUint64(&l.evictions.Tables),
+		Bytes:  atomic.LoadUint64(&l.evictions.Bytes),
+	}
+}
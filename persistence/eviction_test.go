@@ -0,0 +1,159 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
+)
+
+func TestEviction(t *testing.T) {
+	for _, policy := range []string{EvictOldest, EvictColdest} {
+		t.Run(policy, func(t *testing.T) {
+			testEviction(t, policy)
+		})
+	}
+}
+
+func testEviction(t *testing.T, policy string) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.L0Capacity = 100
+	setting.Persistence.EvictionPolicy = policy
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for table := 0; table < 3; table++ {
+		for i := 0; i < 100; i++ {
+			l.Set([]byte(fmt.Sprintf("key %d-%d", table, i)), []byte(fmt.Sprintf("%d", i)))
+		}
+		l.Set([]byte("shared"), []byte(fmt.Sprintf("%d", table)))
+		l.flush()
+	}
+	// the oldest table is the hottest, but the newer ones lie over it
+	for i := 0; i < 100; i++ {
+		l.Get([]byte(fmt.Sprintf("key 0-%d", i)))
+	}
+	files := byAge(l.metadata.copyLevel(0))
+	l.compactMutex.Lock()
+	l.setting.DiskQuota = int(l.metadata.totalSize()+l.logSize()) - 1
+	l.enforceQuota()
+	l.compactMutex.Unlock()
+	if _, ok := l.metadata.levelOf(files[0].Index); ok {
+		t.Fatalf("expected %d.fza to be evicted", files[0].Index)
+	}
+	if l.metadata.levelLen(0) != 2 {
+		t.Fatalf("expected 2 tables to be left but got %d", l.metadata.levelLen(0))
+	}
+	if stats := l.EvictionStats(); stats.Tables != 1 || stats.Bytes != uint64(files[0].Size) {
+		t.Fatalf("expected 1 table of %d bytes to be evicted but got %+v", files[0].Size, stats)
+	}
+	for table := 0; table < 3; table++ {
+		val, ok := l.Get([]byte(fmt.Sprintf("key %d-50", table)))
+		if ok != (table > 0) || ok && !bytes.Equal(val, []byte("50")) {
+			t.Fatalf("unexpected value %q of table %d", val, table)
+		}
+	}
+	if val, _ := l.Get([]byte("shared")); !bytes.Equal(val, []byte("2")) {
+		t.Fatalf("expected the newest value of shared but got %q", val)
+	}
+}
+
+func TestQuotaCountsLogs(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.ValueThreshold = 64
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 100; i++ {
+		l.Set([]byte(fmt.Sprintf("key %d", i)), bytes.Repeat([]byte("x"), 100))
+	}
+	l.flush()
+	// the segments take most of the quota, only half of the tables fit next to them
+	l.compactMutex.Lock()
+	l.setting.DiskQuota = int(l.metadata.totalSize()/2 + l.logSize())
+	l.enforceQuota()
+	l.compactMutex.Unlock()
+	if l.metadata.levelLen(0) != 0 {
+		t.Fatalf("expected the table to be evicted but got %d tables", l.metadata.levelLen(0))
+	}
+}
+
+func TestQuotaOutgrownByLogs(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.ValueThreshold = 64
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 100; i++ {
+		l.Set([]byte(fmt.Sprintf("key %d", i)), bytes.Repeat([]byte("x"), 100))
+	}
+	l.flush()
+	// evicting the table can't bring the segments within the quota, so it's kept
+	l.compactMutex.Lock()
+	l.setting.DiskQuota = int(l.logSize() / 2)
+	l.enforceQuota()
+	l.compactMutex.Unlock()
+	if l.metadata.levelLen(0) != 1 {
+		t.Fatalf("expected the table to be kept but got %d tables", l.metadata.levelLen(0))
+	}
+	if stats := l.EvictionStats(); stats.Tables != 0 {
+		t.Fatalf("expected no table to be evicted but got %+v", stats)
+	}
+}
+
+func TestColdestPolicy(t *testing.T) {
+	l := &Lsm{tableCache: newTableCache("./", 1, nil)}
+	l.tableCache.reads = map[uint32]uint64{1: 5, 2: 0, 3: 0, 4: 9}
+	files := []TableInfo{
+		{Level: 1, Index: 1, Sequence: 1},
+		{Level: 1, Index: 2, Sequence: 4},
+		{Level: 2, Index: 3, Sequence: 3},
+		{Level: 2, Index: 4, Sequence: 2},
+	}
+	(&coldestPolicy{}).Order(l, files)
+	indexes := make([]uint32, 0)
+	for _, f := range files {
+		indexes = append(indexes, f.Index)
+	}
+	// the tables read as often are evicted from the oldest
+	if fmt.Sprint(indexes) != "[3 2 1 4]" {
+		t.Fatalf("unexpected eviction order %v", indexes)
+	}
+}
+
+type largestPolicy struct{}
+
+// Order evict the largest table first
+func (p *largestPolicy) Order(l *Lsm, tables []TableInfo) {
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Size > tables[j].Size })
+}
+
+func TestRegisterEvictionPolicy(t *testing.T) {
+	RegisterEvictionPolicy("largest", func() EvictionPolicy { return &largestPolicy{} })
+	p, err := newEvictionPolicy("largest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := []TableInfo{{Index: 1, Size: 10}, {Index: 2, Size: 30}, {Index: 3, Size: 20}}
+	p.Order(nil, tables)
+	if tables[0].Index != 2 {
+		t.Fatalf("expected table 2 to be evicted first but got %d", tables[0].Index)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a taken name to be refused")
+		}
+	}()
+	RegisterEvictionPolicy("largest", func() EvictionPolicy { return &largestPolicy{} })
+}
@@ -0,0 +1,74 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// expiring is set on the value length of an entry whose value is followed by the time it expires at,
+// unix nanoseconds(8) in front of its sequence. an expired entry reads as a tombstone, so it hides
+// the older entries of its key as well, and compaction drops its value.
+// wal and value log records carry the flag too, their value is followed by the expiry then.
+const expiring uint32 = 1 << 28
+
+// expirySize is what an expiry adds to an entry or a record
+const expirySize = 8
+
+// expired report whether an entry which expires at expires has expired, 0 never expires
+func expired(expires int64) bool {
+	return expires != 0 && expires <= time.Now().UnixNano()
+}
+
+// expiryOf return the unix nanoseconds t is at, the zero time never expires
+func expiryOf(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// withExpiry return value followed by expires and the flag its length is marked with,
+// value is returned as it is if it never expires.
+func withExpiry(value []byte, expires int64) ([]byte, uint32) {
+	if expires == 0 {
+		return value, 0
+	}
+	payload := make([]byte, len(value)+expirySize)
+	copy(payload, value)
+	binary.BigEndian.PutUint64(payload[len(value):], uint64(expires))
+	return payload, expiring
+}
+
+// splitExpiry take the expiry off a payload written by withExpiry, flags are the ones of its length
+func splitExpiry(payload []byte, flags uint32) ([]byte, int64) {
+	if flags&expiring == 0 || len(payload) < expirySize {
+		return payload, 0
+	}
+	value := payload[:len(payload)-expirySize]
+	return value, int64(binary.BigEndian.Uint64(payload[len(value):]))
+}
+
+// entryExpiry return the time the whole entry e expires at, 0 if it never expires
+func entryExpiry(e []byte) int64 {
+	valLength := binary.BigEndian.Uint32(e[4:8])
+	if valLength&expiring == 0 {
+		return 0
+	}
+	trailer := len(e) - expirySize
+	if valLength&versioned != 0 {
+		trailer -= 8
+	}
+	return int64(binary.BigEndian.Uint64(e[trailer:]))
+}
+
+// expire return a tombstone of the key and sequence of the whole entry e,
+// it takes the place of an expired entry which still has older entries to hide.
+func expire(e []byte) []byte {
+	key, _, _ := decodeEntry(e, 0)
+	t := make([]byte, 8+len(key)+8)
+	binary.BigEndian.PutUint32(t[0:4], uint32(len(key)))
+	binary.BigEndian.PutUint32(t[4:8], tombstone|versioned)
+	copy(t[8:], key)
+	binary.BigEndian.PutUint64(t[8+len(key):], entrySequence(e))
+	return t
+}
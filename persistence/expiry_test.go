@@ -0,0 +1,71 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Pheomenon/frozra/v1/conf"
+)
+
+func TestExpiry(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.ValueThreshold = 64
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	large := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 10; i++ {
+		l.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	l.flush()
+	l.compactMutex.Lock()
+	l.compact(Compaction{Level: 0, Victims: []uint32{l.metadata.copyLevel(0)[0].Index}, Output: 1})
+	l.compactMutex.Unlock()
+	// an expired entry hides the older entries of its key in level 1
+	past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+	l.SetExpiring([]byte("key 0"), []byte("expired"), past)
+	l.SetExpiring([]byte("key 1"), large, past)
+	l.SetExpiring([]byte("key 2"), []byte("live"), future)
+	l.SetExpiring([]byte("key 3"), large, future)
+	batch := l.NewWriteBatch()
+	batch.PutExpiring([]byte("key 4"), []byte("expired"), past)
+	batch.PutExpiring([]byte("key 5"), []byte("5"), time.Time{})
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(stage string) {
+		expected := map[int][]byte{2: []byte("live"), 3: large, 5: []byte("5"), 6: []byte("6"), 7: []byte("7"), 8: []byte("8"), 9: []byte("9")}
+		for i := 0; i < 10; i++ {
+			val, ok := l.Get([]byte(fmt.Sprintf("key %d", i)))
+			if v, live := expected[i]; ok != live || ok && !bytes.Equal(val, v) {
+				t.Fatalf("%s: expected key %d to be %q but got %q", stage, i, v, val)
+			}
+		}
+		kvs := scanned(func(fn func(key, value []byte) bool) {
+			l.Scan(nil, nil, fn)
+		})
+		if len(kvs) != len(expected) {
+			t.Fatalf("%s: expected %d keys to be scanned but got %v", stage, len(expected), kvs)
+		}
+	}
+	check("memory table")
+	l.flush()
+	check("level 0")
+	l.compactMutex.Lock()
+	l.compact(Compaction{Level: 0, Victims: []uint32{l.metadata.copyLevel(0)[0].Index}, Output: 1})
+	l.compactMutex.Unlock()
+	check("level 1")
+	// nothing is left below level 1 for the expired entries to hide
+	records := uint32(0)
+	for _, f := range l.metadata.copyLevel(1) {
+		records += f.Records
+	}
+	if records != 7 {
+		t.Fatalf("expected the expired entries to be dropped but got %d entries", records)
+	}
+}
@@ -0,0 +1,342 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+// every file of a data directory starts with a header of magic(4) + version(4),
+// the magic tells what the file is and the version how the rest of it is laid out.
+const headerSize = 8
+
+// FormatVersion is the version of the files this release writes, it's bumped whenever the layout
+// of a released file changes. files without a header are version 0 and have to be migrated first,
+// a directory of any other version is refused. layouts only written by unreleased builds between
+// two releases share the version of the next release and aren't supported.
+const FormatVersion uint32 = 1
+
+// fileKind is the magic number of a kind of file
+type fileKind uint32
+
+const (
+	tableFile    fileKind = 0x465a5454 // FZTT
+	metadataFile fileKind = 0x465a544d // FZTM
+	filterFile   fileKind = 0x465a5446 // FZTF
+	walFile      fileKind = 0x465a5457 // FZTW
+	manifestFile fileKind = 0x465a5445 // FZTE
+	valueLogFile fileKind = 0x465a5456 // FZTV
+)
+
+// formatError report a file which can't be read by this release
+type formatError struct {
+	name    string
+	version uint32
+}
+
+func (e *formatError) Error() string {
+	if e.version == 0 {
+		return fmt.Sprintf("%s has no format header, upgrade the data directory with frozra-migrate", e.name)
+	}
+	return fmt.Sprintf("%s has format version %d but this release reads version %d", e.name, e.version, FormatVersion)
+}
+
+// encodeHeader return the header of a file of kind
+func encodeHeader(kind fileKind) []byte {
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(kind))
+	binary.BigEndian.PutUint32(header[4:8], FormatVersion)
+	return header
+}
+
+// decodeHeader return the format version of a file of kind, 0 if it has no header
+func decodeHeader(header []byte, kind fileKind) uint32 {
+	if len(header) < headerSize || fileKind(binary.BigEndian.Uint32(header[0:4])) != kind {
+		return 0
+	}
+	return binary.BigEndian.Uint32(header[4:8])
+}
+
+// readHeader read the header of a file of kind from r, io.EOF means the file is empty
+func readHeader(r io.Reader, name string, kind fileKind) error {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(r, header)
+	if n == 0 && err == io.EOF {
+		return io.EOF
+	}
+	if version := decodeHeader(header[:n], kind); version != FormatVersion {
+		return &formatError{name: name, version: version}
+	}
+	return nil
+}
+
+// fileKindOf return the kind of the file called name in a data directory
+func fileKindOf(name string) (fileKind, bool) {
+	switch {
+	case name == manifestName:
+		return manifestFile, true
+	case name == legacyMetadataName:
+		return metadataFile, true
+	case name == legacyFilterName:
+		return filterFile, true
+	case strings.HasSuffix(name, ".fza"):
+		return tableFile, true
+	case strings.HasSuffix(name, ".wal"):
+		return walFile, true
+	case strings.HasSuffix(name, ".vlog"):
+		return valueLogFile, true
+	}
+	return 0, false
+}
+
+// fileVersion return the format version of file, a file too short for a header has none,
+// it's either empty or a wal segment torn while it was created.
+func fileVersion(file string, kind fileKind) (uint32, bool, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return 0, false, err
+	}
+	defer fp.Close()
+	header := make([]byte, headerSize)
+	_, err = io.ReadFull(fp, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return decodeHeader(header, kind), true, nil
+}
+
+// checkFormat refuse a data directory holding a file of another format version
+func checkFormat(absPath string) error {
+	infos, err := ioutil.ReadDir(absPath)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		kind, ok := fileKindOf(info.Name())
+		if info.IsDir() || !ok {
+			continue
+		}
+		version, ok, err := fileVersion(path.Join(absPath, info.Name()), kind)
+		if err != nil {
+			return err
+		}
+		if ok && version != FormatVersion {
+			return &formatError{name: info.Name(), version: version}
+		}
+	}
+	return nil
+}
+
+// Migrate upgrade the data directory at dir written by the release before the format header to
+// FormatVersion in place, the names of the files upgraded are returned. the node must not be running meanwhile.
+// every table is rewritten from its gob index next to itself and renamed over it, then the metadata is
+// replaced by a manifest and the filter file is dropped, every table keeps its own filter now.
+// a crash leaves every file either old or new behind, and Migrate can simply be run again.
+// only files without a header can be upgraded, any other format version is refused.
+func Migrate(dir string) ([]string, error) {
+	absPath, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(absPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		kind, ok := fileKindOf(info.Name())
+		if info.IsDir() || !ok {
+			continue
+		}
+		version, ok, err := fileVersion(path.Join(absPath, info.Name()), kind)
+		if err != nil {
+			return nil, err
+		}
+		// the release before the header wrote no other files than tables, metadata and filter
+		legacy := kind == tableFile || kind == metadataFile || kind == filterFile
+		if ok && version != FormatVersion && (version != 0 || !legacy) {
+			return nil, &formatError{name: info.Name(), version: version}
+		}
+	}
+
+	levels, next, found, err := loadLegacyMetadata(absPath)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := listTables(absPath)
+	if err != nil {
+		return nil, err
+	}
+	// tables are rewritten from the oldest, level 1 holds the entries which were pushed down,
+	// so the sequences of their entries grow with the age of the tables whenever Migrate runs
+	order := make([]uint32, 0, len(indexes))
+	seen := make(map[uint32]bool)
+	for level := len(levels) - 1; level >= 0; level-- {
+		files := append([]tableMetadata{}, levels[level]...)
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Index < files[j].Index
+		})
+		for _, f := range files {
+			order = append(order, f.Index)
+			seen[f.Index] = true
+		}
+	}
+	for _, index := range indexes {
+		if !seen[index] {
+			order = append(order, index)
+		}
+	}
+
+	upgraded := make([]string, 0)
+	files := make(map[uint32]tableMetadata)
+	sequence := uint64(0)
+	for i, index := range order {
+		file := util.TablePath(absPath, index)
+		name := filepath.Base(file)
+		version, _, err := fileVersion(file, tableFile)
+		if os.IsNotExist(err) {
+			// the metadata refers to a table the node never wrote, the manifest leaves it out
+			logrus.Warnf("migrate: %s is missing", name)
+			continue
+		}
+		if err != nil {
+			return upgraded, err
+		}
+		if version == 0 {
+			err = migrateTable(absPath, index, sequence)
+			if err != nil {
+				return upgraded, fmt.Errorf("migrate: unable to upgrade %s: %v", name, err)
+			}
+			logrus.Infof("migrate: %s is upgraded to version %d", name, FormatVersion)
+			upgraded = append(upgraded, name)
+		}
+		t, err := openTable(absPath, index)
+		if err != nil {
+			return upgraded, err
+		}
+		files[index] = tableMetadata{
+			Records:  uint32(t.fileInfo.entries),
+			MinRange: t.fileInfo.minRange,
+			MaxRange: t.fileInfo.maxRange,
+			Size:     uint32(t.size),
+			Index:    index,
+			Sequence: uint32(i + 1),
+		}
+		sequence += uint64(t.fileInfo.entries)
+		t.close()
+		t.release()
+	}
+	// without metadata the levels are left to Recover
+	if found {
+		m := &metadata{absPath: absPath, NextIndex: next, LastSequence: sequence}
+		for level, legacyFiles := range levels {
+			m.Levels = append(m.Levels, make([]tableMetadata, 0, len(legacyFiles)))
+			for _, f := range legacyFiles {
+				if f, ok := files[f.Index]; ok {
+					m.addFile(level, f)
+				}
+			}
+		}
+		if _, err = m.writeManifest(absPath); err != nil {
+			return upgraded, fmt.Errorf("migrate: unable to write the manifest: %v", err)
+		}
+		logrus.Infof("migrate: %s is replaced by %s", legacyMetadataName, manifestName)
+	}
+	for _, name := range []string{legacyMetadataName, legacyFilterName} {
+		err = os.Remove(path.Join(absPath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return upgraded, err
+		}
+		upgraded = append(upgraded, name)
+	}
+	return upgraded, syncDir(absPath)
+}
+
+// legacyMetadata is the metadata saved by the release before the format header
+type legacyMetadata struct {
+	L0Files   []tableMetadata
+	L1Files   []tableMetadata
+	NextIndex uint32
+}
+
+// loadLegacyMetadata return the levels and the last file ID of the legacy metadata in absPath,
+// found reports whether there is one. the metadata is empty until the node is closed for the first time.
+func loadLegacyMetadata(absPath string) (levels [][]tableMetadata, next uint32, found bool, err error) {
+	fp, err := os.Open(path.Join(absPath, legacyMetadataName))
+	if os.IsNotExist(err) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer fp.Close()
+	legacy := &legacyMetadata{}
+	err = gob.NewDecoder(fp).Decode(legacy)
+	if err != nil && err != io.EOF {
+		return nil, 0, false, fmt.Errorf("migrate: unable to decode %s: %v", legacyMetadataName, err)
+	}
+	return [][]tableMetadata{legacy.L0Files, legacy.L1Files}, legacy.NextIndex, true, nil
+}
+
+// migrateTable rewrite the legacy table index in the current layout through a memory table,
+// its entries take the sequences behind sequence. a legacy table is laid out as entries of
+// key length(4) + value length(4) + key + value, a gob index and the file info.
+func migrateTable(absPath string, index uint32, sequence uint64) error {
+	content, err := ioutil.ReadFile(util.TablePath(absPath, index))
+	if err != nil {
+		return err
+	}
+	size := len(content)
+	if size < 32 {
+		return fmt.Errorf("%d bytes are too short for the file info", size)
+	}
+	fi := &fileInfo{}
+	fi.Decode(content[size-32:])
+	if fi.metaOffset > size-32 {
+		return fmt.Errorf("index offset %d is out of the file", fi.metaOffset)
+	}
+	idx, err := decodeHashIndex(content[fi.metaOffset : size-32])
+	if err != nil {
+		return fmt.Errorf("unable to decode the index: %v", err)
+	}
+	data := content[:fi.metaOffset]
+	// every entry gains its sequence
+	h := newHashMap(len(data) + 8*idx.len())
+	h.sequence = sequence
+	idx.forEach(func(_ uint32, position uint32) {
+		if err != nil {
+			return
+		}
+		end := uint64(position) + 8
+		if end <= uint64(len(data)) {
+			end += uint64(binary.BigEndian.Uint32(data[position:])) + uint64(binary.BigEndian.Uint32(data[position+4:]))
+		}
+		if end > uint64(len(data)) {
+			err = fmt.Errorf("entry at %d is out of the data", position)
+			return
+		}
+		key, value, _ := decodeEntry(data, position)
+		h.Set(key, value)
+	})
+	if err != nil {
+		return err
+	}
+	h.persistence(absPath, index)
+	return nil
+}
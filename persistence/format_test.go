@@ -0,0 +1,90 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
+)
+
+// testdata/baseline is a data directory written by the release before the format header,
+// its three level 0 tables and level 1 table hold "value i" for every key "key i" below 700
+func TestMigrate(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	files, _ := filepath.Glob("testdata/baseline/*")
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(setting.Persistence.Path, filepath.Base(file)), content, 0666)
+	}
+	if _, err := New(setting.Persistence); err == nil {
+		t.Fatal("expected a data directory without format headers to be refused")
+	}
+	upgraded, err := Migrate(setting.Persistence.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upgraded) != 6 {
+		t.Fatalf("expected the tables, the metadata and the filter to be upgraded but got %v", upgraded)
+	}
+	// running it again has nothing to do
+	if upgraded, _ = Migrate(setting.Persistence.Path); len(upgraded) != 0 {
+		t.Fatalf("expected nothing to be upgraded but got %v", upgraded)
+	}
+	m, err := loadMetadata(setting.Persistence.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.levelLen(0) != 3 || m.levelLen(1) != 1 || m.NextIndex != 6 || m.LastSequence != 700 {
+		t.Fatalf("expected the levels of the legacy metadata but got %v %d %d", m.Levels, m.NextIndex, m.LastSequence)
+	}
+	m.close()
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 700; i++ {
+		val, _ := l.Get([]byte(fmt.Sprintf("key %d", i)))
+		if !bytes.Equal(val, []byte(fmt.Sprintf("value %d", i))) {
+			t.Fatalf("expected value %d but got %s", i, val)
+		}
+	}
+	// new writes are newer than every migrated entry
+	l.Set([]byte("key 42"), []byte("Phenom"))
+	l.Close()
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := l.Get([]byte("key 42")); !bytes.Equal(val, []byte("Phenom")) {
+		t.Fatalf("expected value Phenom but got %s", val)
+	}
+	l.Close()
+}
+
+func TestUnknownFormatVersion(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	manifest := filepath.Join(setting.Persistence.Path, manifestName)
+	content, _ := ioutil.ReadFile(manifest)
+	binary.BigEndian.PutUint32(content[4:8], FormatVersion+1)
+	ioutil.WriteFile(manifest, content, 0666)
+	if _, err = New(setting.Persistence); err == nil {
+		t.Fatal("expected a newer format version to be refused")
+	}
+	if _, err = Migrate(setting.Persistence.Path); err == nil {
+		t.Fatal("expected a newer format version not to be migrated")
+	}
+}
@@ -0,0 +1,176 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+)
+
+// hashIndex map every key's CRC checksum to its entry's position in a memory table
+// or a table being merged, the table written is indexed by a tableIndex.
+// different keys may share a checksum, the first one of them takes the slot and
+// the others are chained in overflow, the key bytes stored in the entry tell
+// them apart. collisions are rare, so overflow keeps almost nothing.
+type hashIndex struct {
+	Slots    map[uint32]uint32
+	Overflow map[uint32][]uint32
+	entries  int // positions in Slots and Overflow, len is asked for on every write
+}
+
+func newHashIndex() *hashIndex {
+	return &hashIndex{
+		Slots:    map[uint32]uint32{},
+		Overflow: map[uint32][]uint32{},
+	}
+}
+
+// find return the position of key's entry in data
+func (idx *hashIndex) find(data []byte, hash uint32, key []byte) (uint32, bool) {
+	return idx.findEntry(hash, key, bufferReader(data))
+}
+
+// findEntry return the position of key's entry, entries are read by read
+func (idx *hashIndex) findEntry(hash uint32, key []byte, read entryReader) (uint32, bool) {
+	position, ok := idx.Slots[hash]
+	if !ok {
+		return 0, false
+	}
+	if k, _, _ := read(position); bytes.Equal(k, key) {
+		return position, true
+	}
+	for _, position := range idx.Overflow[hash] {
+		if k, _, _ := read(position); bytes.Equal(k, key) {
+			return position, true
+		}
+	}
+	return 0, false
+}
+
+// put point key to position, the entry is already written in data.
+// an older entry of the same key is replaced, a different key with the same checksum is chained.
+func (idx *hashIndex) put(data []byte, hash uint32, key []byte, position uint32) {
+	old, ok := idx.Slots[hash]
+	if !ok {
+		idx.Slots[hash] = position
+		idx.entries++
+		return
+	}
+	if k, _, _ := decodeEntry(data, old); bytes.Equal(k, key) {
+		idx.Slots[hash] = position
+		return
+	}
+	chain := idx.Overflow[hash]
+	for i, old := range chain {
+		if k, _, _ := decodeEntry(data, old); bytes.Equal(k, key) {
+			chain[i] = position
+			return
+		}
+	}
+	idx.Overflow[hash] = append(chain, position)
+	idx.entries++
+}
+
+// insert add a position whose key is known to be absent from the index
+func (idx *hashIndex) insert(hash uint32, position uint32) {
+	idx.entries++
+	if _, ok := idx.Slots[hash]; !ok {
+		idx.Slots[hash] = position
+		return
+	}
+	idx.Overflow[hash] = append(idx.Overflow[hash], position)
+}
+
+// remove drop the entry at position
+func (idx *hashIndex) remove(hash uint32, position uint32) {
+	chain := idx.Overflow[hash]
+	if slot, ok := idx.Slots[hash]; ok && slot == position {
+		idx.entries--
+		if len(chain) == 0 {
+			delete(idx.Slots, hash)
+			return
+		}
+		// promote the first chained entry to the slot
+		idx.Slots[hash] = chain[0]
+		chain = chain[1:]
+	} else {
+		for i, p := range chain {
+			if p == position {
+				chain = append(chain[:i], chain[i+1:]...)
+				idx.entries--
+				break
+			}
+		}
+	}
+	if len(chain) == 0 {
+		delete(idx.Overflow, hash)
+		return
+	}
+	idx.Overflow[hash] = chain
+}
+
+// forEach call fn for every entry's checksum and position
+func (idx *hashIndex) forEach(fn func(hash uint32, position uint32)) {
+	for hash, position := range idx.Slots {
+		fn(hash, position)
+		for _, position := range idx.Overflow[hash] {
+			fn(hash, position)
+		}
+	}
+}
+
+// scan return the positions of the keys in [start, end) in ascending key order, a nil end is unbounded.
+// the checksum order says nothing about the key order, so every entry has to be checked.
+func (idx *hashIndex) scan(data []byte, start, end []byte) []uint32 {
+	return idx.scanEntries(start, end, bufferReader(data))
+}
+
+// scanEntries is scan over the entries read by read
+func (idx *hashIndex) scanEntries(start, end []byte, read entryReader) []uint32 {
+	return scanKeys(idx, start, end, read)
+}
+
+// scanKeys return the positions of keys whose key is in [start, end) in ascending key order
+func scanKeys(keys tableKeys, start, end []byte, read entryReader) []uint32 {
+	type entry struct {
+		key      []byte
+		position uint32
+	}
+	entries := make([]entry, 0)
+	keys.forEach(func(_ uint32, position uint32) {
+		key, _, _ := read(position)
+		if bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0) {
+			entries = append(entries, entry{key, position})
+		}
+	})
+	// the versions of a key stay in the order they're laid out, from the newest
+	sort.SliceStable(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	positions := make([]uint32, len(entries))
+	for i, e := range entries {
+		positions[i] = e.position
+	}
+	return positions
+}
+
+// len return the number of entries
+func (idx *hashIndex) len() int {
+	return idx.entries
+}
+
+// decodeHashIndex decode the gob index of a table written before the format header, it maps
+// every key's checksum to its entry's position. keys sharing a checksum kept a single entry
+// back then, so it has no overflow.
+func decodeHashIndex(buf []byte) (*hashIndex, error) {
+	idx := newHashIndex()
+	err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&idx.Slots)
+	if err != nil {
+		return nil, err
+	}
+	// gob leaves out an empty map
+	if idx.Slots == nil {
+		idx.Slots = map[uint32]uint32{}
+	}
+	idx.entries = len(idx.Slots)
+	return idx, nil
+}
@@ -74,7 +74,7 @@ func (i *node) delete(minimumKey uint32) *node {
 		}
 		tmp := i
 		i = min(tmp.right)
-		deleteMin(i.right)
+		i.right = deleteMin(tmp.right)
 		i.left = tmp.left
 	}
 	return i
@@ -134,8 +134,5 @@ func (i *indexer) floor(minimumKey uint32) *node {
 }
 
 func (i *indexer) delete(minimumKey uint32) {
-	if i.root == nil {
-		return
-	}
-	i.root.delete(minimumKey)
+	i.root = i.root.delete(minimumKey)
 }
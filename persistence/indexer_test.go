@@ -46,7 +46,25 @@ func TestDeleteTable(t *testing.T) {
 	tr.delete(20)
 	tr.delete(24)
 	tr.delete(10)
-	if tr.root.right != nil || tr.root.left != nil {
+	if tr.root != nil {
 		t.Fatalf("expected root to be nil but got %+v", tr)
 	}
 }
+
+func TestDeleteInnerNode(t *testing.T) {
+	tr := newIndexer()
+	for i, key := range []uint32{50, 30, 70, 20, 40, 60, 80} {
+		tr.put(key, uint32(i))
+	}
+	tr.delete(50)
+	tr.delete(30)
+	if n := tr.floor(55); n.minimumKey != 40 {
+		t.Fatalf("expected 40 but got %d", n.minimumKey)
+	}
+	if n := tr.floor(35); n.minimumKey != 20 {
+		t.Fatalf("expected 20 but got %d", n.minimumKey)
+	}
+	if n := tr.floor(75); n.minimumKey != 70 {
+		t.Fatalf("expected 70 but got %d", n.minimumKey)
+	}
+}
@@ -1,174 +1,118 @@
 package persistence
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
-	"fmt"
-	"hash/crc32"
-	"io"
-	"os"
-	"path"
+	"sort"
 	"sync"
 
-	"github.com/AndreasBriese/bbloom"
 	"github.com/sirupsen/logrus"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
 )
 
+// level0Maintainer keep the bloom filter of every l0 table, the filters are read from the tables' footers.
+// l0 tables overlap each other, so they're kept from the newest to the oldest and a key's newest entry is found first.
 type level0Maintainer struct {
-	filter map[uint32]bbloom.Bloom
-	sync.Mutex
+	tables []level0Table
+	sync.RWMutex
+}
+
+// level0Table is a l0 table with its sequence, see tableMetadata
+type level0Table struct {
+	fd       uint32
+	sequence uint32
+	filter   tableFilter
 }
 
 func newL0Maintainer() *level0Maintainer {
 	return &level0Maintainer{
-		filter: map[uint32]bbloom.Bloom{},
+		tables: make([]level0Table, 0),
 	}
 }
 
-// addTable add new l0 table's bloom to l0 maintainer
-func (lm0 *level0Maintainer) addTable(h *hashMap, fd uint32) {
-	// use bloom filter to record every key-value pair
-	slots := h.Len()
-	filter := bbloom.New(float64(slots), 0.001)
-	//var buf bytes.Buffer
-	//buf.Grow(4)
-	for key := range h.concurrentMap {
-		buf := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf, key)
-		filter.Add(buf)
-	}
+// tableKeys is the index of a memory table or table whose checksums go to a bloom filter
+type tableKeys interface {
+	forEach(fn func(hash uint32, position uint32))
+	len() int
+}
+
+// addTable add new l0 table's bloom to l0 maintainer, the filter is copied out of the mmapped table
+func (lm0 *level0Maintainer) addTable(t *table, sequence uint32) {
 	lm0.Lock()
 	defer lm0.Unlock()
-	lm0.filter[fd] = filter
+	lm0.add(t, sequence)
 }
 
-func (lm0 *level0Maintainer) get(key []byte, holder *tableHolder) ([]byte, bool) {
-	var value []byte
-	c := crc32.New(CrcTable)
-	_, _ = c.Write(key)
-	var hash []byte
-	// TODO: need to optimize!
-	hash = append(hash, c.Sum(hash)...)
-	for fd, bloom := range lm0.filter {
-		isIn := bloom.Has(hash)
-		if isIn {
-			value = lm0.search(key, fd, holder)
-		}
-		if value == nil {
-			continue
-		} else {
-			return value, true
-		}
+// replace swap the l0 tables dels for adds of sequence under one lock, a lookup sees either of them but never both
+func (lm0 *level0Maintainer) replace(dels []uint32, adds []*table, sequences []uint32) {
+	lm0.Lock()
+	defer lm0.Unlock()
+	for _, fd := range dels {
+		lm0.del(fd)
 	}
-	return nil, false
-}
-
-func (lm0 *level0Maintainer) search(key []byte, fd uint32, holder *tableHolder) []byte {
-	holder.fdKey <- fdKey{fd: fd, key: key}
-	result := <-holder.l0
-	if result != nil {
-		return result
+	for i, t := range adds {
+		lm0.add(t, sequences[i])
 	}
-	return nil
-
-	//t0 := readTable(absPath, fd)
-	// TODO: this table's fd should be close but when it close return value will be unreferenced.
-	//defer t0.release()
-	//hash := util.Hashing(key)
-	//if position, ok := t0.offsetMap[hash]; ok {
-	//	keyLength := binary.BigEndian.Uint32(t0.data[position : position+4])
-	//	position += 4
-	//	valLength := binary.BigEndian.Uint32(t0.data[position : position+4])
-	//	position += 4
-	//	return t0.data[position+keyLength : position+keyLength+valLength]
-	//}
 }
 
-// save every l0 table's filter to disk
-func (lm0 *level0Maintainer) save(absPath string) error {
-	filterName := path.Join(absPath, "filter")
-	fp, err := os.OpenFile(filterName, os.O_WRONLY, 0666)
-	if err != nil {
-		return err
-	}
-
-	dump := map[uint32][]byte{}
-	for fd, bloom := range lm0.filter {
-		filterJSON := bloom.JSONMarshal()
-		dump[fd] = filterJSON
-	}
-	encoder := gob.NewEncoder(fp)
-	return encoder.Encode(dump)
+func (lm0 *level0Maintainer) add(t *table, sequence uint32) {
+	added := level0Table{fd: t.index, sequence: sequence, filter: append(tableFilter{}, t.filter...)}
+	i := sort.Search(len(lm0.tables), func(i int) bool {
+		return !newer(lm0.tables[i].sequence, lm0.tables[i].fd, sequence, t.index)
+	})
+	lm0.tables = append(lm0.tables, level0Table{})
+	copy(lm0.tables[i+1:], lm0.tables[i:])
+	lm0.tables[i] = added
 }
 
-// loadFilter load filter from disk
-func loadFilter(absPath string) (*level0Maintainer, error) {
-	filterName := path.Join(absPath, "filter")
-	_, err := os.Stat(filterName)
-	if err != nil {
-		if !os.IsExist(err) {
-			return createFilter(filterName)
-		} else {
-			panic(fmt.Sprintf("check filter error: %v", err))
+// get return the value of key's newest entry up to sequence from the l0 tables,
+// deleted reports the entry is a tombstone. the tables are searched under the read lock,
+// so a compaction can't remove one of them before it's read.
+func (lm0 *level0Maintainer) get(key []byte, search tableSearch, sequence uint64) ([]byte, bool, bool, error) {
+	lm0.RLock()
+	defer lm0.RUnlock()
+	hash := util.Hashing(key)
+	for _, t := range lm0.tables {
+		if !t.filter.mayContain(hash) {
+			continue
+		}
+		value, deleted, ok, err := search(t.fd, key, sequence)
+		if err != nil {
+			return nil, false, false, err
+		}
+		if ok {
+			return value, deleted, true, nil
 		}
 	}
-
-	fp, err := os.Open(filterName)
-	if err != nil {
-		panic(fmt.Sprintf("load filter error: %v", err))
-	}
-
-	dump := map[uint32][]byte{}
-	decoder := gob.NewDecoder(fp)
-	err = decoder.Decode(&dump)
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
-
-	lm0 := newL0Maintainer()
-	for fd, filterJSON := range dump {
-		lm0.filter[fd] = bbloom.JSONUnmarshal(filterJSON)
-	}
-	return lm0, nil
+	return nil, false, false, nil
 }
 
-func createFilter(filterName string) (*level0Maintainer, error) {
-	fp, err := os.Create(filterName)
-	if err != nil {
-		panic(fmt.Sprintf("create filter error: %v", err))
+// mayContain report whether any l0 table other than except may hold an entry of hash
+func (lm0 *level0Maintainer) mayContain(hash uint32, except ...uint32) bool {
+	lm0.RLock()
+	defer lm0.RUnlock()
+	for _, t := range lm0.tables {
+		if _, skip := util.InArray(except, t.fd); skip {
+			continue
+		}
+		if t.filter.mayContain(hash) {
+			return true
+		}
 	}
-	fp.Close()
-	return newL0Maintainer(), nil
+	return false
 }
 
 func (lm0 *level0Maintainer) delTable(fd uint32) {
 	lm0.Lock()
-	if _, ok := lm0.filter[fd]; !ok {
-		logrus.Warnf("level 0 maintainer: don't found the table that should be deleted")
-	}
-	delete(lm0.filter, fd)
-	lm0.Unlock()
+	defer lm0.Unlock()
+	lm0.del(fd)
 }
 
-// compress two tables into one then delete old file in disk
-func (lm0 *level0Maintainer) compress(t1, t2 *table, fd uint32) *table {
-	content := bytes.NewBuffer(t1.data)
-	content.Grow(len(t1.data) + len(t2.data))
-	content.Write(t2.data)
-	t1.data = content.Bytes()
-	offset := uint32(t1.fileInfo.metaOffset)
-	for key, val := range t2.offsetMap {
-		t1.offsetMap[key] = val + offset
-	}
-	if t2.fileInfo.maxRange > t1.fileInfo.maxRange {
-		t1.fileInfo.maxRange = t2.fileInfo.maxRange
-	}
-	if t2.fileInfo.minRange < t1.fileInfo.minRange {
-		t1.fileInfo.minRange = t2.fileInfo.minRange
+func (lm0 *level0Maintainer) del(fd uint32) {
+	for i, t := range lm0.tables {
+		if t.fd == fd {
+			lm0.tables = append(lm0.tables[:i], lm0.tables[i+1:]...)
+			return
+		}
 	}
-	t1.fileInfo.metaOffset += t2.fileInfo.metaOffset
-	t1.fileInfo.entries += t2.fileInfo.entries
-	t1.index = fd
-	return t1
+	logrus.Warnf("level 0 maintainer: don't found the table that should be deleted")
 }
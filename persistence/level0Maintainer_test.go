@@ -0,0 +1,43 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+)
+
+// a compaction mustn't remove a l0 table while a lookup is about to read it, the lookup would miss the key
+func TestLevel0MaintainerReplaceDuringGet(t *testing.T) {
+	lm0 := newL0Maintainer()
+	lm0.addTable(&table{index: 1}, 1)
+	searching := make(chan struct{})
+	release := make(chan struct{})
+	search := func(index uint32, key []byte, sequence uint64) ([]byte, bool, bool, error) {
+		close(searching)
+		<-release
+		return []byte("1"), false, true, nil
+	}
+	found := make(chan bool, 1)
+	go func() {
+		_, _, ok, _ := lm0.get([]byte("key 1"), search, latest)
+		found <- ok
+	}()
+	<-searching
+	replaced := make(chan struct{})
+	go func() {
+		lm0.replace([]uint32{1}, []*table{{index: 2}}, []uint32{2})
+		close(replaced)
+	}()
+	select {
+	case <-replaced:
+		t.Fatal("expected the table to stay until the lookup read it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-replaced
+	if !<-found {
+		t.Fatal("expected the lookup to find the key")
+	}
+	if len(lm0.tables) != 1 || lm0.tables[0].fd != 2 {
+		t.Fatalf("expected table 2 to replace table 1 but got %+v", lm0.tables)
+	}
+}
@@ -0,0 +1,86 @@
+package persistence
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+// levelMaintainer index the tables of a level below level 0,
+// tables of such a level never overlap each other's checksum range.
+type levelMaintainer struct {
+	level   int
+	indexer *indexer
+	ranges  map[uint32]uint32      // every table's minimum checksum which the indexer is keyed by
+	filters map[uint32]tableFilter // every table's bloom filter, copied out of the mmapped table
+	sync.RWMutex
+}
+
+func newLevelMaintainer(level int) *levelMaintainer {
+	return &levelMaintainer{
+		level:   level,
+		indexer: newIndexer(),
+		ranges:  map[uint32]uint32{},
+		filters: map[uint32]tableFilter{},
+	}
+}
+
+func (lm *levelMaintainer) addTable(t *table) {
+	lm.Lock()
+	defer lm.Unlock()
+	lm.add(t)
+}
+
+func (lm *levelMaintainer) delTable(index uint32) {
+	lm.Lock()
+	defer lm.Unlock()
+	lm.del(index)
+}
+
+// replace swap the tables dels for adds under one lock, a lookup sees either of them but never both
+func (lm *levelMaintainer) replace(dels []uint32, adds []*table) {
+	lm.Lock()
+	defer lm.Unlock()
+	for _, index := range dels {
+		lm.del(index)
+	}
+	for _, t := range adds {
+		lm.add(t)
+	}
+}
+
+func (lm *levelMaintainer) add(t *table) {
+	lm.indexer.put(t.fileInfo.minRange, t.index)
+	lm.ranges[t.index] = t.fileInfo.minRange
+	lm.filters[t.index] = append(tableFilter{}, t.filter...)
+}
+
+func (lm *levelMaintainer) del(index uint32) {
+	minRange, ok := lm.ranges[index]
+	if !ok {
+		logrus.Warnf("level %d maintainer: don't found the table that should be deleted", lm.level)
+		return
+	}
+	delete(lm.ranges, index)
+	delete(lm.filters, index)
+	// another table may have taken over the minimum checksum
+	if n := lm.indexer.floor(minRange); n != nil && n.minimumKey == minRange && n.fd == index {
+		lm.indexer.delete(minRange)
+	}
+}
+
+// get check indexer and return the value of key's newest entry up to sequence if it existed,
+// deleted reports the entry found is a tombstone.
+func (lm *levelMaintainer) get(key []byte, search tableSearch, sequence uint64) ([]byte, bool, bool, error) {
+	lm.RLock()
+	defer lm.RUnlock()
+	hash := util.Hashing(key)
+	target := lm.indexer.floor(hash)
+	// most lookups of a key which doesn't exist end at the filter without reading the table
+	if target == nil || !lm.filters[target.fd].mayContain(hash) {
+		return nil, false, false, nil
+	}
+	return search(target.fd, key, sequence)
+}
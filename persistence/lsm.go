@@ -1,40 +1,76 @@
 package persistence
 
 import (
-	"hash/crc32"
-	"os"
+	"fmt"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/y"
 	"github.com/sirupsen/logrus"
 
 	"github.com/Pheomenon/frozra/v1/conf"
-	"github.com/Pheomenon/frozra/v1/persistence/util"
 )
 
+// request is a batch of writes, which is logged and applied at once
 type request struct {
-	key   []byte
-	value []byte
-	wg    sync.WaitGroup
+	entries []batchEntry
+	rewrite []byte // the value log record the gc rewrites the value of, dropped unless the key still points to it
+	flush   bool   // swap the memory table out, see Checkpoint
+	wg      sync.WaitGroup
+}
+
+// size is the total occupied of the entries in Lsm's buf
+func (r *request) size() int {
+	size := 0
+	for _, e := range r.entries {
+		size += e.size()
+	}
+	return size
+}
+
+// writeSlowdown is how long a batch of writes is held while the queue of immutable memory tables is full
+const writeSlowdown = time.Millisecond
+
+// WriteStats count the batches of writes slowed down and the swaps of memory tables which stalled the writes
+// until a flush caught up, StallTime is how long the writes were held. Immutables is the number of
+// memory tables waiting to be flushed.
+type WriteStats struct {
+	Slowdowns  uint64
+	Stalls     uint64
+	StallTime  time.Duration
+	Immutables int
 }
 
 type Lsm struct {
+	sequence          uint64 // sequence of the last write applied to the memory table, see Snapshot
 	setting           conf.Persistence
 	writeChan         chan *request
 	l0Maintainer      *level0Maintainer
-	l1Maintainer      *level1Maintainer
+	levels            []*levelMaintainer // level 0 is kept by l0Maintainer, so its slot is nil
 	absPath           string
 	metadata          *metadata
 	memoryTable       *hashMap
-	swap              *hashMap
+	immutables        []*hashMap // full memory tables waiting to be flushed, the oldest first
+	snapshots         *snapshotList
+	flushed           *sync.Cond // signaled whenever an immutable memory table is flushed
+	stats             WriteStats
+	evictions         EvictionStats
+	wal               *wal
 	flushDisk         chan *hashMap
-	tableHolder       *tableHolder
+	tableCache        *tableCache
+	vlog              *valueLog
 	writeCloser       *y.Closer
 	loadBalanceCloser *y.Closer
 	compactCloser     *y.Closer
 	flushDiskCloser   *y.Closer
+	vlogCloser        *y.Closer
+	policy            CompactionPolicy
+	eviction          EvictionPolicy
+	codec             codec      // compression of every table this node writes
+	compactMutex      sync.Mutex // compaction and load balancing don't rewrite the same tables at once
+	vlogMutex         sync.Mutex // the value log gc doesn't delete segments a checkpoint links
 	sync.RWMutex
 }
 
@@ -43,52 +79,154 @@ func New(setting conf.Persistence) (*Lsm, error) {
 	if err != nil {
 		return nil, err
 	}
+	// every file has to be in the format of this release, older ones are upgraded by frozra-migrate
+	err = checkFormat(absPath)
+	if err != nil {
+		return nil, err
+	}
 
 	md, err := loadMetadata(absPath)
 	if err != nil {
 		return nil, err
 	}
 
-	l0Maintainer, err := loadFilter(absPath)
-
-	l1Maintainer := newLevel1Maintainer()
-	for _, l1File := range md.L1Files {
-		t := readTable(absPath, l1File.Index)
-		l1Maintainer.addTable(t)
-		t.release()
+	// a data directory never loses the levels it already has
+	if setting.MaxLevels < 2 {
+		setting.MaxLevels = 2
+	}
+	if len(md.Levels) > setting.MaxLevels {
+		setting.MaxLevels = len(md.Levels)
+	}
+	if setting.LevelSizeMultiplier < 2 {
+		setting.LevelSizeMultiplier = 10
+	}
+	if setting.TableCacheSize < 1 {
+		setting.TableCacheSize = 64
+	}
+	if setting.BlockCacheSize < 1 {
+		setting.BlockCacheSize = 8 << 20
+	}
+	if setting.MaxImmutableTables < 1 {
+		setting.MaxImmutableTables = 4
+	}
+	if setting.ValueLogFileSize < 1 {
+		setting.ValueLogFileSize = 256 << 20
+	}
+	if setting.ValueLogGCRatio <= 0 || setting.ValueLogGCRatio >= 1 {
+		setting.ValueLogGCRatio = 0.5
+	}
+	md.grow(setting.MaxLevels)
+	policy, err := newCompactionPolicy(setting.CompactionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	eviction, err := newEvictionPolicy(setting.EvictionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := newCodec(setting.Compression)
+	if err != nil {
+		return nil, err
+	}
+	// the value log is opened even with the value threshold unset, the tables may still point to it
+	vlog, err := openValueLog(absPath, int64(setting.ValueLogFileSize))
+	if err != nil {
+		return nil, err
+	}
+	l0Maintainer := newL0Maintainer()
+	levels := make([]*levelMaintainer, setting.MaxLevels)
+	for level := 0; level < setting.MaxLevels; level++ {
+		if level > 0 {
+			levels[level] = newLevelMaintainer(level)
+		}
+		for _, file := range md.copyLevel(level) {
+			t, err := openTable(absPath, file.Index)
+			if _, ok := corruptTable(err); ok {
+				// a corrupt table is left out, the node serves the other ones
+				logrus.Errorf("lsm: level %d %d.fza is taken out of service %s", level, file.Index, err.Error())
+				err = quarantineTable(absPath, file.Index)
+				if err != nil {
+					logrus.Errorf("quarantine: unable to move %d.fza %s", file.Index, err.Error())
+				}
+				err = md.apply(&versionEdit{dels: []levelTable{{level: level, file: file}}})
+				if err != nil {
+					vlog.close()
+					md.close()
+					return nil, err
+				}
+				continue
+			}
+			if err != nil {
+				// any other failure, such as running out of file descriptors, says nothing about the table
+				vlog.close()
+				md.close()
+				return nil, fmt.Errorf("lsm: unable to open level %d %d.fza %v", level, file.Index, err)
+			}
+			if level == 0 {
+				l0Maintainer.addTable(t, file.Sequence)
+			} else {
+				levels[level].addTable(t)
+			}
+			t.close()
+			t.release()
+		}
 	}
-
-	th := newTableHolder(absPath)
 
 	lsm := &Lsm{
 		setting:           setting,
 		writeChan:         make(chan *request, 1024),
 		absPath:           absPath,
 		metadata:          md,
-		memoryTable:       newHashMap(setting.MemoryTableSize),
 		l0Maintainer:      l0Maintainer,
-		l1Maintainer:      l1Maintainer,
-		tableHolder:       th,
+		levels:            levels,
+		policy:            policy,
+		eviction:          eviction,
+		codec:             compression,
+		tableCache:        newTableCache(absPath, setting.TableCacheSize, newBlockCache(setting.BlockCacheSize)),
 		writeCloser:       y.NewCloser(1),
 		loadBalanceCloser: y.NewCloser(1),
 		compactCloser:     y.NewCloser(1),
 		flushDiskCloser:   y.NewCloser(1),
-		flushDisk:         make(chan *hashMap, 1),
+		flushDisk:         make(chan *hashMap, setting.MaxImmutableTables+1),
+		vlog:              vlog,
+		vlogCloser:        y.NewCloser(1),
+		sequence:          md.LastSequence,
+		snapshots:         newSnapshotList(),
+	}
+	lsm.tableCache.vlog = vlog
+	lsm.flushed = sync.NewCond(lsm)
+	lsm.memoryTable = lsm.newMemoryTable()
+	err = lsm.replayWal()
+	if err != nil {
+		return nil, err
 	}
 	go lsm.runCompaction(lsm.compactCloser)
 	go lsm.listeningForFlush(lsm.flushDiskCloser)
 	go lsm.loadBalancing(lsm.loadBalanceCloser)
 	go lsm.acceptWrite(lsm.writeCloser)
+	go lsm.runValueLogGC(lsm.vlogCloser)
 	return lsm, nil
 }
 
 func (l *Lsm) Set(key, val []byte) {
-	r := request{
-		key:   key,
-		value: val,
-	}
+	l.submit(&request{entries: []batchEntry{{key: key, value: val}}})
+}
+
+// SetExpiring write val to key until expires, from then on the key reads as deleted
+// and compaction drops the value. the zero time never expires.
+func (l *Lsm) SetExpiring(key, val []byte, expires time.Time) {
+	l.submit(&request{entries: []batchEntry{{key: key, value: val, expires: expiryOf(expires)}}})
+}
+
+// Delete write a tombstone for key, it hides every older value of the key
+// until compaction drops both of them.
+func (l *Lsm) Delete(key []byte) {
+	l.submit(&request{entries: []batchEntry{{key: key, deleted: true}}})
+}
+
+func (l *Lsm) submit(r *request) {
 	r.wg.Add(1)
-	l.writeChan <- &r
+	l.writeChan <- r
 	r.wg.Wait()
 }
 
@@ -97,29 +235,202 @@ loop:
 	for {
 		select {
 		case req := <-l.writeChan:
-			l.write(req)
+			l.write(l.collect(req))
 		case <-closer.HasBeenClosed():
 			break loop
 		}
 	}
 	close(l.writeChan)
+	batch := make([]*request, 0)
 	for req := range l.writeChan {
-		l.write(req)
+		batch = append(batch, req)
 	}
+	l.write(batch)
 	closer.Done()
 }
 
-func (l *Lsm) write(req *request) {
-	// len(req.key) + len(req.value) + 8 is the total occupied of an entry in Lsm's buf
-	if !l.memoryTable.isEnoughSpace(len(req.key) + len(req.value) + 8) {
-		l.Lock()
-		l.swap = l.memoryTable
-		l.memoryTable = newHashMap(l.setting.MemoryTableSize)
-		l.Unlock()
-		l.flushDisk <- l.swap
-	}
-	l.memoryTable.Set(req.key, req.value)
-	req.wg.Done()
+// collect gather the requests queued behind req, single writes and batches alike,
+// so that group commit can make all of them durable with a single fsync.
+func (l *Lsm) collect(req *request) []*request {
+	batch := []*request{req}
+	if l.wal.syncMode != WalSyncGroup {
+		return batch
+	}
+	for len(batch) < cap(l.writeChan) {
+		select {
+		case next := <-l.writeChan:
+			batch = append(batch, next)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// write log every request to wal before it's applied to the memory table.
+// when the memory table is full, the requests logged so far are applied
+// and the memory table is swapped together with its wal segment.
+func (l *Lsm) write(batch []*request) {
+	l.throttle()
+	start, occupied := 0, 0
+	for i, req := range batch {
+		if req.flush {
+			l.apply(batch[start:i])
+			start, occupied = i+1, 0
+			if l.memoryTable.Len() > 0 {
+				l.swapMemoryTable()
+			}
+			req.wg.Done()
+			continue
+		}
+		if req.rewrite != nil {
+			// the key is checked after every write queued before the rewrite is applied
+			l.apply(batch[start:i])
+			start, occupied = i, 0
+			if !l.pointsTo(req.entries[0].key, req.rewrite) {
+				req.wg.Done()
+				start = i + 1
+				continue
+			}
+		}
+		if !l.memoryTable.isEnoughSpace(occupied + req.size()) {
+			l.apply(batch[start:i])
+			l.swapMemoryTable()
+			start, occupied = i, 0
+		}
+		l.wal.appendBatch(req.entries)
+		occupied += req.size()
+	}
+	l.apply(batch[start:])
+}
+
+func (l *Lsm) apply(batch []*request) {
+	err := l.wal.commit()
+	if err != nil {
+		logrus.Fatalf("wal: unable to commit writes %s", err.Error())
+	}
+	for _, req := range batch {
+		l.memoryTable.putBatch(req.entries)
+		// a snapshot sees either none or all of the batch
+		atomic.StoreUint64(&l.sequence, l.memoryTable.sequence)
+		req.wg.Done()
+	}
+}
+
+func (l *Lsm) swapMemoryTable() {
+	segment, err := l.wal.rotate()
+	if err != nil {
+		logrus.Fatalf("wal: unable to rotate segment %s", err.Error())
+	}
+	l.Lock()
+	defer l.Unlock()
+	full := l.memoryTable
+	full.segment = segment
+	l.immutables = append(l.immutables[:len(l.immutables):len(l.immutables)], full)
+	l.memoryTable = l.newMemoryTable()
+	l.flushDisk <- full
+	// the writes stall until the flush catches up
+	if len(l.immutables) > l.setting.MaxImmutableTables {
+		start := time.Now()
+		for len(l.immutables) > l.setting.MaxImmutableTables {
+			l.flushed.Wait()
+		}
+		stalled := time.Since(start)
+		atomic.AddUint64(&l.stats.Stalls, 1)
+		atomic.AddInt64((*int64)(&l.stats.StallTime), int64(stalled))
+		logrus.Warnf("lsm: writes stalled %v until a memory table was flushed", stalled)
+	}
+}
+
+// throttle slow the writes down while the queue of immutable memory tables is full,
+// so the flush may catch up before the next swap stalls them.
+func (l *Lsm) throttle() {
+	l.RLock()
+	full := len(l.immutables) >= l.setting.MaxImmutableTables
+	l.RUnlock()
+	if full {
+		time.Sleep(writeSlowdown)
+		atomic.AddUint64(&l.stats.Slowdowns, 1)
+		atomic.AddInt64((*int64)(&l.stats.StallTime), int64(writeSlowdown))
+	}
+}
+
+// WriteStats return how often the writes were slowed down and stalled by the memory tables waiting to be flushed
+func (l *Lsm) WriteStats() WriteStats {
+	l.RLock()
+	immutables := len(l.immutables)
+	l.RUnlock()
+	return WriteStats{
+		Slowdowns:  atomic.LoadUint64(&l.stats.Slowdowns),
+		Stalls:     atomic.LoadUint64(&l.stats.Stalls),
+		StallTime:  time.Duration(atomic.LoadInt64((*int64)(&l.stats.StallTime))),
+		Immutables: immutables,
+	}
+}
+
+// newMemoryTable return an empty memory table, it keeps its keys in order in sorted table mode
+// and is persisted with the node's compression.
+func (l *Lsm) newMemoryTable() *hashMap {
+	var h *hashMap
+	if l.setting.SortedTable {
+		h = newSortedHashMap(l.setting.MemoryTableSize)
+	} else {
+		h = newHashMap(l.setting.MemoryTableSize)
+	}
+	h.codec = l.codec
+	h.vlog = l.vlog
+	h.threshold = l.setting.ValueThreshold
+	// sequences go on from the last write
+	h.sequence = atomic.LoadUint64(&l.sequence)
+	h.snapshots = l.snapshots
+	return h
+}
+
+// replayWal rebuild the memory tables lost by a crash from the wal segments,
+// flush them as l0 tables and then start a new segment.
+func (l *Lsm) replayWal() error {
+	segments, err := walSegments(l.absPath)
+	if err != nil {
+		return err
+	}
+	next := uint32(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+	l.wal, err = newWal(l.absPath, next, l.setting.WalSyncMode)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		err = replaySegment(l.absPath, segment, func(e batchEntry) {
+			if !l.memoryTable.isEnoughSpace(e.size()) {
+				l.flushMemory(l.memoryTable)
+				l.memoryTable = l.newMemoryTable()
+			}
+			// replayed writes take new sequences behind the ones of the tables
+			switch {
+			case e.deleted:
+				l.memoryTable.Delete(e.key)
+			case e.expires != 0:
+				l.memoryTable.SetExpiring(e.key, e.value, e.expires)
+			default:
+				l.memoryTable.Set(e.key, e.value)
+			}
+			l.sequence = l.memoryTable.sequence
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if l.memoryTable.Len() > 0 {
+		logrus.Infof("wal: %d entries recovered from %d segments", l.memoryTable.Len(), len(segments))
+		l.flushMemory(l.memoryTable)
+		l.memoryTable = l.newMemoryTable()
+	}
+	for _, segment := range segments {
+		l.wal.remove(segment)
+	}
+	return nil
 }
 
 func (l *Lsm) listeningForFlush(closer *y.Closer) {
@@ -139,91 +450,138 @@ loop:
 	closer.Done()
 }
 
+// Get search key from the newest level to the oldest one,
+// a tombstone, an expired entry or a table which can't be read stops the search as a miss.
 func (l *Lsm) Get(key []byte) ([]byte, bool) {
-	val, exist := l.memoryTable.Get(key)
+	return l.get(key, latest)
+}
+
+// get return the value of key's newest entry up to sequence, see Get
+func (l *Lsm) get(key []byte, sequence uint64) ([]byte, bool) {
+	l.RLock()
+	memoryTable, immutables := l.memoryTable, l.immutables
+	l.RUnlock()
+	val, deleted, exist := memoryTable.lookup(key, sequence)
 	if exist {
-		return val, exist
+		return val, !deleted
 	}
-	if l.swap != nil {
-		val, exist = l.swap.Get(key)
+	// a memory table is flushed as a l0 table before it leaves the queue
+	for i := len(immutables) - 1; i >= 0; i-- {
+		val, deleted, exist = immutables[i].lookup(key, sequence)
 		if exist {
-			return val, exist
+			return val, !deleted
 		}
 	}
 
-	val, exist = l.l0Maintainer.get(key, l.tableHolder)
+	val, deleted, exist = l.searchLevels(key, sequence, l.tableCache.search)
+	return val, exist && !deleted
+}
+
+// searchLevels return the newest entry of key up to sequence in the levels by search, see tableSearch.
+// a table which can't be read is reported by readFailed and the key isn't found.
+func (l *Lsm) searchLevels(key []byte, sequence uint64, search tableSearch) ([]byte, bool, bool) {
+	val, deleted, exist, err := l.l0Maintainer.get(key, search, sequence)
+	if err != nil {
+		l.readFailed(err)
+		return nil, false, false
+	}
 	if exist {
-		return val, exist
+		return val, deleted, true
+	}
+	for _, lm := range l.levels[1:] {
+		val, deleted, exist, err = lm.get(key, search, sequence)
+		if err != nil {
+			l.readFailed(err)
+			return nil, false, false
+		}
+		if exist {
+			return val, deleted, true
+		}
+	}
+	return nil, false, false
+}
+
+// CacheStats return the counters of the block cache
+func (l *Lsm) CacheStats() CacheStats {
+	return l.tableCache.blocks.stats()
+}
+
+// readFailed log a table which couldn't be read, a corrupt one is quarantined.
+// an older value of the key must not be served meanwhile, so the read is a miss.
+func (l *Lsm) readFailed(err error) {
+	logrus.Errorf("lsm: unable to read table %s", err.Error())
+	if index, ok := corruptTable(err); ok {
+		go l.quarantine(index, err)
 	}
-	return l.l1Maintainer.get(key, l.tableHolder)
 }
 
 // Close save all data and metadata form memory to disk
 func (l *Lsm) Close() {
+	l.vlogCloser.SignalAndWait()
 	l.loadBalanceCloser.SignalAndWait()
 	l.compactCloser.SignalAndWait()
 	l.writeCloser.SignalAndWait()
 	if l.memoryTable.Len() > 0 {
+		l.memoryTable.segment = l.wal.current()
 		l.flushDisk <- l.memoryTable
 	}
 	l.flushDiskCloser.SignalAndWait()
-	err := l.metadata.save(l.absPath)
+	err := l.wal.close()
 	if err != nil {
-		logrus.Fatalf("metadata: unable to save the metadata %s", err.Error())
+		logrus.Fatalf("wal: unable to close the wal %s", err.Error())
 	}
-	err = l.l0Maintainer.save(l.absPath)
+	err = l.metadata.close()
 	if err != nil {
-		logrus.Fatalf("filter: unable to save the filter %s", err.Error())
+		logrus.Fatalf("manifest: unable to close the manifest %s", err.Error())
+	}
+	l.tableCache.close()
+	err = l.vlog.close()
+	if err != nil {
+		logrus.Fatalf("vlog: unable to close the value log %s", err.Error())
+	}
+}
+
+// commit log edit to the manifest and apply it to metadata
+func (l *Lsm) commit(edit *versionEdit) {
+	err := l.metadata.apply(edit)
+	if err != nil {
+		logrus.Fatalf("manifest: unable to log the metadata change %s", err.Error())
 	}
 }
 
 func (l *Lsm) flushMemory(swap *hashMap) {
 	nextID := l.metadata.nextFileID()
-	// persist swap to disk
+	// persist swap to disk, the table is synced and renamed into place before the edit is committed
 	swap.persistence(l.absPath, nextID)
-	// add swap's info to metadata
-	l.metadata.addL0File(swap.records, swap.minRange, swap.maxRange, swap.occupiedSpace(), nextID)
-	// add filter to swap
-	l.l0Maintainer.addTable(swap, nextID)
-	l.Lock()
-	l.swap = nil
-	l.Unlock()
-}
-
-func (l *Lsm) merge(t1, t2 *table) {
-	t1.SeekBegin()
-	t2.SeekBegin()
-	merger := newTableMerger(int(t1.size + t2.size))
-	merger.append(t1.fp, int64(t1.fileInfo.metaOffset))
-	merger.append(t2.fp, int64(t2.fileInfo.metaOffset))
-	merger.merge(t1.offsetMap, 0)
-	merger.merge(t2.offsetMap, uint32(t1.fileInfo.metaOffset))
-	buf := merger.setTableInfo()
-	l.saveL1Table(buf)
-}
-
-func (l *Lsm) saveL1Table(buf []byte) {
-	fileID := l.metadata.nextFileID()
-	fp, err := os.Create(util.TablePath(l.absPath, fileID))
-	if err != nil {
-		logrus.Fatalf("compaction: unable to create new while pushing to level 1 %s", err.Error())
-		return
+	// the filter of swap is read back from the table's footer
+	t := readTable(l.absPath, nextID)
+	l.l0Maintainer.addTable(t, nextID)
+	t.close()
+	t.release()
+	// the table must be reachable from the manifest before its wal segment goes away
+	edit := &versionEdit{sequence: swap.sequence}
+	edit.add(0, tableMetadata{
+		Records:  swap.records,
+		MinRange: swap.minRange,
+		MaxRange: swap.maxRange,
+		Size:     uint32(swap.occupiedSpace()),
+		Index:    nextID,
+		Sequence: nextID,
+	})
+	l.commit(edit)
+	if swap.segment != 0 {
+		l.wal.remove(swap.segment)
 	}
-	defer fp.Close()
-	n, err := fp.Write(buf)
-	if err != nil {
-		logrus.Fatalf("compaction: unable to write to new level 1 table %s", err.Error())
-	}
-	if n != len(buf) {
-		logrus.Fatalf("compaction: unable to write a new file at level 1 table expected %d but got %d", len(buf), n)
+	l.Lock()
+	for i, h := range l.immutables {
+		if h == swap {
+			// readers keep the queue they took, so it's never modified in place
+			l.immutables = append(append([]*hashMap{}, l.immutables[:i]...), l.immutables[i+1:]...)
+			break
+		}
 	}
-	// l1 table has been created so have to remove those files from l0
-	// and add it to l1
-	newTable := readTable(l.absPath, fileID)
-	l.l1Maintainer.addTable(newTable)
-
-	l.metadata.addL1File(uint32(newTable.fileInfo.entries), newTable.fileInfo.minRange, newTable.fileInfo.maxRange, int(newTable.size), fileID)
-	logrus.Infof("comapction: new l1 file has beed added %d.fza", fileID)
+	l.flushed.Broadcast()
+	l.Unlock()
 }
 
 func (l *Lsm) runCompaction(closer *y.Closer) {
@@ -234,63 +592,32 @@ loop:
 		case <-closer.HasBeenClosed():
 			break loop
 		case <-compactTicker.C:
-			// check for l0Tables
-			l0Len := l.metadata.l0Len()
-			if l0Len >= l.setting.L0Capacity {
-				// if there is no file on the level 1, just push two level 0 tables to level1
-				if l.metadata.l1Len() == 0 {
-					l.metadata.sortL0()
-					//l.metadata.mutex.Lock()
-					l.tableHolder.Lock()
-					t1, t2 := readTable(l.absPath, l.metadata.L0Files[0].Index), readTable(l.absPath, l.metadata.L0Files[1].Index)
-					t0 := l.l0Maintainer.compress(t1, t2, l.metadata.nextFileID())
-
-					l.tableHolder.remove(l.metadata.L0Files[0].Index)
-					l.tableHolder.remove(l.metadata.L0Files[1].Index)
-
-					l.l0Maintainer.delTable(l.metadata.L0Files[0].Index)
-					l.l0Maintainer.delTable(l.metadata.L0Files[1].Index)
-
-					util.RemoveTable(l.absPath, l.metadata.L0Files[0].Index)
-					util.RemoveTable(l.absPath, l.metadata.L0Files[1].Index)
-
-					l.metadata.delL0File(l.metadata.L0Files[0].Index)
-					l.metadata.delL0File(l.metadata.L0Files[1].Index)
-
-					t0.path = util.TablePath(l.absPath, t0.index)
-					l.l1Maintainer.persistence(t0, l.absPath)
-					l.l1Maintainer.addTable(t0)
-
-					l.metadata.addL1File(uint32(t0.fileInfo.entries), t0.fileInfo.minRange, t0.fileInfo.maxRange, int(t0.size), t0.index)
-					l.tableHolder.Unlock()
-					//l.metadata.mutex.Unlock()
-				} else {
-					// level 1 files already exist so find union set to push
-					// if overlapping range then append accordingly otherwise just push down
-					l0fs := l.metadata.copyL0()
-					logrus.Infof("%+v", l.metadata.L0Files)
-					logrus.Infof("%+v", l.metadata.L1Files)
-					for _, l0f := range l0fs {
-						compactStrategy := l.metadata.l1Status(l0f)
-						if compactStrategy.strategy == NOTUNION {
-							l.notUnion(l0f)
-							continue
-						}
-						if compactStrategy.strategy == UNION {
-							l.union(compactStrategy, l0f)
-							continue
-						}
-						if compactStrategy.strategy == OVERLAPPING {
-							l.overlapping(compactStrategy, l0f)
-						}
-					}
+			// load balancing must not split a table between planning and compacting it
+			l.compactMutex.Lock()
+			for _, c := range l.policy.Plan(l) {
+				if err := l.compact(c); err != nil {
+					// the rest of the plan waits for the next run as well, it may depend on this compaction
+					logrus.Errorf("compaction: level %d is left for the next run %s", c.Level, err.Error())
+					break
 				}
 			}
+			l.enforceQuota()
+			l.compactMutex.Unlock()
 		}
 	}
 	closer.Done()
 }
 
+// levelTarget return the size level is allowed to grow to before it's compacted,
+// level 1 holds levelSizeMultiplier tables and every next level holds levelSizeMultiplier times more.
+func (l *Lsm) levelTarget(level int) uint64 {
+	target := uint64(l.setting.L1TableSize)
+	for i := 0; i < level; i++ {
+		target *= uint64(l.setting.LevelSizeMultiplier)
+	}
+	return target
+}
+
 func (l *Lsm) loadBalancing(closer *y.Closer) {
 	loadBalanceTicker := time.NewTicker(time.Second * 1)
 loop:
@@ -299,33 +626,49 @@ loop:
 		case <-closer.HasBeenClosed():
 			break loop
 		case <-loadBalanceTicker.C:
-			for _, l1f := range l.metadata.copyL1() {
-				if l1f.Size > uint32(l.setting.L1TableSize) {
-					logrus.Infof("load balancing: level 1 file %d.fza found which it larger than max l1 file size", l1f.Index)
-					l1t := readTable(l.absPath, l1f.Index)
-					median := (l1t.fileInfo.maxRange - l1t.fileInfo.minRange) / 2
-					mergers := []*tableMerger{newTableMerger(int(l1f.Size) / 2), newTableMerger(int(l1f.Size) / 2)}
-					iter := l1t.iter()
-					for iter.hasNext() {
-						kl, vl, key, val := iter.next()
-						c := crc32.New(CrcTable)
-						c.Write(key)
-						hash := c.Sum32()
-						if hash < median {
-							mergers[0].add(kl, vl, key, val, hash)
-							continue
-						}
-						mergers[1].add(kl, vl, key, val, hash)
-						continue
+			for level := 1; level < len(l.levels); level++ {
+				for _, file := range l.metadata.copyLevel(level) {
+					// entries of a single checksum can't be split
+					if file.Size > uint32(l.setting.L1TableSize) && file.MinRange < file.MaxRange {
+						l.split(level, file)
 					}
-					l.saveL1Table(mergers[0].setTableInfo())
-					l.saveL1Table(mergers[1].setTableInfo())
-					l.l1Maintainer.delTable(l1f.Index)
-					l.metadata.delL1File(l1f.Index)
-					logrus.Infof("load balancing: level 1 file %d.fza is splitted into two l1 files properly", l1f.Index)
 				}
 			}
 		}
 	}
 	closer.Done()
 }
+
+// split cut a table which is larger than the max table size into tables of about half its size
+func (l *Lsm) split(level int, file tableMetadata) {
+	l.compactMutex.Lock()
+	defer l.compactMutex.Unlock()
+	// compaction may have pushed the table down meanwhile
+	if _, ok := l.metadata.file(level, file.Index); !ok {
+		return
+	}
+	logrus.Infof("load balancing: level %d file %d.fza found which it larger than max table size", level, file.Index)
+	t, err := openTable(l.absPath, file.Index)
+	if err != nil {
+		if err = l.dropCorrupt(err); err != nil {
+			logrus.Errorf("load balancing: level %d %d.fza is left for the next run %s", level, file.Index, err.Error())
+		}
+		return
+	}
+	defer func() {
+		t.close()
+		t.release()
+	}()
+	// the entries are streamed in checksum order, the first half of them goes to one table and the rest to another
+	edit := &versionEdit{}
+	if err = l.stream(level, []*table{t}, t.length()/2, edit); err != nil {
+		if err = l.dropCorrupt(err); err != nil {
+			logrus.Errorf("load balancing: level %d %d.fza is left for the next run %s", level, file.Index, err.Error())
+		}
+		return
+	}
+	edit.del(level, file.Index)
+	l.commit(edit)
+	l.install(edit)
+	logrus.Infof("load balancing: level %d file %d.fza is splitted properly", level, file.Index)
+}
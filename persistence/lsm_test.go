@@ -3,18 +3,24 @@ package persistence
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/Pheomenon/frozra/v1/conf"
+	"github.com/Pheomenon/frozra/v1/persistence/util"
 )
 
 func TestLSM(t *testing.T) {
-	clean()
 	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
 	l, err := New(setting.Persistence)
 	if err != nil {
 		t.Fatalf("Lsm is expected to open but got error %s", err.Error())
@@ -49,7 +55,21 @@ func clean() {
 	os.Remove("./11.fza")
 	os.Remove("./12.fza")
 	os.Remove("./metadata")
+	os.Remove("./" + manifestName)
 	os.Remove("./filter")
+	os.RemoveAll("./" + quarantineDir)
+	segments, _ := filepath.Glob("./*.wal")
+	for _, segment := range segments {
+		os.Remove(segment)
+	}
+	segments, _ = filepath.Glob("./*.vlog")
+	for _, segment := range segments {
+		os.Remove(segment)
+	}
+	tables, _ := filepath.Glob("./*.fza")
+	for _, table := range tables {
+		os.Remove(table)
+	}
 }
 
 func produceEntry(l *Lsm, start, end int) {
@@ -63,8 +83,8 @@ func TestClean(t *testing.T) {
 }
 
 func TestConcurrent(t *testing.T) {
-	clean()
 	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
 	l, err := New(setting.Persistence)
 	if err != nil {
 		t.Fatalf("Lsm is expected to open but got error %s", err.Error())
@@ -156,8 +176,8 @@ func TestConcurrent(t *testing.T) {
 }
 
 func TestCompaction(t *testing.T) {
-	clean()
 	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
 	l, err := New(setting.Persistence)
 	if err != nil {
 		t.Fatalf("Lsm is expected to open but got error %s", err.Error())
@@ -196,8 +216,8 @@ func TestCompaction(t *testing.T) {
 }
 
 func TestDuplicateKey(t *testing.T) {
-	clean()
-	l := initLSM(t)
+	dir := t.TempDir()
+	l := initLSM(t, dir)
 	var key, value []byte
 	key = []byte("phenom")
 	value = []byte("froza")
@@ -209,10 +229,62 @@ func TestDuplicateKey(t *testing.T) {
 	if !bytes.Equal(val, value) {
 		t.Fatalf("Lsm get a unexpected value %s", value)
 	}
+	l.Close()
+}
+
+func TestLsm_Delete(t *testing.T) {
+	dir := t.TempDir()
+	l := initLSM(t, dir)
+	produceEntry(l, 0, 100)
+	l.Close()
+	l = initLSM(t, dir)
+	for i := 0; i < 50; i++ {
+		l.Delete([]byte(fmt.Sprintf("key %d", i)))
+	}
+	// tombstones in the memory table hide the values in l0
+	for i := 0; i <= 100; i++ {
+		val, exist := l.Get([]byte(fmt.Sprintf("key %d", i)))
+		if i < 50 && exist {
+			t.Fatalf("deleted key %d is still visible with value %s", i, val)
+		}
+		if i >= 50 && !bytes.Equal(val, []byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("Lsm get a unexpected value %s", val)
+		}
+	}
+	l.Set([]byte("key 0"), []byte("0"))
+	if val, _ := l.Get([]byte("key 0")); !bytes.Equal(val, []byte("0")) {
+		t.Fatalf("Lsm get a unexpected value %s", val)
+	}
+	l.Close()
 }
 
-func initLSM(t *testing.T) *Lsm {
+func TestLsm_ChecksumCollision(t *testing.T) {
+	dir := t.TempDir()
+	// every pair of keys has the same checksum
+	pairs := [][]string{{"key 1371838", "key 2000402"}, {"key 1371839", "key 2000403"}, {"key 1371832", "key 2000408"}}
+	for _, pair := range pairs {
+		l := initLSM(t, dir)
+		l.Set([]byte(pair[0]), []byte(pair[0]))
+		l.Set([]byte(pair[1]), []byte(pair[1]))
+		l.Close()
+	}
+	l := initLSM(t, dir)
+	// give compaction a chance to push level 0 down
+	time.Sleep(time.Second * 2)
+	for _, pair := range pairs {
+		for _, key := range pair {
+			val, exist := l.Get([]byte(key))
+			if !exist || !bytes.Equal(val, []byte(key)) {
+				t.Fatalf("expected value %s but got %s", key, val)
+			}
+		}
+	}
+	l.Close()
+}
+
+func initLSM(t *testing.T, dir string) *Lsm {
 	setting := conf.LoadConfigure()
+	setting.Persistence.Path = dir
 	l, err := New(setting.Persistence)
 	if err != nil {
 		t.Fatalf("Lsm is expected to open but got error %s", err.Error())
@@ -221,8 +293,8 @@ func initLSM(t *testing.T) *Lsm {
 }
 
 func TestDuplicateKeyInL1(t *testing.T) {
-	clean()
-	l := initLSM(t)
+	dir := t.TempDir()
+	l := initLSM(t, dir)
 	key := []byte("froza")
 	for i := 0; i <= 1<<8; i++ {
 		l.Set(key, []byte(fmt.Sprintf("%b", i)))
@@ -231,65 +303,428 @@ func TestDuplicateKeyInL1(t *testing.T) {
 	if !bytes.Equal(val, []byte(fmt.Sprintf("%b", 1<<8))) {
 		t.Fatalf("Lsm get a unexpected value %s", val)
 	}
+	l.Close()
 }
 
 func TestCompactL0(t *testing.T) {
-	clean()
-	l := initLSM(t)
+	dir := t.TempDir()
+	l := initLSM(t, dir)
 	for i := 0; i < 100; i++ {
 		l.Set([]byte(fmt.Sprintf("phenom%d", i)), []byte(fmt.Sprintf("froza%d", i)))
 	}
 	l.Close()
-	l = initLSM(t)
+	l = initLSM(t, dir)
 	for i := 100; i < 200; i++ {
 		l.Set([]byte(fmt.Sprintf("phenom%d", i)), []byte(fmt.Sprintf("froza%d", i)))
 	}
 	l.Close()
-	l = initLSM(t)
+	l = initLSM(t, dir)
 	val, _ := l.Get([]byte("phenom66"))
 	if !bytes.Equal(val, []byte("froza66")) {
 		t.Fatalf("Lsm get a unexpected value %s", val)
 	}
+	l.Close()
 }
 
 func TestLsm_GetInL0(t *testing.T) {
-	clean()
-	l := initLSM(t)
+	dir := t.TempDir()
+	l := initLSM(t, dir)
 	for i := 0; i < 100; i++ {
 		l.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("%d", i)))
 	}
 	l.Close()
-	l = initLSM(t)
+	l = initLSM(t, dir)
 	val, _ := l.Get([]byte(fmt.Sprintf("key %d", 43)))
 	if !bytes.Equal(val, []byte("43")) {
 		t.Fatalf("Lsm get a unexpected value %s", val)
 	}
+	l.Close()
 }
 
 func TestLsm_GetInL1(t *testing.T) {
-	clean()
-	l := initLSM(t)
+	dir := t.TempDir()
+	l := initLSM(t, dir)
 	produceEntry(l, 0, 100)
 	l.Close()
-	l = initLSM(t)
+	l = initLSM(t, dir)
 	produceEntry(l, 100, 200)
 	l.Close()
-	l = initLSM(t)
+	l = initLSM(t, dir)
 	produceEntry(l, 200, 300)
 	l.Close()
-	l = initLSM(t)
+	l = initLSM(t, dir)
 	val, _ := l.Get([]byte(fmt.Sprintf("key %d", 32)))
 	if !bytes.Equal(val, []byte("32")) {
 		t.Fatalf("Lsm get a unexpected value %s", val)
 	}
+	l.Close()
+}
+
+func initSortedLSM(t *testing.T, dir string) *Lsm {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = dir
+	setting.Persistence.SortedTable = true
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatalf("Lsm is expected to open but got error %s", err.Error())
+	}
+	return l
+}
+
+// scanned collect every key and value a scan hands over
+func scanned(scan func(fn func(key, value []byte) bool)) []string {
+	kvs := make([]string, 0)
+	scan(func(key, value []byte) bool {
+		kvs = append(kvs, fmt.Sprintf("%s=%s", key, value))
+		return true
+	})
+	return kvs
+}
+
+func TestLsm_Scan(t *testing.T) {
+	dir := t.TempDir()
+	l := initSortedLSM(t, dir)
+	for i := 0; i < 100; i++ {
+		l.Set([]byte(fmt.Sprintf("user:%02d", i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	l.Set([]byte("order:1"), []byte("1"))
+	l.Close()
+	l = initSortedLSM(t, dir)
+	// newer entries in the memory table override and delete the ones in l0
+	l.Set([]byte("user:10"), []byte("phenom"))
+	l.Delete([]byte("user:11"))
+	l.Set([]byte("user:100"), []byte("froza"))
+	kvs := scanned(func(fn func(key, value []byte) bool) {
+		l.ScanPrefix([]byte("user:1"), fn)
+	})
+	expected := []string{"user:10=phenom", "user:100=froza", "user:12=12", "user:13=13", "user:14=14",
+		"user:15=15", "user:16=16", "user:17=17", "user:18=18", "user:19=19"}
+	if fmt.Sprint(kvs) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v but got %v", expected, kvs)
+	}
+	kvs = scanned(func(fn func(key, value []byte) bool) {
+		l.Scan([]byte("user:98"), nil, fn)
+	})
+	if fmt.Sprint(kvs) != fmt.Sprint([]string{"user:98=98", "user:99=99"}) {
+		t.Fatalf("unexpected scan result %v", kvs)
+	}
+	// returning false stops the scan
+	count := 0
+	l.Scan(nil, nil, func(key, value []byte) bool {
+		count++
+		return count < 5
+	})
+	if count != 5 {
+		t.Fatalf("expected the scan to stop after 5 keys but got %d", count)
+	}
+	l.Close()
+}
+
+func TestLsm_ScanUnsortedTable(t *testing.T) {
+	dir := t.TempDir()
+	// tables written without sorted table mode are scanned as well
+	l := initLSM(t, dir)
+	produceEntry(l, 0, 100)
+	l.Close()
+	l = initSortedLSM(t, dir)
+	l.Delete([]byte("key 5"))
+	kvs := scanned(func(fn func(key, value []byte) bool) {
+		l.ScanPrefix([]byte("key 5"), fn)
+	})
+	expected := []string{"key 50=50", "key 51=51", "key 52=52", "key 53=53", "key 54=54",
+		"key 55=55", "key 56=56", "key 57=57", "key 58=58", "key 59=59"}
+	if fmt.Sprint(kvs) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v but got %v", expected, kvs)
+	}
+	l.Close()
+}
+
+func TestLsm_Iterator(t *testing.T) {
+	dir := t.TempDir()
+	l := initSortedLSM(t, dir)
+	for i := 0; i < 100; i++ {
+		l.Set([]byte(fmt.Sprintf("key %02d", i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	l.flush()
+	l.compactMutex.Lock()
+	l.compact(Compaction{Level: 0, Victims: []uint32{l.metadata.copyLevel(0)[0].Index}, Output: 1})
+	l.compactMutex.Unlock()
+	// level 0 and the memory table shadow level 1
+	l.Set([]byte("key 10"), []byte("phenom"))
+	l.Delete([]byte("key 11"))
+	l.flush()
+	l.Set([]byte("key 12"), []byte("frozra"))
+	l.Delete([]byte("key 13"))
+	l.Set([]byte("key 100"), []byte("100"))
+	it := l.NewIterator()
+	// writes after the iterator is created aren't seen
+	l.Set([]byte("key 14"), []byte("xonlab"))
+	l.Set([]byte("key 101"), []byte("101"))
+	kvs := make([]string, 0)
+	for it.Next() {
+		kvs = append(kvs, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	it.Close()
+	if len(kvs) != 99 {
+		t.Fatalf("expected 99 keys but got %d", len(kvs))
+	}
+	expected := []string{"key 09=9", "key 10=phenom", "key 100=100", "key 12=frozra", "key 14=14"}
+	if fmt.Sprint(kvs[9:14]) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v but got %v", expected, kvs[9:14])
+	}
+	if sequences := l.snapshots.sequences(); len(sequences) != 0 {
+		t.Fatalf("expected the snapshot of the iterator to be released but got %v", sequences)
+	}
+	l.Close()
+}
+
+// iterated return key=value of every key the iterator walks and close it
+func iterated(it *Iterator) []string {
+	defer it.Close()
+	kvs := make([]string, 0)
+	for it.Next() {
+		kvs = append(kvs, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	return kvs
+}
+
+// an iterator reads the keys of an unsorted table before its first key
+func TestLsm_IteratorUnsorted(t *testing.T) {
+	l := initLSM(t, t.TempDir())
+	defer l.Close()
+	produceEntry(l, 0, 100)
+	l.flush()
+	l.Set([]byte("key 10"), []byte("phenom"))
+	l.Delete([]byte("key 11"))
+	expected := scanned(func(fn func(key, value []byte) bool) { l.Scan(nil, nil, fn) })
+	kvs := iterated(l.NewIterator())
+	if len(kvs) != 100 || fmt.Sprint(kvs) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v but got %v", expected, kvs)
+	}
+	if fmt.Sprint(kvs[:4]) != "[key 0=0 key 1=1 key 10=phenom key 100=100]" {
+		t.Fatalf("unexpected keys %v", kvs[:4])
+	}
+	if sequences := l.snapshots.sequences(); len(sequences) != 0 {
+		t.Fatalf("expected the snapshot of the iterator to be released but got %v", sequences)
+	}
+	// a table written before the switch to sorted table mode is merged with the sorted ones
+	dir := t.TempDir()
+	l = initLSM(t, dir)
+	produceEntry(l, 0, 100)
+	l.Close()
+	l = initSortedLSM(t, dir)
+	defer l.Close()
+	l.Set([]byte("key 5"), []byte("xonlab"))
+	l.flush()
+	keys := make([]string, 0)
+	for i := 0; i <= 100; i++ {
+		keys = append(keys, fmt.Sprintf("key %d", i))
+	}
+	sort.Strings(keys)
+	expected = make([]string, 0)
+	for _, key := range keys {
+		value := strings.TrimPrefix(key, "key ")
+		if key == "key 5" {
+			value = "xonlab"
+		}
+		expected = append(expected, key+"="+value)
+	}
+	if kvs = iterated(l.NewIterator()); fmt.Sprint(kvs) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v but got %v", expected, kvs)
+	}
+}
+
+func TestLsm_Compression(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.MemoryTableSize = 64 << 10
+	setting.Persistence.L1TableSize = 16 << 10
+	setting.Persistence.SortedTable = true
+	setting.Persistence.Compression = CompressionSnappy
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatalf("Lsm is expected to open but got error %s", err.Error())
+	}
+	value := bytes.Repeat([]byte(`{"name":"froza"}`), 8)
+	for i := 0; i < 4000; i++ {
+		l.Set([]byte(fmt.Sprintf("key %04d", i)), value)
+	}
+	// give compaction a chance to rewrite the flushed tables
+	time.Sleep(time.Second * 2)
+	l.Close()
+	// the codec is recorded by every table, so they are still readable without compression
+	setting.Persistence.Compression = CompressionNone
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatalf("Lsm is expected to open but got error %s", err.Error())
+	}
+	for i := 0; i < 4000; i++ {
+		val, exist := l.Get([]byte(fmt.Sprintf("key %04d", i)))
+		if !exist || !bytes.Equal(val, value) {
+			t.Fatalf("expected value %s but got %s", value, val)
+		}
+	}
+	kvs := scanned(func(fn func(key, value []byte) bool) {
+		l.ScanPrefix([]byte("key 12"), fn)
+	})
+	if len(kvs) != 100 {
+		t.Fatalf("expected 100 keys but got %d", len(kvs))
+	}
+	l.Close()
+	setting.Persistence.Compression = "lz4"
+	if _, err = New(setting.Persistence); err == nil {
+		t.Fatal("expected an unknown codec to be refused")
+	}
+}
+
+func TestLsm_Quarantine(t *testing.T) {
+	dir := t.TempDir()
+	l := initLSM(t, dir)
+	produceEntry(l, 0, 100)
+	l.Close()
+	// flip a byte in the data of the only l0 table
+	tm := l.metadata.copyLevel(0)[0]
+	content, err := ioutil.ReadFile(util.TablePath(l.absPath, tm.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[10] ^= 0xff
+	err = ioutil.WriteFile(util.TablePath(l.absPath, tm.Index), content, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = initLSM(t, dir)
+	l.Set([]byte("key 101"), []byte("101"))
+	if _, exist := l.Get([]byte("key 1")); exist {
+		t.Fatal("expected a key of the corrupt table to be missing")
+	}
+	// the node keeps serving once the table is quarantined
+	time.Sleep(time.Millisecond * 100)
+	if val, exist := l.Get([]byte("key 101")); !exist || !bytes.Equal(val, []byte("101")) {
+		t.Fatalf("expected value 101 but got %s", val)
+	}
+	if _, ok := l.metadata.levelOf(tm.Index); ok {
+		t.Fatal("expected the corrupt table to be dropped from metadata")
+	}
+	if _, err = os.Stat(util.TablePath(filepath.Join(l.absPath, quarantineDir), tm.Index)); err != nil {
+		t.Fatalf("expected the corrupt table in the quarantine directory but got %v", err)
+	}
+	l.Close()
+}
+
+func TestLsm_OpenUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	l := initLSM(t, dir)
+	produceEntry(l, 0, 100)
+	l.Close()
+	tm := l.metadata.copyLevel(0)[0]
+	// a table which can't be opened for a reason of its own, the node refuses to start without it
+	table := util.TablePath(l.absPath, tm.Index)
+	if err := os.Rename(table, table+".away"); err != nil {
+		t.Fatal(err)
+	}
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = dir
+	if l, err := New(setting.Persistence); err == nil {
+		l.Close()
+		t.Fatal("expected the node to refuse to start")
+	}
+	os.Rename(table+".away", table)
+	l = initLSM(t, dir)
+	defer l.Close()
+	if level, ok := l.metadata.levelOf(tm.Index); !ok || level != 0 {
+		t.Fatalf("expected the table to stay in level 0 but got %d %v", level, ok)
+	}
+	if val, _ := l.Get([]byte("key 1")); !bytes.Equal(val, []byte("1")) {
+		t.Fatalf("expected value 1 but got %s", val)
+	}
+}
+
+func TestLsm_CompactUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	l := initLSM(t, dir)
+	produceEntry(l, 0, 100)
+	l.Close()
+	l = initLSM(t, dir)
+	defer l.Close()
+	l.compactMutex.Lock()
+	defer l.compactMutex.Unlock()
+	tm := l.metadata.copyLevel(0)[0]
+	// a table which can't be opened for a reason of its own, such as running out of file descriptors
+	table := util.TablePath(l.absPath, tm.Index)
+	if err := os.Rename(table, table+".away"); err != nil {
+		t.Fatal(err)
+	}
+	c := Compaction{Level: 0, Victims: []uint32{tm.Index}, Output: 1}
+	if err := l.compact(c); err == nil {
+		t.Fatal("expected the compaction to fail")
+	}
+	if level, ok := l.metadata.levelOf(tm.Index); !ok || level != 0 {
+		t.Fatalf("expected the table to stay in level 0 but got %d %v", level, ok)
+	}
+	if _, err := os.Stat(filepath.Join(l.absPath, quarantineDir)); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be quarantined but got %v", err)
+	}
+	os.Rename(table+".away", table)
+	if err := l.compact(c); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := l.Get([]byte("key 1")); !bytes.Equal(val, []byte("1")) {
+		t.Fatalf("expected value 1 but got %s", val)
+	}
+}
+
+func TestLsm_Leveled(t *testing.T) {
+	for _, policy := range []string{CompactionPushDown, CompactionLeveled, CompactionSizeTiered} {
+		t.Run(policy, func(t *testing.T) {
+			testCompactionPolicy(t, policy)
+		})
+	}
+}
+
+func testCompactionPolicy(t *testing.T, policy string) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.MemoryTableSize = 64 << 10
+	setting.Persistence.L1TableSize = 16 << 10
+	setting.Persistence.LevelSizeMultiplier = 2
+	setting.Persistence.MaxLevels = 4
+	setting.Persistence.CompactionPolicy = policy
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatalf("Lsm is expected to open but got error %s", err.Error())
+	}
+	value := bytes.Repeat([]byte("froza"), 20)
+	for i := 0; i < 4000; i++ {
+		l.Set([]byte(fmt.Sprintf("key %d", i)), append([]byte(fmt.Sprintf("%d", i)), value...))
+	}
+	for i := 0; i < 4000; i += 2 {
+		l.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	// give compaction a chance to push the tables down level by level
+	time.Sleep(time.Second * 5)
+	if l.metadata.levelLen(2) == 0 {
+		t.Fatalf("expected tables at level 2 but got %d %d %d %d", l.metadata.levelLen(0), l.metadata.levelLen(1), l.metadata.levelLen(2), l.metadata.levelLen(3))
+	}
+	for i := 0; i < 4000; i++ {
+		expected := append([]byte(fmt.Sprintf("%d", i)), value...)
+		if i%2 == 0 {
+			expected = []byte(fmt.Sprintf("%d", i))
+		}
+		val, exist := l.Get([]byte(fmt.Sprintf("key %d", i)))
+		if !exist || !bytes.Equal(val, expected) {
+			t.Fatalf("expected value %s but got %s", expected, val)
+		}
+	}
+	l.Close()
 }
 
 func TestLsm_Mixed(t *testing.T) {
-	clean()
-	l := initLSM(t)
+	dir := t.TempDir()
+	l := initLSM(t, dir)
 	produceEntry(l, 0, 1<<24)
 	l.Close()
-	l = initLSM(t)
+	l = initLSM(t, dir)
 	for i := 0; i <= 1<<24; i++ {
 		val, _ := l.Get([]byte(fmt.Sprintf("key %d", i)))
 		logrus.Infof("got val %s", val)
@@ -310,8 +745,8 @@ go tool pprof -pdf cpu.out > cpu.pdf
 go tool pprof -svg cpu.out > cpu.svg
 */
 func BenchmarkLsm_Set(b *testing.B) {
-	clean()
 	setting := conf.LoadConfigure()
+	setting.Persistence.Path = b.TempDir()
 	l, _ := New(setting.Persistence)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -320,8 +755,8 @@ func BenchmarkLsm_Set(b *testing.B) {
 }
 
 func BenchmarkLsm_Get(b *testing.B) {
-	clean()
 	setting := conf.LoadConfigure()
+	setting.Persistence.Path = b.TempDir()
 	l, _ := New(setting.Persistence)
 	produceEntry(l, 0, 1<<22)
 	b.ResetTimer()
@@ -329,3 +764,94 @@ func BenchmarkLsm_Get(b *testing.B) {
 		l.Get([]byte(fmt.Sprintf("key %d", b.N)))
 	}
 }
+
+func TestLsm_WriteStall(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.MemoryTableSize = 4 << 10
+	setting.Persistence.MaxImmutableTables = 2
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no flush can commit its table until the metadata is released
+	l.metadata.mutex.Lock()
+	done := make(chan struct{})
+	go func() {
+		produceEntry(l, 0, 1000)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for l.WriteStats().Immutables <= setting.Persistence.MaxImmutableTables && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("expected the writes to stall while no memory table is flushed")
+	default:
+	}
+	// every memory table waiting to be flushed is readable
+	if val, _ := l.Get([]byte("key 0")); !bytes.Equal(val, []byte("0")) {
+		t.Fatalf("expected value 0 but got %s", val)
+	}
+	l.metadata.mutex.Unlock()
+	<-done
+	stats := l.WriteStats()
+	if stats.Stalls == 0 || stats.Slowdowns == 0 || stats.StallTime < 50*time.Millisecond {
+		t.Fatalf("expected the stall to be counted but got %+v", stats)
+	}
+	for i := 0; i <= 1000; i++ {
+		if val, _ := l.Get([]byte(fmt.Sprintf("key %d", i))); !bytes.Equal(val, []byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("expected value %d but got %s", i, val)
+		}
+	}
+	l.Close()
+}
+
+func TestLsm_L0Order(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.L0Capacity = 100
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(version int) {
+		for i := 0; i < 20; i++ {
+			if val, _ := l.Get([]byte("key")); !bytes.Equal(val, []byte(fmt.Sprintf("%d", version))) {
+				t.Fatalf("expected version %d but got %s", version, val)
+			}
+		}
+		l.Scan([]byte("key"), []byte("key\x00"), func(key, val []byte) bool {
+			if !bytes.Equal(val, []byte(fmt.Sprintf("%d", version))) {
+				t.Fatalf("expected version %d to be scanned but got %s", version, val)
+			}
+			return true
+		})
+	}
+	// every version of the key is flushed to its own l0 table
+	for version := 1; version <= 5; version++ {
+		l.Set([]byte("key"), []byte(fmt.Sprintf("%d", version)))
+		l.Set([]byte(fmt.Sprintf("key %d", version)), []byte("Phenom"))
+		l.flush()
+		check(version)
+	}
+	// the oldest tables are merged into a table of a larger index than the newer ones
+	l.compactMutex.Lock()
+	files := byAge(l.metadata.copyLevel(0))
+	l.compact(Compaction{Level: 0, Victims: []uint32{files[1].Index, files[0].Index}, Output: 0})
+	l.compactMutex.Unlock()
+	files = byAge(l.metadata.copyLevel(0))
+	if len(files) != 4 || files[0].Index < files[3].Index || files[0].Sequence >= files[1].Sequence {
+		t.Fatalf("expected the merged table to keep the sequence of the newest table merged but got %v", files)
+	}
+	check(5)
+	l.Close()
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	check(5)
+}
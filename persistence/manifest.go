@@ -0,0 +1,300 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the manifest is the log of every change to the tables of the levels. a change is appended
+// as a version edit and fsynced before it takes effect, so a crash leaves the metadata of the
+// last change which made it to disk. it's replayed when the node starts, and it's rotated into
+// a single edit holding the whole metadata when the node starts or the log grows past manifestLimit.
+const (
+	manifestName  = "MANIFEST"
+	manifestLimit = 1 << 20
+)
+
+// levelTable is a table of a level
+type levelTable struct {
+	level int
+	file  tableMetadata
+}
+
+// versionEdit is a change to the metadata, the tables it removes from and adds to levels.
+// levels, next and sequence are the number of levels, the last file ID and the last sequence
+// of the entries in the tables once the edit is applied.
+// it's saved as a record of checksum(4) + length(4) + payload, where the payload is
+// levels(4) + next(4) + count(4) + (level(4) + index(4) + min(4) + max(4) + size(4) + records(4))
+// for every table added + count(4) + (level(4) + index(4)) for every table removed + sequence(4)
+// for every table added + sequence(8).
+type versionEdit struct {
+	levels   int
+	next     uint32
+	sequence uint64
+	adds     []levelTable
+	dels     []levelTable
+}
+
+func (e *versionEdit) add(level int, file tableMetadata) {
+	e.adds = append(e.adds, levelTable{level: level, file: file})
+}
+
+func (e *versionEdit) del(level int, index uint32) {
+	e.dels = append(e.dels, levelTable{level: level, file: tableMetadata{Index: index}})
+}
+
+// encode return the record of e
+func (e *versionEdit) encode() []byte {
+	buf := make([]byte, 8+12+24*len(e.adds)+4+8*len(e.dels)+4*len(e.adds)+8)
+	payload := buf[8:]
+	binary.BigEndian.PutUint32(payload[0:4], uint32(e.levels))
+	binary.BigEndian.PutUint32(payload[4:8], e.next)
+	binary.BigEndian.PutUint32(payload[8:12], uint32(len(e.adds)))
+	offset := 12
+	for _, t := range e.adds {
+		binary.BigEndian.PutUint32(payload[offset:], uint32(t.level))
+		binary.BigEndian.PutUint32(payload[offset+4:], t.file.Index)
+		binary.BigEndian.PutUint32(payload[offset+8:], t.file.MinRange)
+		binary.BigEndian.PutUint32(payload[offset+12:], t.file.MaxRange)
+		binary.BigEndian.PutUint32(payload[offset+16:], t.file.Size)
+		binary.BigEndian.PutUint32(payload[offset+20:], t.file.Records)
+		offset += 24
+	}
+	binary.BigEndian.PutUint32(payload[offset:], uint32(len(e.dels)))
+	offset += 4
+	for _, t := range e.dels {
+		binary.BigEndian.PutUint32(payload[offset:], uint32(t.level))
+		binary.BigEndian.PutUint32(payload[offset+4:], t.file.Index)
+		offset += 8
+	}
+	for _, t := range e.adds {
+		binary.BigEndian.PutUint32(payload[offset:], t.file.Sequence)
+		offset += 4
+	}
+	binary.BigEndian.PutUint64(payload[offset:], e.sequence)
+	binary.BigEndian.PutUint32(buf[0:4], crc32.Checksum(payload, CrcTable))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	return buf
+}
+
+// decodeVersionEdit return the edit of the record buf starts with and the length of the record
+func decodeVersionEdit(buf []byte) (*versionEdit, int, error) {
+	if len(buf) < 8 {
+		return nil, 0, fmt.Errorf("manifest: record header is torn")
+	}
+	length := binary.BigEndian.Uint32(buf[4:8])
+	if uint32(len(buf)-8) < length {
+		return nil, 0, fmt.Errorf("manifest: record of %d bytes is torn", length)
+	}
+	payload := buf[8 : 8+length]
+	if crc32.Checksum(payload, CrcTable) != binary.BigEndian.Uint32(buf[0:4]) {
+		return nil, 0, fmt.Errorf("manifest: record checksum mismatch")
+	}
+	if len(payload) < 12 {
+		return nil, 0, fmt.Errorf("manifest: record of %d bytes is too short", length)
+	}
+	e := &versionEdit{
+		levels: int(binary.BigEndian.Uint32(payload[0:4])),
+		next:   binary.BigEndian.Uint32(payload[4:8]),
+	}
+	adds := int(binary.BigEndian.Uint32(payload[8:12]))
+	offset := 12
+	if (len(payload)-offset)/24 < adds {
+		return nil, 0, fmt.Errorf("manifest: %d added tables don't fit in %d bytes", adds, length)
+	}
+	for i := 0; i < adds; i++ {
+		e.add(int(binary.BigEndian.Uint32(payload[offset:])), tableMetadata{
+			Index:    binary.BigEndian.Uint32(payload[offset+4:]),
+			MinRange: binary.BigEndian.Uint32(payload[offset+8:]),
+			MaxRange: binary.BigEndian.Uint32(payload[offset+12:]),
+			Size:     binary.BigEndian.Uint32(payload[offset+16:]),
+			Records:  binary.BigEndian.Uint32(payload[offset+20:]),
+		})
+		offset += 24
+	}
+	if len(payload)-offset < 4 {
+		return nil, 0, fmt.Errorf("manifest: record of %d bytes is too short", length)
+	}
+	dels := int(binary.BigEndian.Uint32(payload[offset:]))
+	offset += 4
+	if len(payload)-offset != 8*dels+4*adds+8 {
+		return nil, 0, fmt.Errorf("manifest: %d removed tables don't match %d bytes", dels, length)
+	}
+	for i := 0; i < dels; i++ {
+		e.del(int(binary.BigEndian.Uint32(payload[offset:])), binary.BigEndian.Uint32(payload[offset+4:]))
+		offset += 8
+	}
+	for i := range e.adds {
+		e.adds[i].file.Sequence = binary.BigEndian.Uint32(payload[offset:])
+		offset += 4
+	}
+	e.sequence = binary.BigEndian.Uint64(payload[offset:])
+	return e, 8 + int(length), nil
+}
+
+// replay apply every edit of the manifest content, a record torn by a crash ends the log.
+// an edit is logged before its tables are installed or removed, so the edits in front of it hold the levels.
+// only the last record can be torn, a bad record followed by others is corruption and an error.
+func (m *metadata) replay(content []byte) error {
+	if version := decodeHeader(content, manifestFile); version != FormatVersion {
+		return &formatError{name: manifestName, version: version}
+	}
+	for offset := headerSize; offset < len(content); {
+		edit, n, err := decodeVersionEdit(content[offset:])
+		if err != nil && tornRecord(content[offset:]) {
+			logrus.Warnf("manifest: %d bytes at offset %d are dropped %s", len(content)-offset, offset, err.Error())
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s at offset %d, rebuild the levels with Recover", err.Error(), offset)
+		}
+		m.redo(edit)
+		offset += n
+	}
+	return nil
+}
+
+// tornRecord report whether the record buf starts with runs past the end of the log, a crash while it
+// was appended leaves it incomplete then. a record is appended in a single write, so a torn one is the
+// prefix of a well formed record and its length matches the tables it adds and removes as far as they're
+// there. a bad length in front of other records doesn't, the length isn't covered by the checksum.
+func tornRecord(buf []byte) bool {
+	if len(buf) < 8 {
+		return true
+	}
+	length := uint64(binary.BigEndian.Uint32(buf[4:8]))
+	payload := buf[8:]
+	if uint64(len(payload)) >= length {
+		return false
+	}
+	if len(payload) < 12 {
+		return true
+	}
+	adds := uint64(binary.BigEndian.Uint32(payload[8:12]))
+	offset := 12 + 24*adds
+	if offset+4 > length {
+		return false
+	}
+	if uint64(len(payload)) < offset+4 {
+		return true
+	}
+	dels := uint64(binary.BigEndian.Uint32(payload[offset:]))
+	return length == offset+4+8*dels+4*adds+8
+}
+
+// redo apply edit to the levels, the caller holds the mutex
+func (m *metadata) redo(edit *versionEdit) {
+	for len(m.Levels) < edit.levels {
+		m.Levels = append(m.Levels, make([]tableMetadata, 0))
+	}
+	for _, t := range edit.dels {
+		m.delFile(t.level, t.file.Index)
+	}
+	for _, t := range edit.adds {
+		for len(m.Levels) <= t.level {
+			m.Levels = append(m.Levels, make([]tableMetadata, 0))
+		}
+		m.addFile(t.level, t.file)
+	}
+	if edit.next > atomic.LoadUint32(&m.NextIndex) {
+		atomic.StoreUint32(&m.NextIndex, edit.next)
+	}
+	if edit.sequence > m.LastSequence {
+		m.LastSequence = edit.sequence
+	}
+}
+
+// apply log edit to the manifest and apply it once it's on disk
+func (m *metadata) apply(edit *versionEdit) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	edit.levels = len(m.Levels)
+	edit.next = atomic.LoadUint32(&m.NextIndex)
+	if edit.sequence < m.LastSequence {
+		edit.sequence = m.LastSequence
+	}
+	record := edit.encode()
+	_, err := m.manifest.Write(record)
+	if err != nil {
+		return err
+	}
+	err = m.manifest.Sync()
+	if err != nil {
+		return err
+	}
+	m.manifestSize += len(record)
+	m.redo(edit)
+	if m.manifestSize >= manifestLimit {
+		return m.rotate()
+	}
+	return nil
+}
+
+// rotate replace the manifest with one holding a single edit of the whole metadata.
+// the new manifest is written next to the old one and renamed over it,
+// so a crash leaves either of them behind. the caller holds the mutex.
+func (m *metadata) rotate() error {
+	size, err := m.writeManifest(m.absPath)
+	if err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(path.Join(m.absPath, manifestName), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if m.manifest != nil {
+		m.manifest.Close()
+	}
+	m.manifest = fp
+	m.manifestSize = size
+	return nil
+}
+
+// writeManifest write a manifest of the whole metadata to dir through a temporary file
+// and return its size, the caller holds the mutex.
+func (m *metadata) writeManifest(dir string) (int, error) {
+	snapshot := &versionEdit{levels: len(m.Levels), next: atomic.LoadUint32(&m.NextIndex), sequence: m.LastSequence}
+	for level, files := range m.Levels {
+		for _, f := range files {
+			snapshot.add(level, f)
+		}
+	}
+	manifest := path.Join(dir, manifestName)
+	content := append(encodeHeader(manifestFile), snapshot.encode()...)
+	tmp := manifest + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	_, err = fp.Write(content)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, manifest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return len(content), syncDir(dir)
+}
+
+// syncDir fsync the directory at dir, so the files renamed in it stay renamed
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
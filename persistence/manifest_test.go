@@ -0,0 +1,160 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	m, err := loadMetadata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		edit := &versionEdit{}
+		edit.add(0, tableMetadata{Index: m.nextFileID(), MinRange: 1, MaxRange: 9, Size: 100, Records: 4})
+		if err = m.apply(edit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edit := &versionEdit{}
+	edit.add(1, tableMetadata{Index: m.nextFileID(), MinRange: 1, MaxRange: 9, Size: 300, Records: 12})
+	edit.del(0, 1)
+	edit.del(0, 2)
+	edit.del(0, 3)
+	if err = m.apply(edit); err != nil {
+		t.Fatal(err)
+	}
+	m.grow(3)
+	edit = &versionEdit{}
+	edit.add(2, tableMetadata{Index: 4, MinRange: 1, MaxRange: 9, Size: 300, Records: 12})
+	edit.del(1, 4)
+	if err = m.apply(edit); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprint(m.Levels, m.NextIndex)
+	m.close()
+
+	// a crash while an edit is appended leaves a torn record behind
+	manifest := filepath.Join(dir, manifestName)
+	fp, _ := os.OpenFile(manifest, os.O_WRONLY|os.O_APPEND, 0666)
+	edit = &versionEdit{levels: 3, next: 5}
+	edit.add(0, tableMetadata{Index: 5})
+	fp.Write(edit.encode()[:20])
+	fp.Close()
+	m, err = loadMetadata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(m.Levels, m.NextIndex); got != want {
+		t.Fatalf("expected %s to be replayed but got %s", want, got)
+	}
+	m.close()
+}
+
+func TestManifestCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	m, err := loadMetadata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		edit := &versionEdit{}
+		edit.add(0, tableMetadata{Index: m.nextFileID(), MinRange: 1, MaxRange: 9})
+		if err = m.apply(edit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.close()
+	manifest := filepath.Join(dir, manifestName)
+	content, _ := ioutil.ReadFile(manifest)
+	// both edits add a single table, so their records are as long
+	record := len((&versionEdit{adds: make([]levelTable, 1)}).encode())
+	last := len(content) - record
+
+	// the last record is cut short by a crash, it's torn
+	for _, size := range []int{4, 8 + 10, record - 1} {
+		ioutil.WriteFile(manifest, content[:last+size], 0666)
+		m, err = loadMetadata(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Levels[0]) != 1 {
+			t.Fatalf("expected the edits in front of the torn one to be replayed but got %v", m.Levels)
+		}
+		m.close()
+	}
+
+	// a record which ends within the log isn't torn, nor one whose length is off, the manifest isn't trusted
+	for _, offset := range []int{last + 8, last - record + 8, last - record + 7, last + 7} {
+		corrupt := append([]byte{}, content...)
+		corrupt[offset] ^= 0xff
+		ioutil.WriteFile(manifest, corrupt, 0666)
+		if _, err = loadMetadata(dir); err == nil {
+			t.Fatalf("expected the manifest corrupt at %d to be refused", offset)
+		}
+	}
+}
+
+func TestManifestRotation(t *testing.T) {
+	dir := t.TempDir()
+	m, err := loadMetadata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+	manifest := filepath.Join(dir, manifestName)
+	rotated := false
+	for i := 0; i < manifestLimit/32; i++ {
+		edit := &versionEdit{}
+		index := m.nextFileID()
+		edit.add(0, tableMetadata{Index: index, MinRange: 1, MaxRange: 9})
+		if index > 1 {
+			edit.del(0, index-1)
+		}
+		if err = m.apply(edit); err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Stat(manifest)
+		if info.Size() < int64(headerSize+64) {
+			rotated = true
+			break
+		}
+	}
+	if !rotated {
+		t.Fatal("expected the manifest to be rotated")
+	}
+	reloaded, err := loadMetadata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.close()
+	if fmt.Sprint(reloaded.Levels, reloaded.NextIndex) != fmt.Sprint(m.Levels, m.NextIndex) {
+		t.Fatalf("expected %v but got %v", m.Levels, reloaded.Levels)
+	}
+}
+
+func TestManifestSequence(t *testing.T) {
+	edit := &versionEdit{levels: 2, next: 9, sequence: 1 << 40}
+	edit.add(0, tableMetadata{Index: 9, MinRange: 1, MaxRange: 9, Sequence: 4})
+	edit.add(0, tableMetadata{Index: 8, MinRange: 1, MaxRange: 9, Sequence: 6})
+	edit.del(0, 4)
+	decoded, _, err := decodeVersionEdit(edit.encode())
+	if err != nil || fmt.Sprint(decoded.adds) != fmt.Sprint(edit.adds) || decoded.sequence != edit.sequence {
+		t.Fatalf("expected %v to be decoded but got %v %v", edit, decoded, err)
+	}
+	// a record which doesn't end behind the sequence is refused
+	record := edit.encode()
+	record = record[:len(record)-8]
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(record)-8))
+	binary.BigEndian.PutUint32(record[0:4], crc32.Checksum(record[8:], CrcTable))
+	if _, _, err = decodeVersionEdit(record); err == nil {
+		t.Fatal("expected the short record to be refused")
+	}
+}
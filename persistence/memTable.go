@@ -3,9 +3,9 @@ package persistence
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
 	"fmt"
 	"hash/crc32"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
@@ -16,40 +16,111 @@ import (
 
 var CrcTable = crc32.MakeTable(crc32.Castagnoli)
 
+// tombstone is set on the value length of an entry which deletes its key,
+// such an entry has no value and shadows the key in every older table.
+const tombstone uint32 = 1 << 31
+
+// versioned is set on the value length of an entry whose value is followed by its sequence(8).
+// sequences grow with every write, an entry written before there were sequences has sequence 0.
+const versioned uint32 = 1 << 29
+
+// entryFlags are the flags kept on the value length of an entry
+const entryFlags = tombstone | valuePointer | versioned | expiring
+
+// latest is the sequence a read of the newest entries is made at
+const latest = math.MaxUint64
+
 type hashMap struct {
 	buf           []byte
 	currentOffset int
 	minRange      uint32
 	maxRange      uint32
-	concurrentMap map[uint32]uint32
+	concurrentMap memIndex
 	size          int
 	records       uint32
+	segment       uint32 // wal segment which logged this memory table's writes
+	sorted        bool   // keys are kept in order and persisted as a sorted table
+	codec         codec  // compression of the blocks the table is persisted with
+	vlog          *valueLog
+	threshold     int // values larger than threshold are persisted to vlog, 0 keeps every value in the table
+	// older maps the position of an entry to the one of the entry of its key it overwrote,
+	// snapshots are the sequences whose versions are kept when the table is persisted, nil keeps none
+	sequence  uint64 // sequence of the last entry written
+	older     map[uint32]uint32
+	snapshots *snapshotList
 	sync.RWMutex
 }
 
 func newHashMap(size int) *hashMap {
 	return &hashMap{
 		buf:           make([]byte, size),
-		concurrentMap: make(map[uint32]uint32, 0),
+		concurrentMap: newHashIndex(),
+		older:         map[uint32]uint32{},
 		size:          size,
 		RWMutex:       sync.RWMutex{},
 	}
 }
 
+// newSortedHashMap return a memory table which keeps its keys ordered by a skip list
+func newSortedHashMap(size int) *hashMap {
+	h := newHashMap(size)
+	h.concurrentMap = newSkipList()
+	h.sorted = true
+	return h
+}
+
 func (h *hashMap) Set(key, value []byte) {
+	h.put(key, value, 0, 0)
+}
+
+// SetExpiring write value to key which reads as deleted from expires on, unix nanoseconds
+func (h *hashMap) SetExpiring(key, value []byte, expires int64) {
+	h.put(key, value, 0, expires)
+}
+
+// Delete record a tombstone for key
+func (h *hashMap) Delete(key []byte) {
+	h.put(key, nil, tombstone, 0)
+}
+
+func (h *hashMap) put(key, value []byte, flag uint32, expires int64) {
+	h.Lock()
+	defer h.Unlock()
+	h.putLocked(key, value, flag, expires)
+}
+
+// putBatch write every entry of a batch at once, readers see either none or all of them
+func (h *hashMap) putBatch(entries []batchEntry) {
 	h.Lock()
+	defer h.Unlock()
+	for _, e := range entries {
+		if e.deleted {
+			h.putLocked(e.key, nil, tombstone, 0)
+		} else {
+			h.putLocked(e.key, e.value, 0, e.expires)
+		}
+	}
+}
+
+// putLocked append an entry of key with the next sequence, the caller holds the lock.
+// an entry which expires carries expires in front of its sequence, 0 never expires.
+func (h *hashMap) putLocked(key, value []byte, flag uint32, expires int64) {
 	c := crc32.New(CrcTable)
 	_, _ = c.Write(key)
 	hash := c.Sum32()
 	oldOffSet := h.currentOffset
 	keyLength := len(key)
 	valLength := len(value)
+	h.sequence++
+	if expires != 0 {
+		flag |= expiring
+	}
 
 	//first 8 byte uses to store key and value's length
 	binary.BigEndian.PutUint32(h.buf[h.currentOffset:], uint32(keyLength))
 	h.currentOffset += 4
 
-	binary.BigEndian.PutUint32(h.buf[h.currentOffset:], uint32(valLength))
+	binary.BigEndian.PutUint32(h.buf[h.currentOffset:], uint32(valLength)|flag|versioned)
 	h.currentOffset += 4
 
 	//save key
@@ -60,44 +131,119 @@ func (h *hashMap) Set(key, value []byte) {
 	copy(h.buf[h.currentOffset:h.currentOffset+valLength], value)
 	h.currentOffset += valLength
 
+	if expires != 0 {
+		binary.BigEndian.PutUint64(h.buf[h.currentOffset:], uint64(expires))
+		h.currentOffset += expirySize
+	}
+
+	binary.BigEndian.PutUint64(h.buf[h.currentOffset:], h.sequence)
+	h.currentOffset += 8
+
+	// the overwritten entry stays in buf for the snapshots which still see it
+	if older, ok := h.concurrentMap.find(h.buf, hash, key); ok {
+		h.older[uint32(oldOffSet)] = older
+	}
 	//use CRC checksum as key and this map's position as value
-	h.concurrentMap[hash] = uint32(oldOffSet)
-	h.Unlock()
-	h.setRange(hash)
+	h.concurrentMap.put(h.buf, hash, key, uint32(oldOffSet))
+	h.setMinRange(hash)
+	h.setMaxRange(hash)
 	if uint32(h.Len()) != h.records {
 		atomic.AddUint32(&h.records, 1)
 	}
 }
 
 func (h *hashMap) Get(item []byte) ([]byte, bool) {
+	value, deleted, ok := h.lookup(item, latest)
+	return value, ok && !deleted
+}
+
+// lookup return the value of item's newest entry up to sequence,
+// deleted reports the memory table holds a tombstone for item
+func (h *hashMap) lookup(item []byte, sequence uint64) (value []byte, deleted bool, ok bool) {
 	h.RLock()
 	defer h.RUnlock()
 	c := crc32.New(CrcTable)
 	_, _ = c.Write(item)
 	hash := c.Sum32()
-	position, ok := h.concurrentMap[hash]
+	position, ok := h.concurrentMap.find(h.buf, hash, item)
+	if ok {
+		position, ok = h.visible(position, sequence)
+	}
 	if !ok {
-		return nil, false
+		return nil, false, false
+	}
+	_, value, deleted = decodeEntry(h.buf, position)
+	return value, deleted, true
+}
+
+// visible return the position of the newest entry up to sequence among the entry at position
+// and the ones it overwrote, the caller holds the lock
+func (h *hashMap) visible(position uint32, sequence uint64) (uint32, bool) {
+	for sequenceAt(h.buf, position) > sequence {
+		older, ok := h.older[position]
+		if !ok {
+			return 0, false
+		}
+		position = older
 	}
-	keyLength := binary.BigEndian.Uint32(h.buf[position : position+4])
+	return position, true
+}
+
+// decodeEntry return the key and value of the entry starting at position,
+// deleted reports the entry is a tombstone or has expired.
+func decodeEntry(buf []byte, position uint32) (key, value []byte, deleted bool) {
+	keyLength := binary.BigEndian.Uint32(buf[position : position+4])
 	position += 4
-	valLength := binary.BigEndian.Uint32(h.buf[position : position+4])
+	valLength := binary.BigEndian.Uint32(buf[position : position+4])
 	position += 4
+	flags := valLength & entryFlags
+	deleted = flags&tombstone != 0
+	valLength &^= entryFlags
+	key = buf[position : position+keyLength]
+	position += keyLength
+	value = buf[position : position+valLength]
+	if flags&expiring != 0 && !deleted {
+		position += valLength
+		deleted = expired(int64(binary.BigEndian.Uint64(buf[position : position+expirySize])))
+	}
+	return key, value, deleted
+}
 
-	key := h.buf[position : position+keyLength]
-	if bytes.Compare(key, item) != 0 {
-		return nil, false
+// entryAt return the whole entry starting at position, lengths, expiry and sequence included
+func entryAt(buf []byte, position uint32) []byte {
+	keyLength := binary.BigEndian.Uint32(buf[position : position+4])
+	valLength := binary.BigEndian.Uint32(buf[position+4 : position+8])
+	length := 8 + keyLength + valLength&^entryFlags
+	if valLength&expiring != 0 {
+		length += expirySize
 	}
-	position += keyLength
-	end := position + valLength
-	return h.buf[position:end], true
+	if valLength&versioned != 0 {
+		length += 8
+	}
+	return buf[position : position+length]
 }
 
-func (h *hashMap) setRange(r uint32) {
-	h.Lock()
-	defer h.Unlock()
-	h.setMinRange(r)
-	h.setMaxRange(r)
+// entrySequence return the sequence of the whole entry e
+func entrySequence(e []byte) uint64 {
+	if binary.BigEndian.Uint32(e[4:8])&versioned == 0 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(e[len(e)-8:])
+}
+
+// sequenceAt return the sequence of the entry starting at position
+func sequenceAt(buf []byte, position uint32) uint64 {
+	return entrySequence(entryAt(buf, position))
+}
+
+// entryReader decode the entry at position of a memory table or table
+type entryReader func(position uint32) (key, value []byte, deleted bool)
+
+// bufferReader read the entries of an uncompressed buf
+func bufferReader(buf []byte) entryReader {
+	return func(position uint32) ([]byte, []byte, bool) {
+		return decodeEntry(buf, position)
+	}
 }
 
 func (h *hashMap) setMinRange(r uint32) {
@@ -131,7 +277,9 @@ func (h *hashMap) isEnoughSpace(size int) bool {
 }
 
 func (h *hashMap) occupiedSpace() int {
-	return h.size - h.currentOffset
+	h.RLock()
+	defer h.RUnlock()
+	return h.currentOffset
 }
 
 func (h *hashMap) persistence(path string, index uint32) {
@@ -141,61 +289,139 @@ func (h *hashMap) persistence(path string, index uint32) {
 	if err != nil {
 		panic("unable to flushing memory table to disk")
 	}
-	fp, err := os.Create(fmt.Sprintf("%s/%d.fza", filePath, index))
+	// the table is written next to its file and renamed into place once it's synced, as tableWriter does
+	file := fmt.Sprintf("%s/%d.fza", filePath, index)
+	fp, err := os.Create(file + ".tmp")
 	if err != nil {
 		panic(fmt.Sprintf("unable to flush memory table, error: %v", err))
 	}
-	defer fp.Close()
 
 	// traverse every key-value pair and copy its content.
 	// because memory table just append entry's content and change entry's value
 	// if a entry updated frequently that will waste massive buffer.
 	var content bytes.Buffer
 	content.Grow(len(h.buf))
-	// this var use to store the real entry position(origin position - duplicate key caused offset)
-	var entryPosition uint32
-	for hash, position := range h.concurrentMap {
-		entryPosition = uint32(content.Len())
-		// key length
-		content.Write(h.buf[position : position+4])
-		// value length
-		content.Write(h.buf[position+4 : position+8])
-		// key content
-		keyLength := binary.BigEndian.Uint32(h.buf[position : position+4])
-		content.Write(h.buf[position+8 : position+8+keyLength])
-		// value content
-		valLength := binary.BigEndian.Uint32(h.buf[position+4 : position+8])
-		content.Write(h.buf[position+8+keyLength : position+8+keyLength+valLength])
-		h.concurrentMap[hash] = entryPosition
-	}
-
-	_, err = fp.Write(content.Bytes())
+	// the table's index stores the real entry position(origin position - duplicate key caused offset),
+	// memory table keeps its own index because it's still readable until the table is saved.
+	offsets := newHashIndex()
+	// a sorted memory table is walked in key order, so its blocks can be indexed on the way
+	var blocks *blockIndex
+	if h.sorted {
+		blocks = newBlockIndex()
+	}
+	separated := false
+	write := func(hash uint32, position uint32) {
+		offsets.insert(hash, uint32(content.Len()))
+		e := entryAt(h.buf, position)
+		key, value, deleted := decodeEntry(e, 0)
+		if blocks != nil {
+			blocks.add(key, uint32(content.Len()))
+		}
+		if !deleted && h.vlog != nil && h.threshold > 0 && len(value) > h.threshold {
+			// the table keeps a pointer to the value instead
+			expires := entryExpiry(e)
+			pointer, err := h.vlog.append(key, value, expires)
+			if err != nil {
+				logrus.Fatalf("persistence: can't save value to the value log: %v", err)
+			}
+			lengths := make([]byte, 8)
+			binary.BigEndian.PutUint32(lengths[0:4], uint32(len(key)))
+			binary.BigEndian.PutUint32(lengths[4:8], valuePointerSize|valuePointer|versioned|binary.BigEndian.Uint32(e[4:8])&expiring)
+			content.Write(lengths)
+			content.Write(key)
+			content.Write(pointer)
+			// expiry and sequence follow the pointer as they follow the value
+			content.Write(e[8+len(key)+len(value):])
+			separated = true
+			return
+		}
+		// key length, value length with its flags, key, value and sequence are copied as they are
+		content.Write(e)
+	}
+	pinned := h.snapshots.sequences()
+	h.concurrentMap.forEach(func(hash uint32, position uint32) {
+		write(hash, position)
+		// the versions of a key follow its newest entry from the newest to the oldest,
+		// only the ones a live snapshot sees are kept
+		for len(pinned) > 0 {
+			older, ok := h.older[position]
+			if !ok {
+				break
+			}
+			if retained(pinned, sequenceAt(h.buf, position), sequenceAt(h.buf, older)) {
+				write(hash, older)
+			}
+			position = older
+		}
+	})
+	// the table mustn't point to values which aren't on disk yet
+	if separated {
+		err = h.vlog.sync()
+		if err != nil {
+			logrus.Fatalf("persistence: can't sync the value log to disk: %v", err)
+		}
+	}
+
+	// indexes keep the positions of the uncompressed content, the block handles map them to the file
+	data, handles := compressBlocks(content.Bytes(), h.codec)
+	_, err = fp.Write(encodeHeader(tableFile))
+	if err != nil {
+		logrus.Fatalf("persistence: can't save header to disk: %v", err)
+	}
+	_, err = fp.Write(data)
 	if err != nil {
 		logrus.Fatalf("persistence: can't save data to disk: %v", err)
 	}
-	slots := h.Len()
+	slots := offsets.len()
 	fib := make([]byte, 32)
 	fi := &fileInfo{
-		metaOffset: content.Len(),
+		metaOffset: len(data),
 		entries:    slots,
 		minRange:   h.minRange,
 		maxRange:   h.maxRange,
+		codec:      h.codec,
 	}
-	fi.Encode(fib)
 
-	// encode every map to metaBuf
-	metaBuf := new(bytes.Buffer)
-	encoder := gob.NewEncoder(metaBuf)
-	err = encoder.Encode(h.concurrentMap)
+	// the index is laid out to be searched where it's mmapped
+	footer := bytes.NewBuffer(encodeTableIndex(offsets))
+	fi.flags |= binaryIndex
+	if blocks != nil {
+		fi.blockOffset = fi.metaOffset + footer.Len()
+		footer.Write(blocks.encode())
+	}
+	fi.handleOffset = fi.metaOffset + footer.Len()
+	footer.Write(handles.encode())
+	footer.Write(newTableFilter(offsets))
+	fi.flags |= bloomFilter
+	fi.Encode(fib)
+	footer.Write(fib)
+	sealFooter(footer.Bytes())
+	_, err = fp.Write(footer.Bytes())
+	if err != nil {
+		logrus.Fatalf("persistence: can't save index to disk: %v", err)
+	}
+	// wal segment of this memory table will be removed, so the table must be durable
+	err = fp.Sync()
 	if err != nil {
-		panic("unable to encode concurrent map")
+		logrus.Fatalf("persistence: can't sync table to disk: %v", err)
+	}
+	err = fp.Close()
+	if err != nil {
+		logrus.Fatalf("persistence: can't close table: %v", err)
+	}
+	err = os.Rename(file+".tmp", file)
+	if err != nil {
+		logrus.Fatalf("persistence: can't rename table into place: %v", err)
+	}
+	// the directory entry of the table has to survive a crash as well
+	err = syncDir(filePath)
+	if err != nil {
+		logrus.Fatalf("persistence: can't sync the directory of the table: %v", err)
 	}
-	fp.Write(metaBuf.Bytes())
-	fp.Write(fib)
 }
 
 func (h *hashMap) Len() int {
-	return len(h.concurrentMap)
+	return h.concurrentMap.len()
 }
 
 type fileInfo struct {
@@ -203,19 +429,47 @@ type fileInfo struct {
 	entries    int
 	minRange   uint32
 	maxRange   uint32
+	// blockOffset is where the block index of a sorted table starts, 0 means the table isn't sorted
+	blockOffset int
+	// codec is the compression of the data blocks, handleOffset is where their handles start
+	codec        codec
+	handleOffset int
+	// checksum is the CRC of the footer, see sealFooter
+	checksum uint32
+	flags    uint16
 	//filterSize int
 }
 
+// binaryIndex is set in the file info flags of a table whose index is a tableIndex,
+// a legacy table has no flags and a gob encoded index, see Migrate.
+const binaryIndex uint16 = 1
+
+// bloomFilter is set in the file info flags of a table which has a bloom filter behind its block handles
+const bloomFilter uint16 = 2
+
+// the file info is the last 32 bytes of a table: metaOffset(4) + entries(4) + minRange(4) + checksum(4) +
+// maxRange(4) + flags(2) + codec(2) + blockOffset(4) + handleOffset(4). minRange and maxRange stay where
+// a legacy table keeps them, whose file info has 8 byte slots for them and nothing else.
 func (fi *fileInfo) Decode(buf []byte) {
 	fi.metaOffset = int(binary.BigEndian.Uint32(buf[0:4]))
 	fi.entries = int(binary.BigEndian.Uint32(buf[4:8]))
-	fi.minRange = binary.BigEndian.Uint32(buf[8:16])
-	fi.maxRange = binary.BigEndian.Uint32(buf[16:24])
+	fi.minRange = binary.BigEndian.Uint32(buf[8:12])
+	fi.checksum = binary.BigEndian.Uint32(buf[12:16])
+	fi.maxRange = binary.BigEndian.Uint32(buf[16:20])
+	fi.flags = binary.BigEndian.Uint16(buf[20:22])
+	fi.codec = codec(binary.BigEndian.Uint16(buf[22:24]))
+	fi.blockOffset = int(binary.BigEndian.Uint32(buf[24:28]))
+	fi.handleOffset = int(binary.BigEndian.Uint32(buf[28:32]))
 }
 
 func (fi *fileInfo) Encode(buf []byte) {
 	binary.BigEndian.PutUint32(buf[0:4], uint32(fi.metaOffset))
 	binary.BigEndian.PutUint32(buf[4:8], uint32(fi.entries))
-	binary.BigEndian.PutUint32(buf[8:16], fi.minRange)
-	binary.BigEndian.PutUint32(buf[16:24], fi.maxRange)
+	binary.BigEndian.PutUint32(buf[8:12], fi.minRange)
+	binary.BigEndian.PutUint32(buf[12:16], fi.checksum)
+	binary.BigEndian.PutUint32(buf[16:20], fi.maxRange)
+	binary.BigEndian.PutUint16(buf[20:22], fi.flags)
+	binary.BigEndian.PutUint16(buf[22:24], uint16(fi.codec))
+	binary.BigEndian.PutUint32(buf[24:28], uint32(fi.blockOffset))
+	binary.BigEndian.PutUint32(buf[28:32], uint32(fi.handleOffset))
 }
@@ -3,9 +3,12 @@ package persistence
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
 )
 
 func TestGetSet(t *testing.T) {
@@ -63,5 +66,199 @@ func TestSaveFile(t *testing.T) {
 	if _, err := os.Stat(fmt.Sprintf("%s/%d.fza", filePath, 1)); os.IsNotExist(err) {
 		panic("file not exist")
 	}
+	// the table is renamed into place once it's written
+	if _, err := os.Stat(fmt.Sprintf("%s/%d.fza.tmp", filePath, 1)); !os.IsNotExist(err) {
+		t.Fatal("expected the temporary table to be renamed")
+	}
 	os.Remove(fmt.Sprintf("%s/%d.fza", filePath, 1))
 }
+
+func TestDelete(t *testing.T) {
+	hashMap := newHashMap(1024)
+	hashMap.Set([]byte("Phenom"), []byte("Xonlab"))
+	hashMap.Delete([]byte("Phenom"))
+	if _, exist := hashMap.Get([]byte("Phenom")); exist {
+		t.Fatal("deleted key is still in the hashmap")
+	}
+	if _, deleted, ok := hashMap.lookup([]byte("Phenom"), latest); !ok || !deleted {
+		t.Fatal("expected a tombstone for the deleted key")
+	}
+	hashMap.persistence("./", 1)
+	tb := readTable("./", 1)
+	defer removeTestTable(1)
+	if _, deleted, ok, _ := searchKey(tb, []byte("Phenom"), latest); !ok || !deleted {
+		t.Fatal("expected the tombstone to be persisted")
+	}
+}
+
+// "key 1371838" and "key 2000402" have the same checksum
+func TestChecksumCollision(t *testing.T) {
+	hashMap := newHashMap(1024)
+	hashMap.Set([]byte("key 1371838"), []byte("Phenom"))
+	hashMap.Set([]byte("key 2000402"), []byte("Xonlab"))
+	hashMap.Set([]byte("key 1371838"), []byte("Frozra"))
+	if hashMap.Len() != 2 {
+		t.Fatalf("expected 2 entries but got %d", hashMap.Len())
+	}
+	hashMap.persistence("./", 1)
+	tb := readTable("./", 1)
+	defer removeTestTable(1)
+	// memory table must stay readable after it's persisted
+	if v, _ := hashMap.Get([]byte("key 1371838")); !bytes.Equal(v, []byte("Frozra")) {
+		t.Fatalf("expected value Frozra but got %s", v)
+	}
+	if v, _ := hashMap.Get([]byte("key 2000402")); !bytes.Equal(v, []byte("Xonlab")) {
+		t.Fatalf("expected value Xonlab but got %s", v)
+	}
+	if v, _, _, _ := searchKey(tb, []byte("key 1371838"), latest); !bytes.Equal(v, []byte("Frozra")) {
+		t.Fatalf("expected value Frozra but got %s", v)
+	}
+	if v, _, _, _ := searchKey(tb, []byte("key 2000402"), latest); !bytes.Equal(v, []byte("Xonlab")) {
+		t.Fatalf("expected value Xonlab but got %s", v)
+	}
+}
+
+func TestHashIndexLen(t *testing.T) {
+	idx := newHashIndex()
+	idx.insert(7, 0)
+	idx.insert(7, 10)
+	idx.insert(9, 20)
+	// a position which isn't indexed leaves the count alone
+	idx.remove(7, 30)
+	idx.remove(7, 0)
+	if idx.len() != 2 || idx.Slots[7] != 10 {
+		t.Fatalf("expected 2 entries with 10 in the slot but got %d %v", idx.len(), idx.Slots)
+	}
+	idx.remove(9, 20)
+	idx.remove(7, 10)
+	if idx.len() != 0 || len(idx.Slots) != 0 || len(idx.Overflow) != 0 {
+		t.Fatalf("expected an empty index but got %d %v %v", idx.len(), idx.Slots, idx.Overflow)
+	}
+}
+
+func TestSortedTable(t *testing.T) {
+	hashMap := newSortedHashMap(1 << 20)
+	for i := 999; i >= 0; i-- {
+		hashMap.Set([]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	hashMap.Set([]byte("key 500"), []byte("Phenom"))
+	hashMap.persistence("./", 1)
+	tb := readTable("./", 1)
+	defer removeTestTable(1)
+	if tb.blocks == nil || len(tb.blocks.keys) < 2 {
+		t.Fatal("expected a block index for the sorted table")
+	}
+	// entries are laid out in key order
+	position, i := uint32(0), 0
+	for ; position < uint32(len(tb.data)); i++ {
+		key, _, _ := decodeEntry(tb.data, position)
+		if !bytes.Equal(key, []byte(fmt.Sprintf("key %03d", i))) {
+			t.Fatalf("expected key %03d but got %s", i, key)
+		}
+		position += uint32(len(entryAt(tb.data, position)))
+	}
+	if i != 1000 {
+		t.Fatalf("expected 1000 entries but got %d", i)
+	}
+	if v, _, _, _ := searchKey(tb, []byte("key 500"), latest); !bytes.Equal(v, []byte("Phenom")) {
+		t.Fatalf("expected value Phenom but got %s", v)
+	}
+}
+
+func TestCompressedTable(t *testing.T) {
+	hashMap := newSortedHashMap(1 << 20)
+	hashMap.codec = snappyCompression
+	for i := 0; i < 1000; i++ {
+		hashMap.Set([]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf(`{"id":%d,"name":"phenom","tags":["frozra","cache"]}`, i)))
+	}
+	hashMap.Delete([]byte("key 500"))
+	hashMap.persistence("./", 1)
+	tb := readTable("./", 1)
+	defer removeTestTable(1)
+	if tb.handles == nil || len(tb.handles.handles) < 2 {
+		t.Fatal("expected the table to be cut into compressed blocks")
+	}
+	if uint32(len(tb.data)) >= tb.length() {
+		t.Fatalf("expected %d bytes to be compressed but got %d", tb.length(), len(tb.data))
+	}
+	if v, _, _, _ := searchKey(tb, []byte("key 999"), latest); !bytes.Equal(v, []byte(`{"id":999,"name":"phenom","tags":["frozra","cache"]}`)) {
+		t.Fatalf("unexpected value %s", v)
+	}
+	if _, deleted, ok, _ := searchKey(tb, []byte("key 500"), latest); !ok || !deleted {
+		t.Fatal("expected the tombstone of key 500")
+	}
+	// the entries are read across the blocks in the order they are saved
+	r := tb.reader()
+	records := 0
+	for position := uint32(0); position < tb.length(); records++ {
+		e := r.record(position)
+		if key, _, _ := decodeEntry(e, 0); records == 0 && !bytes.Equal(key, []byte("key 000")) {
+			t.Fatalf("expected key 000 first but got %s", key)
+		}
+		position += uint32(len(e))
+	}
+	if err := tb.corruption(); err != nil {
+		t.Fatal(err)
+	}
+	if records != 1000 {
+		t.Fatalf("expected 1000 records but got %d", records)
+	}
+}
+
+// the tables of testdata/baseline were written by the release before tables had a format header,
+// every key "key i" of them holds "value i"
+func TestLegacyHashIndex(t *testing.T) {
+	tables, _ := filepath.Glob("testdata/baseline/*.fza")
+	found := 0
+	for _, file := range tables {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi := &fileInfo{}
+		fi.Decode(content[len(content)-32:])
+		idx, err := decodeHashIndex(content[fi.metaOffset : len(content)-32])
+		if err != nil {
+			t.Fatalf("expected the index of %s to be decoded but got error %s", file, err.Error())
+		}
+		if idx.len() != fi.entries {
+			t.Fatalf("expected %d entries in %s but got %d", fi.entries, file, idx.len())
+		}
+		data := content[:fi.metaOffset]
+		for i := 0; i < 700; i++ {
+			key := []byte(fmt.Sprintf("key %d", i))
+			position, ok := idx.find(data, util.Hashing(key), key)
+			if !ok {
+				continue
+			}
+			if _, v, _ := decodeEntry(data, position); !bytes.Equal(v, []byte(fmt.Sprintf("value %d", i))) {
+				t.Fatalf("expected value %d but got %s", i, v)
+			}
+			found++
+		}
+	}
+	if found != 700 {
+		t.Fatalf("expected 700 keys in the tables but got %d", found)
+	}
+}
+
+func TestFileInfoRoundTrip(t *testing.T) {
+	fi := fileInfo{
+		metaOffset:   0x7fffffff,
+		entries:      0x7ffffffe,
+		minRange:     0xfffffffe,
+		maxRange:     0xffffffff,
+		blockOffset:  0x7ffffffd,
+		codec:        snappyCompression,
+		handleOffset: 0x7ffffffc,
+		checksum:     0xfffffffd,
+		flags:        binaryIndex | bloomFilter,
+	}
+	buf := make([]byte, 32)
+	fi.Encode(buf)
+	decoded := fileInfo{}
+	decoded.Decode(buf)
+	if decoded != fi {
+		t.Fatalf("expected %+v but got %+v", fi, decoded)
+	}
+}
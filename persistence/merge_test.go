@@ -2,8 +2,12 @@ package persistence
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
 )
 
 func testTable(key, value string, begin, end int, idx uint32) *table {
@@ -17,41 +21,114 @@ func testTable(key, value string, begin, end int, idx uint32) *table {
 	return readTable("./", idx)
 }
 
-func testValueExist(key, value string, tb *table, begin, end int, t *testing.T) {
-	for ; begin < end; begin++ {
-		//key := []byte(fmt.Sprintf("%s%d", key, begin))
-		//value := []byte(fmt.Sprintf("%s%d", value, begin))
-		//inv, exist := tb.Get(key)
-		//if !exist {
-		//	t.Fatalf("%s value not found", string(value))
-		//}
-		//if bytes.Compare(value, inv) != 0 {
-		//	t.Fatalf("expected value %s but got %s", string(value), string(inv))
-		//}
+// streamTables persist mems as tables of a new node, the newest first, and stream them into level,
+// the tables written are returned. a shadowed merge has a table below level covering every checksum.
+func streamTables(t *testing.T, level int, shadowed bool, mems ...*hashMap) (*Lsm, []*table) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := make([]*table, 0, len(mems))
+	for _, mem := range mems {
+		index := l.metadata.nextFileID()
+		mem.persistence(l.absPath, index)
+		tables = append(tables, readTable(l.absPath, index))
+	}
+	if shadowed {
+		deeper := &versionEdit{}
+		deeper.add(level+1, tableMetadata{Index: l.metadata.nextFileID(), MaxRange: math.MaxUint32})
+		l.commit(deeper)
+	}
+	edit := &versionEdit{}
+	l.compactMutex.Lock()
+	err = l.stream(level, tables, 0, edit)
+	l.compactMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tb := range tables {
+		tb.close()
+		tb.release()
+	}
+	written := make([]*table, 0, len(edit.adds))
+	for _, add := range edit.adds {
+		written = append(written, readTable(l.absPath, add.file.Index))
+	}
+	return l, written
+}
+
+func TestStreamTombstones(t *testing.T) {
+	mem := func() *hashMap {
+		mem := newHashMap(64 << 20)
+		for i := 0; i < 100; i++ {
+			mem.Set([]byte(fmt.Sprintf("phenom%d", i)), []byte(fmt.Sprintf("froza%d", i)))
+		}
+		for i := 0; i < 50; i++ {
+			mem.Delete([]byte(fmt.Sprintf("phenom%d", i)))
+		}
+		return mem
+	}
+	// nothing is left below for the tombstones to hide
+	l, written := streamTables(t, 1, false, mem())
+	if len(written) != 1 || written[0].offsetMap.len() != 50 {
+		t.Fatalf("expected 50 entries but got %d", written[0].offsetMap.len())
+	}
+	l.Close()
+	// a tombstone shadowing a deeper table still hides an older value, so it must be kept
+	l, written = streamTables(t, 1, true, mem())
+	defer l.Close()
+	if len(written) != 1 || written[0].offsetMap.len() != 100 {
+		t.Fatalf("expected 100 entries but got %d", written[0].offsetMap.len())
+	}
+}
+
+func TestStreamChecksumCollision(t *testing.T) {
+	older := newHashMap(1024)
+	older.Set([]byte("key 1371838"), []byte("phenom"))
+	older.Set([]byte("key 1371839"), []byte("phenom"))
+	newer := newHashMap(1024)
+	newer.Set([]byte("key 2000402"), []byte("froza"))
+	newer.Set([]byte("key 1371839"), []byte("froza"))
+	l, written := streamTables(t, 1, false, newer, older)
+	defer l.Close()
+	if len(written) != 1 || written[0].offsetMap.len() != 3 {
+		t.Fatalf("expected 3 entries but got %d", written[0].offsetMap.len())
+	}
+	expected := map[string]string{"key 1371838": "phenom", "key 2000402": "froza", "key 1371839": "froza"}
+	for key, value := range expected {
+		v, _, ok, err := searchKey(written[0], []byte(key), latest)
+		if err != nil || !ok {
+			t.Fatalf("%s is lost after merging %v", key, err)
+		}
+		if string(v) != value {
+			t.Fatalf("expected value %s but got %s", value, v)
+		}
+	}
+}
+
+func TestMergeCursor(t *testing.T) {
+	tb := testTable("phenom", "frozra", 1, 100, 1)
+	defer removeTestTable(1)
+	c := &mergeCursor{t: tb, reader: tb.reader()}
+	records, hash := 0, uint32(0)
+	for c.next() {
+		if c.hash < hash {
+			t.Fatalf("expected ascending checksums but got %d after %d", c.hash, hash)
+		}
+		hash = c.hash
+		_, value, _ := decodeEntry(c.entry, 0)
+		if expected := "frozra" + strings.TrimPrefix(string(c.key), "phenom"); string(value) != expected {
+			t.Fatalf("expected value %s of %s but got %s", expected, c.key, value)
+		}
+		records++
+	}
+	if records != 99 {
+		t.Fatalf("expected 99 records but got %d", records)
 	}
 }
 
 func removeTestTable(idx uint32) {
 	os.Remove(fmt.Sprintf("./%d.fza", idx))
 }
-
-//func TestBuilder(t *testing.T) {
-//	t1 := testTable("hello", "xonlab", 1, 100, 1)
-//	t2 := testTable("hello", "phenom", 101, 200, 2)
-//	builder := newTableMerger(int(t1.size + t2.size))
-//	t1.SeekBegin()
-//	t2.SeekBegin()
-//	builder.append(t1.fp, int64(t1.fileInfo.metaOffset))
-//	builder.append(t2.fp, int64(t2.fileInfo.metaOffset))
-//	builder.merge(t1.offsetMap, 0)
-//	builder.merge(t2.offsetMap, uint32(t1.fileInfo.metaOffset))
-//	buf := builder.setTableInfo()
-//	fp, _ := os.Create("3.fza")
-//	fp.Write(buf)
-//	t3 := readTable("./", 3)
-//	testValueExist("hello", "xonlab", t3, 1, 100, t)
-//	testValueExist("hello", "phenom", t3, 101, 200, t)
-//	removeTestTable(1)
-//	removeTestTable(2)
-//	removeTestTable(3)
-//}
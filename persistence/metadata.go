@@ -1,16 +1,17 @@
 package persistence
 
 import (
-	"encoding/gob"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
 	"path"
-	"sort"
 	"sync"
 	"sync/atomic"
 )
 
+// tableMetadata is a table of a level. Sequence orders the tables by the age of their entries:
+// a flushed table takes its index, which grows with every flush, and a merged table the
+// newest sequence of the tables it's merged from.
 type tableMetadata struct {
 	MaxRange uint32
 	MinRange uint32
@@ -18,159 +19,211 @@ type tableMetadata struct {
 	Size     uint32
 	Records  uint32
 	Density  float32
+	Sequence uint32
 }
 
-type descendingList []tableMetadata
-
-func (t descendingList) Len() int {
-	return len(t)
-}
-
-func (t descendingList) Swap(i, j int) {
-	t[i], t[j] = t[j], t[i]
-}
-
-func (t descendingList) Less(i, j int) bool {
-	return t[i].Density > t[j].Density
+// newer report whether the table of sequence and index holds newer entries than the one of
+// other and otherIndex, tables of one sequence are ordered by index.
+func newer(sequence, index, other, otherIndex uint32) bool {
+	if sequence != other {
+		return sequence > other
+	}
+	return index > otherIndex
 }
 
+// metadata keeps the tables of every level, Levels[0] is level 0. every change to it is logged to the manifest.
 type metadata struct {
-	L0Files   []tableMetadata
-	L1Files   []tableMetadata
-	NextIndex uint32
-	mutex     sync.RWMutex
-}
+	Levels       [][]tableMetadata
+	NextIndex    uint32
+	LastSequence uint64 // sequence of the newest entry in the tables
+	absPath      string
+	manifest     *os.File
+	manifestSize int
+	mutex        sync.RWMutex
+}
+
+// legacyMetadataName is the file the release before the format header saved the metadata to as a whole,
+// legacyFilterName the one it saved the bloom filters of the l0 tables to. Migrate replaces both.
+const (
+	legacyMetadataName = "metadata"
+	legacyFilterName   = "filter"
+)
 
 func loadMetadata(absPath string) (*metadata, error) {
-	metadataName := path.Join(absPath, "metadata")
-	_, err := os.Stat(metadataName)
-	if err != nil {
-		if !os.IsExist(err) {
-			return createMetadata(metadataName)
-		} else {
-			panic(fmt.Sprintf("check metadata error: %v", err))
+	m := &metadata{absPath: absPath}
+	content, err := ioutil.ReadFile(path.Join(absPath, manifestName))
+	switch {
+	case err == nil:
+		err = m.replay(content)
+	case os.IsNotExist(err):
+		// a new data directory, unless the metadata of its tables is lost
+		var tables []uint32
+		tables, err = listTables(absPath)
+		if err == nil && len(tables) > 0 {
+			err = fmt.Errorf("metadata: %d tables are found without a manifest, rebuild it with Recover", len(tables))
 		}
 	}
-
-	fp, err := os.Open(metadataName)
 	if err != nil {
-		panic(fmt.Sprintf("load metadata error: %v", err))
-	}
-	m := &metadata{}
-	decoder := gob.NewDecoder(fp)
-	err = decoder.Decode(m)
-	if err != nil && err != io.EOF {
 		return nil, err
 	}
-	return m, nil
-}
-
-func createMetadata(metadataName string) (*metadata, error) {
-	fp, err := os.Create(metadataName)
+	for len(m.Levels) < 2 {
+		m.Levels = append(m.Levels, make([]tableMetadata, 0))
+	}
+	// the manifest starts over from what's been loaded, a torn tail is left behind
+	err = m.rotate()
 	if err != nil {
-		panic(fmt.Sprintf("create metadata error: %v", err))
+		return nil, err
 	}
-	fp.Close()
-	return &metadata{
-		L0Files:   make([]tableMetadata, 0),
-		L1Files:   make([]tableMetadata, 0),
-		NextIndex: 0,
-	}, nil
+	return m, nil
 }
 
 func (m *metadata) nextFileID() uint32 {
-	atomic.AddUint32(&m.NextIndex, 1)
-	return m.NextIndex
-}
-
-func (m *metadata) save(absPath string) error {
-	metadataName := path.Join(absPath, "metadata")
-	fp, err := os.OpenFile(metadataName, os.O_WRONLY, 0666)
-	if err != nil {
-		return err
-	}
-	defer fp.Close()
-	encoder := gob.NewEncoder(fp)
-	return encoder.Encode(m)
-
+	return atomic.AddUint32(&m.NextIndex, 1)
 }
 
-func (m *metadata) addL0File(records, minRange, maxRange uint32, size int, index uint32) {
+// close close the manifest
+func (m *metadata) close() error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	m.L0Files = append(m.L0Files, tableMetadata{
-		Records:  records,
-		MinRange: minRange,
-		MaxRange: maxRange,
-		Size:     uint32(size),
-		Density:  float32(records) / float32(maxRange-minRange),
-		Index:    index,
-	})
+	return m.manifest.Close()
 }
 
-func (m *metadata) addL1File(records, minRange, maxRange uint32, size int, index uint32) {
+// grow make sure metadata has at least levels levels
+func (m *metadata) grow(levels int) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	m.L1Files = append(m.L1Files, tableMetadata{
-		Records:  records,
-		MinRange: minRange,
-		MaxRange: maxRange,
-		Size:     uint32(size),
-		Density:  float32(records) / float32(maxRange-minRange),
-		Index:    index,
-	})
+	for len(m.Levels) < levels {
+		m.Levels = append(m.Levels, make([]tableMetadata, 0))
+	}
 }
 
-func (m *metadata) delL0File(index uint32) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	for i := 0; i < len(m.L0Files); i++ {
-		if m.L0Files[i].Index == index {
-			m.L0Files[i] = m.L0Files[len(m.L0Files)-1]
-			m.L0Files = m.L0Files[:len(m.L0Files)-1]
+// addFile add file to level, the caller holds the mutex
+func (m *metadata) addFile(level int, file tableMetadata) {
+	file.Density = float32(file.Records) / float32(file.MaxRange-file.MinRange)
+	m.Levels[level] = append(m.Levels[level], file)
+}
+
+// delFile remove table index from level, the caller holds the mutex
+func (m *metadata) delFile(level int, index uint32) {
+	files := m.Levels[level]
+	for i := 0; i < len(files); i++ {
+		if files[i].Index == index {
+			files[i] = files[len(files)-1]
+			m.Levels[level] = files[:len(files)-1]
 			break
 		}
 	}
 }
 
-func (m *metadata) delL1File(index uint32) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	for i := 0; i < len(m.L1Files); i++ {
-		if m.L1Files[i].Index == index {
-			m.L1Files[i] = m.L1Files[len(m.L1Files)-1]
-			m.L1Files = m.L1Files[:len(m.L1Files)-1]
-			break
+// file return the metadata of table index, false if it's not a table of level anymore
+func (m *metadata) file(level int, index uint32) (tableMetadata, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, f := range m.Levels[level] {
+		if f.Index == index {
+			return f, true
 		}
 	}
+	return tableMetadata{}, false
 }
 
-func (m *metadata) l0Len() int {
+// levelOf return the level table index belongs to, false if it's not a table of any level
+func (m *metadata) levelOf(index uint32) (int, bool) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	return len(m.L0Files)
+	for level, files := range m.Levels {
+		for _, f := range files {
+			if f.Index == index {
+				return level, true
+			}
+		}
+	}
+	return 0, false
 }
 
-func (m *metadata) l1Len() int {
+// newest return the newest sequence of the tables indexes, a table which isn't part of any level counts as its index
+func (m *metadata) newest(indexes ...uint32) uint32 {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	return len(m.L1Files)
+	sequence := uint32(0)
+	for _, index := range indexes {
+		found := index
+	levels:
+		for _, files := range m.Levels {
+			for _, f := range files {
+				if f.Index == index {
+					found = f.Sequence
+					break levels
+				}
+			}
+		}
+		if found > sequence {
+			sequence = found
+		}
+	}
+	return sequence
 }
 
-func (m *metadata) sortL0() {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	sort.Sort(descendingList(m.L0Files))
+func (m *metadata) levelLen(level int) int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.Levels[level])
 }
 
-func (m *metadata) copyL0() []tableMetadata {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	return m.L0Files
+// levelSize return the total size of level's tables
+func (m *metadata) levelSize(level int) uint64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	size := uint64(0)
+	for _, f := range m.Levels[level] {
+		size += uint64(f.Size)
+	}
+	return size
+}
+
+// totalSize return the total size of the tables of every level
+func (m *metadata) totalSize() uint64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	size := uint64(0)
+	for _, files := range m.Levels {
+		for _, f := range files {
+			size += uint64(f.Size)
+		}
+	}
+	return size
+}
+
+// overlaps report whether a table at level or any deeper level overlaps the checksums [min, max]
+func (m *metadata) overlaps(level int, min, max uint32) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for ; level < len(m.Levels); level++ {
+		for _, f := range m.Levels[level] {
+			if f.MinRange <= max && min <= f.MaxRange {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mayContain report whether a table at level or any deeper level covers hash
+func (m *metadata) mayContain(level int, hash uint32) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for ; level < len(m.Levels); level++ {
+		for _, f := range m.Levels[level] {
+			if f.MinRange <= hash && hash <= f.MaxRange {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (m *metadata) copyL1() []tableMetadata {
+func (m *metadata) copyLevel(level int) []tableMetadata {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	return m.L1Files
+	return append([]tableMetadata{}, m.Levels[level]...)
 }
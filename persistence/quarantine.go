@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	"os"
+	"path"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+// quarantineDir keep the tables found corrupt for inspection
+const quarantineDir = "quarantine"
+
+// quarantine take a corrupt table out of service while compaction is paused
+func (l *Lsm) quarantine(index uint32, cause error) {
+	l.compactMutex.Lock()
+	defer l.compactMutex.Unlock()
+	l.dropTable(index, cause)
+}
+
+// dropTable remove a table which can't be read from its level and move its file to the quarantine
+// directory, the node keeps serving from the other tables. compaction must be paused by the caller.
+func (l *Lsm) dropTable(index uint32, cause error) {
+	// the table may be quarantined already by another read
+	level, ok := l.metadata.levelOf(index)
+	if !ok {
+		return
+	}
+	logrus.Errorf("quarantine: level %d %d.fza is taken out of service %s", level, index, cause.Error())
+	if level == 0 {
+		l.l0Maintainer.delTable(index)
+	} else {
+		l.levels[level].delTable(index)
+	}
+	edit := &versionEdit{}
+	edit.del(level, index)
+	l.commit(edit)
+	l.tableCache.remove(index)
+	err := quarantineTable(l.absPath, index)
+	if err != nil {
+		logrus.Errorf("quarantine: unable to move %d.fza %s", index, err.Error())
+	}
+}
+
+// dropCorrupt quarantine the table err reports corrupt, the caller goes on without it. any other error,
+// such as running out of file descriptors or memory, says nothing about the tables and they all stay
+// in service, it's returned instead. compaction must be paused by the caller.
+func (l *Lsm) dropCorrupt(err error) error {
+	index, ok := corruptTable(err)
+	if !ok {
+		return err
+	}
+	l.dropTable(index, err)
+	return nil
+}
+
+// quarantineTable move table index into the quarantine directory of absPath
+func quarantineTable(absPath string, index uint32) error {
+	dir := path.Join(absPath, quarantineDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(util.TablePath(absPath, index), util.TablePath(dir, index))
+}
@@ -0,0 +1,239 @@
+package persistence
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+// Recovery report what Recover did to a data directory
+type Recovery struct {
+	Tables      int      // tables the recovered metadata holds
+	Rebuilt     bool     // the manifest couldn't be trusted, the levels were laid out from the tables
+	Removed     []string // orphaned and partially written files which were deleted
+	Quarantined []string // tables of the manifest which turned out corrupt
+}
+
+// Recover rebuild the metadata of the data directory at dir from its tables,
+// the node must not be running meanwhile and the directory must be migrated to FormatVersion first.
+//
+// a manifest which can be read is trusted up to a record torn by a crash, the tables it doesn't refer to
+// are left behind by a crash around a flush or a compaction and they are deleted, a flushed table's entries
+// are still in the wal. without a manifest every table is read from its footer and
+// the levels are laid out from their ranges: a table overlapping another one goes to level 0 where
+// compaction merges them, the others can't shadow anything and go to level 1.
+// a table whose footer can't be read was written partially and is deleted, unless the manifest refers
+// to it, then it's corrupt and quarantined. wal segments are kept, they're replayed when the node starts.
+func Recover(dir string) (*Recovery, error) {
+	absPath, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recovery{Removed: make([]string, 0), Quarantined: make([]string, 0)}
+	// files a crash left behind before they were renamed into place
+	tmps, err := filepath.Glob(path.Join(absPath, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmps {
+		if err = os.Remove(tmp); err != nil {
+			return nil, err
+		}
+		r.Removed = append(r.Removed, filepath.Base(tmp))
+	}
+
+	m := &metadata{absPath: absPath}
+	content, err := ioutil.ReadFile(path.Join(absPath, manifestName))
+	if err == nil {
+		err = m.replay(content)
+	}
+	trusted := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("recovery: the manifest is ignored %s", err.Error())
+	}
+	referenced := make(map[uint32]bool)
+	if trusted {
+		for _, files := range m.Levels {
+			for _, f := range files {
+				referenced[f.Index] = true
+			}
+		}
+	} else {
+		m = &metadata{absPath: absPath}
+	}
+
+	indexes, err := listTables(absPath)
+	if err != nil {
+		return nil, err
+	}
+	readable := make(map[uint32]bool)
+	files := make([]tableMetadata, 0, len(indexes))
+	newest := uint64(0)
+	sequences := make(map[uint32]uint64)
+	for _, index := range indexes {
+		if index > m.NextIndex {
+			m.NextIndex = index
+		}
+		name := filepath.Base(util.TablePath(absPath, index))
+		version, ok, err := fileVersion(util.TablePath(absPath, index), tableFile)
+		if err != nil {
+			return nil, err
+		}
+		// a table is written behind its header, only a directory of an older release lacks them
+		if ok && version != FormatVersion {
+			return nil, &formatError{name: name, version: version}
+		}
+		t, err := openTable(absPath, index)
+		sequence := uint64(0)
+		if err == nil {
+			sequence = newestEntry(t)
+			err = t.corruption()
+		}
+		if err != nil && referenced[index] {
+			if t != nil {
+				t.close()
+				t.release()
+			}
+			logrus.Errorf("recovery: %s is quarantined %s", name, err.Error())
+			if err = quarantineTable(absPath, index); err != nil {
+				return nil, err
+			}
+			r.Quarantined = append(r.Quarantined, name)
+			continue
+		}
+		if err != nil || (trusted && !referenced[index]) {
+			if t != nil {
+				t.close()
+				t.release()
+			}
+			if err = os.Remove(util.TablePath(absPath, index)); err != nil {
+				return nil, err
+			}
+			r.Removed = append(r.Removed, name)
+			continue
+		}
+		readable[index] = true
+		sequences[index] = sequence
+		if sequence > newest {
+			newest = sequence
+		}
+		files = append(files, tableMetadata{
+			Records:  uint32(t.fileInfo.entries),
+			MinRange: t.fileInfo.minRange,
+			MaxRange: t.fileInfo.maxRange,
+			Size:     uint32(t.size),
+			Index:    index,
+		})
+		t.close()
+		t.release()
+	}
+
+	if trusted {
+		// a table the manifest refers to may be gone from disk
+		for level := range m.Levels {
+			for _, f := range append([]tableMetadata{}, m.Levels[level]...) {
+				if !readable[f.Index] {
+					logrus.Errorf("recovery: level %d %d.fza is missing", level, f.Index)
+					m.delFile(level, f.Index)
+				}
+			}
+		}
+	} else {
+		orderBySequence(files, sequences)
+		m.Levels = layoutLevels(files)
+		r.Rebuilt = true
+	}
+	// new writes go on behind the newest entry of the tables
+	if newest > m.LastSequence {
+		m.LastSequence = newest
+	}
+	for len(m.Levels) < 2 {
+		m.Levels = append(m.Levels, make([]tableMetadata, 0))
+	}
+	r.Tables = len(files)
+
+	err = m.rotate()
+	if err != nil {
+		return nil, err
+	}
+	err = m.close()
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("recovery: %d tables recovered, %d files removed and %d quarantined", r.Tables, len(r.Removed), len(r.Quarantined))
+	return r, nil
+}
+
+// newestEntry return the largest sequence of the entries of t, 0 if they were written before there were sequences
+func newestEntry(t *table) uint64 {
+	newest := uint64(0)
+	r := t.reader()
+	t.offsetMap.forEach(func(_ uint32, position uint32) {
+		if sequence := entrySequence(r.record(position)); sequence > newest {
+			newest = sequence
+		}
+	})
+	return newest
+}
+
+// orderBySequence sort files from the one holding the oldest entries and give them sequences in that order.
+// a merged table may have a higher index than a newer flush, so the order is taken from the newest entry
+// sequence of every table, tables written before there were sequences fall back to their index.
+func orderBySequence(files []tableMetadata, sequences map[uint32]uint64) {
+	sort.Slice(files, func(i, j int) bool {
+		si, sj := sequences[files[i].Index], sequences[files[j].Index]
+		if si != sj {
+			return si < sj
+		}
+		return files[i].Index < files[j].Index
+	})
+	// the sequences stay below the index of every table flushed from now on
+	for i := range files {
+		files[i].Sequence = uint32(i + 1)
+	}
+}
+
+// listTables return the index of every table in absPath in ascending order
+func listTables(absPath string) ([]uint32, error) {
+	names, err := filepath.Glob(path.Join(absPath, "*.fza"))
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]uint32, 0, len(names))
+	for _, name := range names {
+		index, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".fza"), 10, 32)
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, uint32(index))
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+	return indexes, nil
+}
+
+// layoutLevels put every table overlapping another one at level 0 and the others at level 1.
+// overlapping tables are told apart by their sequences, see orderBySequence, compacting them is left to level 0.
+func layoutLevels(files []tableMetadata) [][]tableMetadata {
+	levels := [][]tableMetadata{make([]tableMetadata, 0), make([]tableMetadata, 0)}
+	for i, f := range files {
+		level := 1
+		for j, other := range files {
+			if i != j && f.MinRange <= other.MaxRange && other.MinRange <= f.MaxRange {
+				level = 0
+				break
+			}
+		}
+		levels[level] = append(levels[level], f)
+	}
+	return levels
+}
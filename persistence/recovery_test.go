@@ -0,0 +1,289 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+func TestRecover(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	dir := setting.Persistence.Path
+	// two l0 tables which overlap each other
+	for _, start := range []int{0, 50} {
+		l, err := New(setting.Persistence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		produceEntry(l, start, start+100)
+		l.Close()
+	}
+	// the manifest is lost, a table and the manifest were being written at the crash
+	os.Remove(filepath.Join(dir, manifestName))
+	ioutil.WriteFile(util.TablePath(dir, 99), append(encodeHeader(tableFile), 0, 0, 0, 3), 0666)
+	ioutil.WriteFile(filepath.Join(dir, manifestName+".tmp"), encodeHeader(manifestFile), 0666)
+	if _, err := New(setting.Persistence); err == nil {
+		t.Fatal("expected tables without a manifest to be refused")
+	}
+
+	r, err := Recover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Rebuilt || r.Tables != 2 || fmt.Sprint(r.Removed) != fmt.Sprint([]string{manifestName + ".tmp", "99.fza"}) {
+		t.Fatalf("unexpected recovery %+v", r)
+	}
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.metadata.levelLen(0) != 2 {
+		t.Fatalf("expected the overlapping tables at level 0 but got %v", l.metadata.Levels)
+	}
+	for i := 0; i <= 150; i++ {
+		val, _ := l.Get([]byte(fmt.Sprintf("key %d", i)))
+		if !bytes.Equal(val, []byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("expected value %d but got %s", i, val)
+		}
+	}
+	l.Close()
+}
+
+func TestRecoverOrphans(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	dir := setting.Persistence.Path
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	produceEntry(l, 0, 100)
+	l.Close()
+	// a table written by a compaction which was never committed
+	tm := l.metadata.copyLevel(0)[0]
+	content, _ := ioutil.ReadFile(util.TablePath(dir, tm.Index))
+	ioutil.WriteFile(util.TablePath(dir, 50), content, 0666)
+
+	r, err := Recover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rebuilt || r.Tables != 1 || fmt.Sprint(r.Removed) != fmt.Sprint([]string{"50.fza"}) {
+		t.Fatalf("unexpected recovery %+v", r)
+	}
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= 100; i++ {
+		val, _ := l.Get([]byte(fmt.Sprintf("key %d", i)))
+		if !bytes.Equal(val, []byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("expected value %d but got %s", i, val)
+		}
+	}
+	l.Close()
+}
+
+// a record torn by a crash at the end of the manifest drops the edit, the levels logged before it are kept
+func TestRecoverTornManifest(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	dir := setting.Persistence.Path
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	produceEntry(l, 0, 100)
+	l.Close()
+	// a newer table overwriting some of the keys
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= 50; i++ {
+		l.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("new %d", i)))
+	}
+	l.Close()
+	levels := fmt.Sprint(l.metadata.Levels)
+	manifest, err := os.OpenFile(filepath.Join(dir, manifestName), os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Write([]byte{0, 0, 0, 40, 1, 2, 3})
+	manifest.Close()
+	// the table of the torn edit
+	tm := l.metadata.copyLevel(0)[0]
+	content, _ := ioutil.ReadFile(util.TablePath(dir, tm.Index))
+	ioutil.WriteFile(util.TablePath(dir, 50), content, 0666)
+
+	r, err := Recover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rebuilt || r.Tables != 2 || fmt.Sprint(r.Removed) != fmt.Sprint([]string{"50.fza"}) {
+		t.Fatalf("unexpected recovery %+v", r)
+	}
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if fmt.Sprint(l.metadata.Levels) != levels {
+		t.Fatalf("expected the levels %s but got %v", levels, l.metadata.Levels)
+	}
+	for i := 0; i <= 100; i++ {
+		expected := fmt.Sprintf("%d", i)
+		if i <= 50 {
+			expected = "new " + expected
+		}
+		val, _ := l.Get([]byte(fmt.Sprintf("key %d", i)))
+		if !bytes.Equal(val, []byte(expected)) {
+			t.Fatalf("expected value %s but got %s", expected, val)
+		}
+	}
+}
+
+// a bad record in the middle of the manifest isn't torn by a crash, the levels are rebuilt and no table is lost
+func TestRecoverCorruptManifest(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	dir := setting.Persistence.Path
+	for _, start := range []int{0, 200} {
+		l, err := New(setting.Persistence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		produceEntry(l, start, start+100)
+		l.Close()
+	}
+	// the snapshot holding the first table is followed by the edit adding the second
+	manifest := filepath.Join(dir, manifestName)
+	content, _ := ioutil.ReadFile(manifest)
+	record := len((&versionEdit{adds: make([]levelTable, 1)}).encode())
+	content[len(content)-2*record+8] ^= 0xff
+	ioutil.WriteFile(manifest, content, 0666)
+	if _, err := New(setting.Persistence); err == nil {
+		t.Fatal("expected the corrupt manifest to be refused")
+	}
+
+	r, err := Recover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Rebuilt || r.Tables != 2 || len(r.Removed) != 0 {
+		t.Fatalf("unexpected recovery %+v", r)
+	}
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, i := range []int{0, 100, 200, 300} {
+		val, _ := l.Get([]byte(fmt.Sprintf("key %d", i)))
+		if !bytes.Equal(val, []byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("expected value %d but got %s", i, val)
+		}
+	}
+}
+
+func TestLayoutLevels(t *testing.T) {
+	levels := layoutLevels([]tableMetadata{
+		{Index: 1, MinRange: 0, MaxRange: 9},
+		{Index: 2, MinRange: 10, MaxRange: 19},
+		{Index: 3, MinRange: 15, MaxRange: 25},
+		{Index: 4, MinRange: 30, MaxRange: 39},
+	})
+	if fmt.Sprint(levels) != fmt.Sprint([][]tableMetadata{
+		{{Index: 2, MinRange: 10, MaxRange: 19}, {Index: 3, MinRange: 15, MaxRange: 25}},
+		{{Index: 1, MinRange: 0, MaxRange: 9}, {Index: 4, MinRange: 30, MaxRange: 39}},
+	}) {
+		t.Fatalf("unexpected layout %v", levels)
+	}
+}
+
+func TestRecoverSequence(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.SortedTable = true
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	produceEntry(l, 0, 50)
+	l.Close()
+	os.Remove(filepath.Join(setting.Persistence.Path, manifestName))
+	if _, err = Recover(setting.Persistence.Path); err != nil {
+		t.Fatal(err)
+	}
+	// writes after the rebuild go on behind the entries of the tables
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.sequence < 51 {
+		t.Fatalf("expected the sequence to go on from 51 but got %d", l.sequence)
+	}
+	s := l.NewSnapshot()
+	defer s.Release()
+	l.Set([]byte("key 3"), []byte("phenom"))
+	l.Set([]byte("key 51"), []byte("51"))
+	if val, ok := s.Get([]byte("key 3")); !ok || !bytes.Equal(val, []byte("3")) {
+		t.Fatalf("expected the snapshot to see value 3 but got %q", val)
+	}
+	if val, _ := l.Get([]byte("key 3")); !bytes.Equal(val, []byte("phenom")) {
+		t.Fatalf("expected value phenom but got %q", val)
+	}
+	count := func(it *Iterator) int {
+		defer it.Close()
+		n := 0
+		for it.Next() {
+			n++
+		}
+		return n
+	}
+	if n := count(l.NewIterator()); n != 52 {
+		t.Fatalf("expected 52 keys but got %d", n)
+	}
+	if n := count(s.NewIterator()); n != 51 {
+		t.Fatalf("expected the snapshot to see 51 keys but got %d", n)
+	}
+}
+
+func TestRecoverOrder(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	dir := setting.Persistence.Path
+	for _, value := range []string{"old", "new"} {
+		l, err := New(setting.Persistence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		produceEntry(l, 0, 10)
+		l.Set([]byte("phenom"), []byte(value))
+		l.Close()
+	}
+	// the older entries end up in the table of the higher index, as a merged table may
+	os.Rename(util.TablePath(dir, 1), util.TablePath(dir, 3))
+	os.Rename(util.TablePath(dir, 2), util.TablePath(dir, 1))
+	os.Rename(util.TablePath(dir, 3), util.TablePath(dir, 2))
+	os.Remove(filepath.Join(dir, manifestName))
+	if _, err := Recover(dir); err != nil {
+		t.Fatal(err)
+	}
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if val, _ := l.Get([]byte("phenom")); !bytes.Equal(val, []byte("new")) {
+		t.Fatalf("expected the newest value but got %q", val)
+	}
+}
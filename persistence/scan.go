@@ -0,0 +1,361 @@
+package persistence
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// scanCursor walk the entries of one memory table or table in [start, end) in key order.
+// a sorted table is read sequentially from the block its start key falls in,
+// everything else hands over its positions in the range already ordered.
+type scanCursor struct {
+	read      entryReader
+	record    func(position uint32) []byte
+	positions []uint32
+	offset    uint32 // next entry of a sequential read
+	limit     uint32 // end of a sequential read, 0 if positions are used
+	start     []byte
+	end       []byte
+	priority  int // a lower priority is a newer source
+	key       []byte
+	value     []byte
+	deleted   bool
+	pointer   bool // value is a pointer to the value log
+	sequence  uint64
+}
+
+// newMemoryCursor return a cursor of the newest entries of h up to sequence
+func newMemoryCursor(h *hashMap, start, end []byte, sequence uint64, priority int) *scanCursor {
+	h.RLock()
+	defer h.RUnlock()
+	positions := make([]uint32, 0)
+	for _, position := range h.concurrentMap.scan(h.buf, start, end) {
+		if position, ok := h.visible(position, sequence); ok {
+			positions = append(positions, position)
+		}
+	}
+	// memory table only appends to buf, so the entries below these positions stay as they are
+	buf := h.buf
+	return &scanCursor{
+		read:      bufferReader(buf),
+		record:    func(position uint32) []byte { return entryAt(buf, position) },
+		positions: positions,
+		end:       end,
+		priority:  priority,
+	}
+}
+
+func newTableCursor(t *table, start, end []byte, priority int) *scanCursor {
+	r := t.reader()
+	if t.blocks == nil {
+		return &scanCursor{
+			read:      r.entry,
+			record:    r.record,
+			positions: t.offsetMap.scanEntries(start, end, r.entry),
+			end:       end,
+			priority:  priority,
+		}
+	}
+	return &scanCursor{
+		read:     r.entry,
+		record:   r.record,
+		offset:   t.blocks.seek(start),
+		limit:    t.length(),
+		start:    start,
+		end:      end,
+		priority: priority,
+	}
+}
+
+// next move the cursor to its next entry, false means the cursor is exhausted
+func (c *scanCursor) next() bool {
+	if c.limit == 0 {
+		if len(c.positions) == 0 {
+			return false
+		}
+		c.key, c.value, c.deleted = c.read(c.positions[0])
+		e := c.record(c.positions[0])
+		c.pointer, c.sequence = isValuePointer(e), entrySequence(e)
+		c.positions = c.positions[1:]
+		return true
+	}
+	for c.offset < c.limit {
+		c.key, c.value, c.deleted = c.read(c.offset)
+		e := c.record(c.offset)
+		c.pointer, c.sequence = isValuePointer(e), entrySequence(e)
+		c.offset += uint32(len(e))
+		if bytes.Compare(c.key, c.start) < 0 {
+			continue
+		}
+		if c.end != nil && bytes.Compare(c.key, c.end) >= 0 {
+			c.offset = c.limit
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// scanHeap order the cursors by their current key, the newest source comes first on the same key
+type scanHeap []*scanCursor
+
+func (h scanHeap) Len() int {
+	return len(h)
+}
+
+func (h scanHeap) Less(i, j int) bool {
+	if cmp := bytes.Compare(h[i].key, h[j].key); cmp != 0 {
+		return cmp < 0
+	}
+	return h[i].priority < h[j].priority
+}
+
+func (h scanHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *scanHeap) Push(x interface{}) {
+	*h = append(*h, x.(*scanCursor))
+}
+
+func (h *scanHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// Scan call fn for every key in [start, end) in ascending order until fn returns false,
+// a nil end means there is no upper bound. the memory table, swap and every level
+// are merged, the newest entry of a key wins and deleted keys are skipped.
+// key and value are only valid inside fn.
+// tables written out of sorted table mode are scanned too, but every entry of them is checked.
+func (l *Lsm) Scan(start, end []byte, fn func(key, value []byte) bool) {
+	l.scan(start, end, latest, fn)
+}
+
+// scan call fn for the newest entry up to sequence of every key in [start, end), see Scan
+func (l *Lsm) scan(start, end []byte, sequence uint64, fn func(key, value []byte) bool) {
+	it := l.newIterator(start, end, sequence)
+	defer it.Close()
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			return
+		}
+	}
+}
+
+// Iterator walk the newest entry of every key of the node in ascending key order, the memory
+// table, swap and every level are merged and deleted keys are skipped. it reads from a snapshot,
+// writes made after it's created aren't seen. it must be closed once it's done.
+type Iterator struct {
+	lsm      *Lsm
+	snapshot *Snapshot // nil if the iterator doesn't own the snapshot it reads
+	sequence uint64
+	tables   []*table
+	heap     scanHeap
+	last     []byte
+	key      []byte
+	value    []byte
+	closed   bool
+}
+
+// NewIterator return an iterator over every key of the node as it's now, see newIterator
+func (l *Lsm) NewIterator() *Iterator {
+	s := l.NewSnapshot()
+	it := l.newIterator(nil, nil, s.sequence)
+	it.snapshot = s
+	return it
+}
+
+// NewIterator return an iterator over every key as it was when the snapshot was taken,
+// the snapshot must not be released before the iterator is closed. see Lsm.NewIterator
+func (s *Snapshot) NewIterator() *Iterator {
+	return s.lsm.newIterator(nil, nil, s.sequence)
+}
+
+// newIterator return an iterator over the newest entry up to sequence of every key in [start, end).
+// a sorted table is read as the iterator goes, but the keys of a table which isn't sorted, such as
+// every table out of sorted table mode, are read and ordered before the first key.
+func (l *Lsm) newIterator(start, end []byte, sequence uint64) *Iterator {
+	// memory tables go first, one flushed meanwhile is found in level 0 then
+	l.RLock()
+	memoryTable, immutables := l.memoryTable, l.immutables
+	l.RUnlock()
+	cursors := []*scanCursor{newMemoryCursor(memoryTable, start, end, sequence, 0)}
+	for i := len(immutables) - 1; i >= 0; i-- {
+		cursors = append(cursors, newMemoryCursor(immutables[i], start, end, sequence, len(cursors)))
+	}
+	tables := l.snapshotTables()
+	for i, t := range tables {
+		cursors = append(cursors, newTableCursor(t, start, end, i+len(immutables)+1))
+	}
+
+	h := make(scanHeap, 0, len(cursors))
+	for _, c := range cursors {
+		if c.next() {
+			h = append(h, c)
+		}
+	}
+	heap.Init(&h)
+	return &Iterator{lsm: l, sequence: sequence, tables: tables, heap: h}
+}
+
+// Next move the iterator to the next key, false means every key has been seen
+func (it *Iterator) Next() bool {
+	if it.closed {
+		return false
+	}
+	// the cursor of the current key is moved only now, its entry is read until then
+	if it.key != nil {
+		it.advance()
+	}
+	for it.heap.Len() > 0 {
+		c := it.heap[0]
+		// older entries of the key just seen are shadowed, newer ones than sequence aren't seen
+		if c.sequence <= it.sequence && (it.last == nil || !bytes.Equal(c.key, it.last)) {
+			it.last = append(it.last[:0], c.key...)
+			if !c.deleted && it.load(c) {
+				return true
+			}
+		}
+		it.advance()
+	}
+	it.key, it.value = nil, nil
+	return false
+}
+
+// advance move the cursor at the top of the heap to its next entry
+func (it *Iterator) advance() {
+	if it.heap[0].next() {
+		heap.Fix(&it.heap, 0)
+	} else {
+		heap.Pop(&it.heap)
+	}
+}
+
+// load take the key and value of the entry c is at, a value kept in the value log is read from there.
+// a value which can't be read is logged and left out of the iteration.
+func (it *Iterator) load(c *scanCursor) bool {
+	it.key, it.value = c.key, c.value
+	if !c.pointer {
+		return true
+	}
+	value, err := it.lsm.vlog.read(c.value)
+	if err != nil {
+		logrus.Errorf("scan: unable to read the value of %q %s", c.key, err.Error())
+		return false
+	}
+	it.value = value
+	return true
+}
+
+// Key return the key the iterator is at, it's only valid until the next call to Next
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value return the value of the key the iterator is at, it's only valid until the next call to Next
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Close release the tables the iterator reads and its snapshot
+func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.key, it.value = nil, nil
+	for _, t := range it.tables {
+		// keys of a corrupt block are missing from this scan, the table is taken out of service
+		if err := t.corruption(); err != nil {
+			logrus.Errorf("scan: unable to read table %s", err.Error())
+			it.lsm.quarantine(t.index, err)
+		}
+		t.decRef()
+	}
+	it.tables, it.heap = nil, nil
+	if it.snapshot != nil {
+		it.snapshot.Release()
+	}
+}
+
+// ScanPrefix call fn for every key starts with prefix in ascending order until fn returns false
+func (l *Lsm) ScanPrefix(prefix []byte, fn func(key, value []byte) bool) {
+	l.Scan(prefix, prefixEnd(prefix), fn)
+}
+
+// prefixEnd return the smallest key greater than every key with prefix,
+// nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// snapshotRetries is how often the tables of a scan are looked up while compaction goes on, see snapshotTables
+const snapshotRetries = 3
+
+// snapshotTables take a reference of every table of level 0 from the newest to the oldest
+// followed by the tables of every deeper level through the table cache. compaction may remove
+// a table before its reference is taken, the snapshot is taken again in that case, as well as
+// once a corrupt table is quarantined. the last try holds off compaction, a table which still
+// can't be read then is logged and left out of the iteration.
+func (l *Lsm) snapshotTables() []*table {
+	for try := 1; try < snapshotRetries; try++ {
+		tables, err := l.referenceTables(false)
+		if err == nil {
+			return tables
+		}
+		if index, ok := corruptTable(err); ok {
+			l.quarantine(index, err)
+		} else {
+			logrus.Debugf("scan: table moved by compaction, take the snapshot again: %v", err)
+		}
+	}
+	l.compactMutex.Lock()
+	defer l.compactMutex.Unlock()
+	tables, _ := l.referenceTables(true)
+	return tables
+}
+
+// referenceTables take a reference of every table of the levels, see snapshotTables.
+// the references taken are released once a table can't be read and its error is returned,
+// unless partial is set, then the table is left out. compaction must be paused by a partial caller.
+func (l *Lsm) referenceTables(partial bool) ([]*table, error) {
+	files := make([]tableMetadata, 0)
+	for level := range l.levels {
+		fs := l.metadata.copyLevel(level)
+		sort.Slice(fs, func(i, j int) bool { return newer(fs[i].Sequence, fs[i].Index, fs[j].Sequence, fs[j].Index) })
+		files = append(files, fs...)
+	}
+	tables := make([]*table, 0, len(files))
+	for _, tm := range files {
+		t, err := l.tableCache.get(tm.Index)
+		if err == nil {
+			tables = append(tables, t)
+			continue
+		}
+		if !partial {
+			for _, t := range tables {
+				t.decRef()
+			}
+			return nil, err
+		}
+		if index, ok := corruptTable(err); ok {
+			l.dropTable(index, err)
+		} else {
+			logrus.Errorf("scan: %d.fza is left out of the scan %s", tm.Index, err.Error())
+		}
+	}
+	return tables, nil
+}
@@ -0,0 +1,116 @@
+package persistence
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+const skipListMaxLevel = 20
+
+// memIndex locate the entries of a memory table by their keys
+type memIndex interface {
+	find(data []byte, hash uint32, key []byte) (uint32, bool)
+	put(data []byte, hash uint32, key []byte, position uint32)
+	forEach(fn func(hash uint32, position uint32))
+	scan(data []byte, start, end []byte) []uint32
+	len() int
+}
+
+type skipNode struct {
+	hash     uint32
+	position uint32
+	next     []*skipNode
+}
+
+// skipList is the ordered index of a memory table in sorted table mode,
+// walking it yields the entries in ascending key order.
+type skipList struct {
+	head   *skipNode
+	level  int
+	length int
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+func nodeKey(data []byte, n *skipNode) []byte {
+	key, _, _ := decodeEntry(data, n.position)
+	return key
+}
+
+// seek return the last node whose key is less than key on every level
+func (s *skipList) seek(data []byte, key []byte) []*skipNode {
+	prev := make([]*skipNode, skipListMaxLevel)
+	n := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && bytes.Compare(nodeKey(data, n.next[i]), key) < 0 {
+			n = n.next[i]
+		}
+		prev[i] = n
+	}
+	return prev
+}
+
+func (s *skipList) find(data []byte, _ uint32, key []byte) (uint32, bool) {
+	n := s.seek(data, key)[0].next[0]
+	if n != nil && bytes.Equal(nodeKey(data, n), key) {
+		return n.position, true
+	}
+	return 0, false
+}
+
+func (s *skipList) put(data []byte, hash uint32, key []byte, position uint32) {
+	prev := s.seek(data, key)
+	if n := prev[0].next[0]; n != nil && bytes.Equal(nodeKey(data, n), key) {
+		n.position = position
+		return
+	}
+	level := randomLevel()
+	for i := s.level; i < level; i++ {
+		prev[i] = s.head
+	}
+	if level > s.level {
+		s.level = level
+	}
+	n := &skipNode{hash: hash, position: position, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+	s.length++
+}
+
+// forEach walk the entries in ascending key order
+func (s *skipList) forEach(fn func(hash uint32, position uint32)) {
+	for n := s.head.next[0]; n != nil; n = n.next[0] {
+		fn(n.hash, n.position)
+	}
+}
+
+// scan return the positions of the keys in [start, end) in ascending key order, a nil end is unbounded
+func (s *skipList) scan(data []byte, start, end []byte) []uint32 {
+	positions := make([]uint32, 0)
+	for n := s.seek(data, start)[0].next[0]; n != nil; n = n.next[0] {
+		if end != nil && bytes.Compare(nodeKey(data, n), end) >= 0 {
+			break
+		}
+		positions = append(positions, n.position)
+	}
+	return positions
+}
+
+func (s *skipList) len() int {
+	return s.length
+}
@@ -0,0 +1,94 @@
+package persistence
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Snapshot is a view of the node at the point in time it's taken, its reads return the same
+// entries however the node is written meanwhile. every write takes the next sequence and a
+// snapshot reads the newest entries up to the last sequence written before it, flushes and
+// compaction keep the older versions of a key as long as a live snapshot sees them.
+type Snapshot struct {
+	lsm      *Lsm
+	sequence uint64
+	released int32
+}
+
+// NewSnapshot return a snapshot of every write applied so far, it must be released once it's
+// no longer read, the versions it sees are kept until then.
+func (l *Lsm) NewSnapshot() *Snapshot {
+	l.snapshots.Lock()
+	defer l.snapshots.Unlock()
+	s := &Snapshot{lsm: l, sequence: atomic.LoadUint64(&l.sequence)}
+	l.snapshots.live[s.sequence]++
+	return s
+}
+
+// Sequence return the sequence of the last write the snapshot sees
+func (s *Snapshot) Sequence() uint64 {
+	return s.sequence
+}
+
+// Get return key's value as it was when the snapshot was taken, see Lsm.Get
+func (s *Snapshot) Get(key []byte) ([]byte, bool) {
+	return s.lsm.get(key, s.sequence)
+}
+
+// Scan call fn for every key in [start, end) as it was when the snapshot was taken, see Lsm.Scan
+func (s *Snapshot) Scan(start, end []byte, fn func(key, value []byte) bool) {
+	s.lsm.scan(start, end, s.sequence, fn)
+}
+
+// Release let compaction drop the versions only the snapshot sees, it's not read afterwards
+func (s *Snapshot) Release() {
+	if !atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		return
+	}
+	l := s.lsm
+	l.snapshots.Lock()
+	defer l.snapshots.Unlock()
+	l.snapshots.live[s.sequence]--
+	if l.snapshots.live[s.sequence] == 0 {
+		delete(l.snapshots.live, s.sequence)
+	}
+}
+
+// snapshotList count the live snapshots of every sequence
+type snapshotList struct {
+	live map[uint64]int
+	sync.Mutex
+}
+
+func newSnapshotList() *snapshotList {
+	return &snapshotList{live: map[uint64]int{}}
+}
+
+// sequences return the sequences of the live snapshots in ascending order
+func (s *snapshotList) sequences() []uint64 {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	pinned := make([]uint64, 0, len(s.live))
+	for sequence := range s.live {
+		pinned = append(pinned, sequence)
+	}
+	sort.Slice(pinned, func(i, j int) bool { return pinned[i] < pinned[j] })
+	return pinned
+}
+
+// retained report whether a snapshot of pinned sees the older of two successive versions of a key,
+// that's when its sequence falls between theirs. the newest version is always kept.
+func retained(pinned []uint64, newer, older uint64) bool {
+	i := sort.Search(len(pinned), func(i int) bool { return pinned[i] >= older })
+	return i < len(pinned) && pinned[i] < newer
+}
+
+// hidden report whether every snapshot of pinned sees a version of sequence or a newer one,
+// then none of them reads an older version of the key.
+func hidden(pinned []uint64, sequence uint64) bool {
+	return len(pinned) == 0 || pinned[0] >= sequence
+}
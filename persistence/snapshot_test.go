@@ -0,0 +1,163 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
+)
+
+func TestSnapshot(t *testing.T) {
+	for _, sorted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sorted=%v", sorted), func(t *testing.T) {
+			testSnapshot(t, sorted)
+		})
+	}
+}
+
+func testSnapshot(t *testing.T, sorted bool) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.SortedTable = sorted
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.L0Capacity = 100
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := func(start, end, version int) {
+		for i := start; i < end; i++ {
+			l.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("%d-%d", i, version)))
+		}
+	}
+	set(0, 100, 1)
+	first := l.NewSnapshot()
+	set(0, 50, 2)
+	for i := 90; i < 100; i++ {
+		l.Delete([]byte(fmt.Sprintf("key %d", i)))
+	}
+	second := l.NewSnapshot()
+	set(0, 10, 3)
+	// version of key i every snapshot sees, 0 is deleted
+	expected := map[*Snapshot]func(i int) int{
+		first: func(i int) int {
+			if i >= 100 {
+				return 0
+			}
+			return 1
+		},
+		second: func(i int) int {
+			switch {
+			case i < 50:
+				return 2
+			case i >= 90:
+				return 0
+			}
+			return 1
+		},
+		nil: func(i int) int {
+			switch {
+			case i < 10:
+				return 3
+			case i < 50:
+				return 2
+			case i >= 90:
+				return 0
+			}
+			return 1
+		},
+	}
+	check := func(stage string) {
+		for s, version := range expected {
+			get, scan := l.Get, l.Scan
+			if s != nil {
+				get, scan = s.Get, s.Scan
+			}
+			live := 0
+			for i := 0; i < 110; i++ {
+				val, ok := get([]byte(fmt.Sprintf("key %d", i)))
+				if v := version(i); ok != (v != 0) || ok && !bytes.Equal(val, []byte(fmt.Sprintf("%d-%d", i, v))) {
+					t.Fatalf("%s: expected version %d of key %d but got %s", stage, v, i, val)
+				}
+				if ok {
+					live++
+				}
+			}
+			scanned := 0
+			scan([]byte("key "), nil, func(key, val []byte) bool {
+				var i, v int
+				fmt.Sscanf(string(val), "%d-%d", &i, &v)
+				if !bytes.Equal(key, []byte(fmt.Sprintf("key %d", i))) || v != version(i) {
+					t.Fatalf("%s: expected version %d of %s to be scanned but got %s", stage, version(i), key, val)
+				}
+				scanned++
+				return true
+			})
+			if scanned != live {
+				t.Fatalf("%s: expected %d keys to be scanned but got %d", stage, live, scanned)
+			}
+		}
+	}
+	check("memory table")
+	l.flush()
+	check("level 0")
+	// the versions the snapshots see survive a merge into level 1
+	l.compactMutex.Lock()
+	l.compact(Compaction{Level: 0, Victims: []uint32{l.metadata.copyLevel(0)[0].Index}, Output: 1})
+	set(100, 110, 1)
+	l.flush()
+	l.compact(Compaction{Level: 0, Victims: []uint32{l.metadata.copyLevel(0)[0].Index}, Output: 1})
+	l.compactMutex.Unlock()
+	expected[nil] = func(i int) int {
+		switch {
+		case i < 10:
+			return 3
+		case i < 50:
+			return 2
+		case i >= 100:
+			return 1
+		case i >= 90:
+			return 0
+		}
+		return 1
+	}
+	check("level 1")
+	records := func() uint32 {
+		total := uint32(0)
+		for _, f := range l.metadata.copyLevel(1) {
+			total += f.Records
+		}
+		return total
+	}
+	if records() <= 110 {
+		t.Fatalf("expected the older versions to be kept but got %d entries", records())
+	}
+
+	// once the snapshots are released a merge keeps the newest entries alone
+	first.Release()
+	second.Release()
+	delete(expected, first)
+	delete(expected, second)
+	l.compactMutex.Lock()
+	set(0, 1, 3)
+	l.flush()
+	l.compact(Compaction{Level: 0, Victims: []uint32{l.metadata.copyLevel(0)[0].Index}, Output: 1})
+	l.compactMutex.Unlock()
+	check("released")
+	if records() != 100 {
+		t.Fatalf("expected 100 live keys but got %d entries", records())
+	}
+	sequence := l.NewSnapshot().Sequence()
+	l.Close()
+
+	// sequences go on after the node is opened again
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if s := l.NewSnapshot(); s.Sequence() != sequence {
+		t.Fatalf("expected sequence %d to be restored but got %d", sequence, s.Sequence())
+	}
+	check("reopened")
+}
@@ -1,12 +1,10 @@
 package persistence
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
-	"io"
+	"hash/crc32"
 	"os"
-	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/sirupsen/logrus"
@@ -22,74 +20,265 @@ type table struct {
 	fp        *os.File
 	dataRef   []byte // file reference provided by mmap
 	status    os.FileInfo
-	offsetMap map[uint32]uint32
+	offsetMap *tableIndex
+	blocks    *blockIndex   // nil unless the table is sorted
+	handles   *blockHandles // nil unless the table is compressed
+	filter    tableFilter   // empty unless the table has a bloom filter
+	err       atomic.Value  // of *corruptionError, set once a corrupt block is read
 	index     uint32
-	sync.RWMutex
+	refs      int32       // references of a cached table, see tableCache
+	cache     *blockCache // blocks of a table read by lookups are cached, nil for any other reader
+	vlog      *valueLog   // resolves the value pointers lookups find, nil for any other reader
 }
 
 // readTable return table's content
 func readTable(path string, index uint32) *table {
+	t, err := openTable(path, index)
+	if err != nil {
+		panic(err.Error())
+	}
+	return t
+}
+
+// openTable mmap the table and decode its indexes, the error is returned
+// instead of panicking because the table may be removed by compaction meanwhile
+// or be corrupt, which is reported by a corruptionError.
+func openTable(path string, index uint32) (*table, error) {
 	path = util.TablePath(path, index)
 	fp, err := os.OpenFile(path, os.O_RDONLY, 0666)
 	if err != nil {
-		panic(fmt.Sprintf("unable to open table file, error: %v", err))
+		return nil, fmt.Errorf("unable to open table file, error: %v", err)
 	}
-	status, err := os.Stat(path)
+	status, err := fp.Stat()
 	if err != nil {
-		panic(fmt.Sprintf("unable to get table file status, error: %v", err))
+		fp.Close()
+		return nil, fmt.Errorf("unable to get table file status, error: %v", err)
 	}
 	dataRef, err := syscall.Mmap(int(fp.Fd()), int64(0), int(status.Size()), syscall.PROT_READ, syscall.MAP_PRIVATE)
 	if err != nil {
-		panic(fmt.Sprintf("unable to mmap: %v", err))
+		fp.Close()
+		return nil, fmt.Errorf("unable to mmap: %v", err)
+	}
+	t, err := decodeFooter(dataRef, index)
+	if err != nil {
+		syscall.Munmap(dataRef)
+		fp.Close()
+		return nil, err
+	}
+	t.data = dataRef[headerSize : headerSize+t.fileInfo.metaOffset] // this field stored table's content
+	t.path = path
+	t.dataRef = dataRef
+	t.size = status.Size()
+	t.fp = fp
+	t.status = status
+	t.index = index
+	return t, nil
+}
+
+// decodeFooter verify the header and footer of a table file and decode the file info, indexes and filter in it,
+// offsets of the file info count from the end of the header.
+func decodeFooter(file []byte, index uint32) (*table, error) {
+	corrupt := func(format string, args ...interface{}) (*table, error) {
+		return nil, &corruptionError{index: index, reason: fmt.Sprintf(format, args...)}
+	}
+	// the format of every table is checked when the data directory is opened
+	if version := decodeHeader(file, tableFile); version != FormatVersion {
+		return corrupt("format header of version %d", version)
+	}
+	content := file[headerSize:]
+	size := len(content)
+	if size < 32 {
+		return corrupt("%d bytes are too short for the file info", size)
 	}
 	fi := &fileInfo{}
 	// get file info
-	fi.Decode(dataRef[status.Size()-32 : status.Size()])
-
-	metaBuf := new(bytes.Buffer)
-	// metaBuf saved all map's entry in this table
-	metaBuf.Write(dataRef[fi.metaOffset : status.Size()-32])
-	offsetMap := map[uint32]uint32{}
-	decoder := gob.NewDecoder(metaBuf)
-	err = decoder.Decode(&offsetMap)
-	if err != nil {
-		panic(fmt.Sprintf("unable to decode map, error: %v", err))
+	fi.Decode(content[size-32:])
+	if fi.metaOffset > size-32 {
+		return corrupt("index offset %d is out of the file", fi.metaOffset)
 	}
-	return &table{
-		data:      dataRef[0:fi.metaOffset], // this field stored table's content
-		path:      path,
-		fileInfo:  fi,
-		dataRef:   dataRef,
-		size:      status.Size(),
-		fp:        fp,
-		status:    status,
-		offsetMap: offsetMap,
-		index:     index,
+	if footerChecksum(content[fi.metaOffset:]) != fi.checksum {
+		return corrupt("footer checksum mismatch")
 	}
-}
 
-func (t *table) SeekBegin() {
-	t.fp.Seek(0, io.SeekStart)
+	// index of all the entries in this table is saved between data and file info,
+	// a sorted table has its block index behind it, then come the block handles and the bloom filter.
+	indexEnd := size - 32
+	var handles *blockHandles
+	var filter tableFilter
+	var err error
+	if fi.handleOffset != 0 {
+		if fi.handleOffset < fi.metaOffset || fi.handleOffset > indexEnd {
+			return corrupt("block handles offset %d is out of the footer", fi.handleOffset)
+		}
+		handles, err = decodeBlockHandles(content[fi.handleOffset:indexEnd])
+		if err != nil {
+			return corrupt("unable to decode block handles, error: %v", err)
+		}
+		if fi.flags&bloomFilter != 0 {
+			filter, err = decodeTableFilter(content[fi.handleOffset+handles.encodedLen() : indexEnd])
+			if err != nil {
+				return corrupt("unable to decode bloom filter, error: %v", err)
+			}
+		}
+		for _, h := range handles.handles {
+			if uint64(h.offset)+uint64(h.length) > uint64(fi.metaOffset) {
+				return corrupt("block at %d is out of the data", h.offset)
+			}
+		}
+		indexEnd = fi.handleOffset
+	}
+	var blocks *blockIndex
+	if fi.blockOffset != 0 {
+		if fi.blockOffset < fi.metaOffset || fi.blockOffset > indexEnd {
+			return corrupt("block index offset %d is out of the footer", fi.blockOffset)
+		}
+		blocks, err = decodeBlockIndex(content[fi.blockOffset:indexEnd])
+		if err != nil {
+			return corrupt("unable to decode block index, error: %v", err)
+		}
+		indexEnd = fi.blockOffset
+	}
+	if fi.flags&binaryIndex == 0 {
+		return corrupt("index isn't a table index")
+	}
+	offsetMap, err := decodeTableIndex(content[fi.metaOffset:indexEnd])
+	if err != nil {
+		return corrupt("unable to decode index, error: %v", err)
+	}
+	if offsetMap.len() != fi.entries {
+		return corrupt("index holds %d entries but %d are expected", offsetMap.len(), fi.entries)
+	}
+	return &table{fileInfo: fi, offsetMap: offsetMap, blocks: blocks, handles: handles, filter: filter}, nil
 }
 
 func (t *table) ID() uint32 {
 	return t.index
 }
 
-func (t *table) iter() *iterator {
-	return newIterator(t.fp, t.fileInfo.metaOffset)
+// length return the size of the table's entries once they are decompressed
+func (t *table) length() uint32 {
+	if t.handles == nil {
+		return uint32(len(t.data))
+	}
+	return t.handles.size
 }
 
-func (t *table) close() {
-	t.fp.Close()
+// entry decode the entry at position, see entryReader
+func (t *table) entry(position uint32) ([]byte, []byte, bool) {
+	return decodeEntry(t.record(position), 0)
+}
+
+// record return the whole entry at position, the block it's in is read by readBlock.
+// a block which is corrupt marks the whole table corrupt and an empty entry is returned instead,
+// see corruption. a reader of more than one entry keeps its block by a blockReader.
+func (t *table) record(position uint32) []byte {
+	return t.reader().record(position)
+}
+
+// reader return a blockReader of t
+func (t *table) reader() *blockReader {
+	return &blockReader{t: t}
+}
+
+// blockReader read the entries of a table, the block of a compressed table it decompressed last
+// is kept until an entry of another block is read. every reader keeps its own block, so
+// concurrent readers of a table don't lock it.
+type blockReader struct {
+	t     *table
+	block []byte // block decompressed last, it starts at start
+	start uint32
 }
 
-func (t *table) entries() []uint32 {
-	entries := make([]uint32, 0)
-	for key := range t.offsetMap {
-		entries = append(entries, key)
+// entry decode the entry at position, see entryReader
+func (r *blockReader) entry(position uint32) ([]byte, []byte, bool) {
+	return decodeEntry(r.record(position), 0)
+}
+
+// record return the whole entry at position, see table.record
+func (r *blockReader) record(position uint32) []byte {
+	t := r.t
+	if t.handles == nil {
+		return entryAt(t.data, position)
+	}
+	if t.corruption() != nil || len(t.handles.handles) == 0 {
+		return emptyEntry
+	}
+	h := t.handles.find(position)
+	if r.block == nil || r.start != h.start {
+		block, err := t.readBlock(h)
+		if err != nil {
+			t.fail(err)
+			return emptyEntry
+		}
+		// slices of the last block stay valid, a new block is never decompressed into it
+		r.block, r.start = block, h.start
+	}
+	if position-h.start+8 > uint32(len(r.block)) {
+		t.fail(&corruptionError{index: t.index, reason: fmt.Sprintf("entry at %d is out of its block", position)})
+		return emptyEntry
+	}
+	return entryAt(r.block, position-h.start)
+}
+
+// readBlock return the block of h verified and decompressed, it's taken from the block cache
+// and put there when the table has one.
+func (t *table) readBlock(h blockHandle) ([]byte, *corruptionError) {
+	key := blockKey{table: t.index, start: h.start}
+	if t.cache != nil {
+		if block, ok := t.cache.get(key); ok {
+			return block, nil
+		}
+	}
+	compressed := t.data[h.offset : h.offset+h.length]
+	if crc32.Checksum(compressed, CrcTable) != h.checksum {
+		return nil, &corruptionError{index: t.index, reason: fmt.Sprintf("checksum mismatch of block at %d", h.offset)}
+	}
+	block, err := t.fileInfo.codec.decompress(compressed)
+	if err != nil {
+		return nil, &corruptionError{index: t.index, reason: fmt.Sprintf("unable to decompress block at %d, error: %v", h.offset, err)}
+	}
+	if t.cache != nil {
+		// an uncompressed block is mmapped, it's gone once the table is released
+		if t.fileInfo.codec == noCompression {
+			block = append([]byte{}, block...)
+		}
+		t.cache.put(key, block)
+	}
+	return block, nil
+}
+
+// emptyEntry stands in for an entry of a corrupt block
+var emptyEntry = make([]byte, 8)
+
+// corruption return the error of a corrupt block read from the table
+func (t *table) corruption() error {
+	if err, ok := t.err.Load().(*corruptionError); ok {
+		return err
+	}
+	return nil
+}
+
+// fail mark the table corrupt by err unless it's marked already
+func (t *table) fail(err *corruptionError) {
+	if t.err.Load() == nil {
+		t.err.Store(err)
+	}
+}
+
+func (t *table) incRef() {
+	atomic.AddInt32(&t.refs, 1)
+}
+
+// decRef release a reference, the table is closed and unmapped once the last one is released
+func (t *table) decRef() {
+	if atomic.AddInt32(&t.refs, -1) == 0 {
+		t.close()
+		t.release()
 	}
-	return entries
+}
+
+func (t *table) close() {
+	t.fp.Close()
 }
 
 func (t *table) release() {
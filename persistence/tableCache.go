@@ -0,0 +1,193 @@
+package persistence
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+// tableCache keep the tables read lately open, up to capacity of them, and evict the least recently used.
+// a table is handed out with a reference which the reader releases by decRef, so an evicted or
+// removed table stays mapped until the last reader is done with it.
+type tableCache struct {
+	path     string
+	capacity int
+	blocks   *blockCache // the blocks lookups read from the cached tables
+	vlog     *valueLog   // the values the cached tables point to, nil if there is no value log
+	lru      *list.List  // of *table, the most recently used first
+	tables   map[uint32]*list.Element
+	reads    map[uint32]uint64 // lookups of every table since the node started, see coldestPolicy
+	sync.Mutex
+}
+
+func newTableCache(path string, capacity int, blocks *blockCache) *tableCache {
+	return &tableCache{
+		path:     path,
+		capacity: capacity,
+		blocks:   blocks,
+		lru:      list.New(),
+		tables:   map[uint32]*list.Element{},
+		reads:    map[uint32]uint64{},
+	}
+}
+
+// get return table index with a reference the caller has to release,
+// the table is opened unless it's cached.
+func (c *tableCache) get(index uint32) (*table, error) {
+	if t, ok := c.lookup(index); ok {
+		return t, nil
+	}
+	// tables are opened outside of the lock, other readers go on meanwhile
+	t, err := openTable(c.path, index)
+	if err != nil {
+		return nil, err
+	}
+	t.cache = c.blocks
+	t.vlog = c.vlog
+	c.Lock()
+	defer c.Unlock()
+	c.reads[index]++
+	if e, ok := c.tables[index]; ok {
+		// another reader opened it first
+		t.close()
+		t.release()
+		c.lru.MoveToFront(e)
+		t = e.Value.(*table)
+		t.incRef()
+		return t, nil
+	}
+	// one reference is the cache's own, the other one the caller's
+	t.incRef()
+	t.incRef()
+	c.tables[index] = c.lru.PushFront(t)
+	for c.lru.Len() > c.capacity {
+		c.evict(c.lru.Back())
+	}
+	return t, nil
+}
+
+func (c *tableCache) lookup(index uint32) (*table, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.tables[index]
+	if !ok {
+		return nil, false
+	}
+	c.reads[index]++
+	c.lru.MoveToFront(e)
+	t := e.Value.(*table)
+	t.incRef()
+	return t, true
+}
+
+// evict drop the cache's reference of the table of e, the caller holds the lock
+func (c *tableCache) evict(e *list.Element) {
+	t := c.lru.Remove(e).(*table)
+	delete(c.tables, t.index)
+	t.decRef()
+}
+
+// remove evict table index and its blocks, it's been compacted, quarantined or evicted
+func (c *tableCache) remove(index uint32) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.reads, index)
+	if e, ok := c.tables[index]; ok {
+		c.evict(e)
+	}
+	if c.blocks != nil {
+		c.blocks.removeTable(index)
+	}
+}
+
+// readCount return the lookups of table index since the node started
+func (c *tableCache) readCount(index uint32) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.reads[index]
+}
+
+// close evict every table
+func (c *tableCache) close() {
+	c.Lock()
+	defer c.Unlock()
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
+
+// tableSearch return the value of key's newest entry up to sequence in table index,
+// whether it's deleted and whether the table holds an entry of key, see tableCache.search
+type tableSearch func(index uint32, key []byte, sequence uint64) ([]byte, bool, bool, error)
+
+// search return key's value in table index, see searchKey
+func (c *tableCache) search(index uint32, key []byte, sequence uint64) ([]byte, bool, bool, error) {
+	t, err := c.get(index)
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer t.decRef()
+	return searchKey(t, key, sequence)
+}
+
+// searchPointer return the value pointer of key's newest entry in table index, see searchPointer
+func (c *tableCache) searchPointer(index uint32, key []byte, sequence uint64) ([]byte, bool, bool, error) {
+	t, err := c.get(index)
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer t.decRef()
+	return searchPointer(t, key, sequence)
+}
+
+// findEntry return the whole newest entry of key up to sequence in t, a corrupt block on the way is returned as an error
+func findEntry(t *table, key []byte, sequence uint64) ([]byte, bool, error) {
+	r := t.reader()
+	position, ok := t.offsetMap.findVersion(util.Hashing(key), key, sequence, r.record)
+	if err := t.corruption(); err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	e := r.record(position)
+	if err := t.corruption(); err != nil {
+		return nil, false, err
+	}
+	return e, true, nil
+}
+
+// searchPointer return the value pointer of key's newest entry up to sequence in t, nil if the entry
+// holds its value or is deleted. the pointer is copied, see searchKey.
+func searchPointer(t *table, key []byte, sequence uint64) ([]byte, bool, bool, error) {
+	e, ok, err := findEntry(t, key, sequence)
+	if err != nil || !ok {
+		return nil, false, false, err
+	}
+	_, value, deleted := decodeEntry(e, 0)
+	if !isValuePointer(e) || deleted {
+		return nil, deleted, true, nil
+	}
+	return append([]byte{}, value...), false, true, nil
+}
+
+// searchKey return the value of key's newest entry up to sequence in t, a corrupt block on the way is returned as an error.
+// the value is copied, the table may be unmapped once it's released. a value kept
+// in the value log is read from there.
+func searchKey(t *table, key []byte, sequence uint64) ([]byte, bool, bool, error) {
+	e, ok, err := findEntry(t, key, sequence)
+	if err != nil || !ok {
+		return nil, false, false, err
+	}
+	_, value, deleted := decodeEntry(e, 0)
+	if isValuePointer(e) && !deleted {
+		if t.vlog == nil {
+			return nil, false, false, fmt.Errorf("table %d.fza points to the value log which isn't open", t.index)
+		}
+		value, err := t.vlog.read(value)
+		return value, false, err == nil, err
+	}
+	return append([]byte{}, value...), deleted, true, nil
+}
@@ -0,0 +1,97 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTableCache(t *testing.T) {
+	for i := uint32(1); i <= 3; i++ {
+		hashMap := newHashMap(1024)
+		hashMap.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("%d", i)))
+		hashMap.persistence("./", i)
+		defer removeTestTable(i)
+	}
+	c := newTableCache("./", 2, newBlockCache(1<<20))
+	defer c.close()
+	held, err := c.get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []uint32{2, 3} {
+		if _, _, ok, err := c.search(index, []byte(fmt.Sprintf("key %d", index)), latest); !ok || err != nil {
+			t.Fatalf("expected key %d in table %d but got %v", index, index, err)
+		}
+	}
+	if _, ok := c.tables[1]; ok || c.lru.Len() != 2 {
+		t.Fatalf("expected the least recently used table to be evicted but %d are cached", c.lru.Len())
+	}
+	// a reader keeps an evicted table mapped until it's done
+	if value, _, ok, err := searchKey(held, []byte("key 1"), latest); !ok || err != nil || !bytes.Equal(value, []byte("1")) {
+		t.Fatalf("expected value 1 but got %s %v", value, err)
+	}
+	held.decRef()
+	c.remove(3)
+	if _, ok := c.tables[3]; ok {
+		t.Fatal("expected a removed table to be evicted")
+	}
+	if stats := c.blocks.stats(); stats.Size == 0 {
+		t.Fatal("expected the blocks of table 2 to be kept")
+	}
+	for _, shard := range c.blocks.shards {
+		for key := range shard.blocks {
+			if key.table == 3 {
+				t.Fatalf("expected the blocks of a removed table to be dropped but got %+v", key)
+			}
+		}
+	}
+	if _, err = c.get(4); err == nil {
+		t.Fatal("expected a missing table to be reported")
+	}
+}
+
+func TestTableCacheConcurrentReads(t *testing.T) {
+	testConcurrentReads(t, noCompression, newBlockCache(1<<20))
+}
+
+// the readers of a compressed table decompress its blocks at once without the block cache
+func TestTableCacheConcurrentCompressedReads(t *testing.T) {
+	testConcurrentReads(t, snappyCompression, nil)
+}
+
+func testConcurrentReads(t *testing.T, codec codec, blocks *blockCache) {
+	hashMap := newHashMap(1 << 20)
+	hashMap.codec = codec
+	for i := 0; i < 1000; i++ {
+		hashMap.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	for i := uint32(1); i <= 4; i++ {
+		hashMap.persistence("./", i)
+		defer removeTestTable(i)
+	}
+	c := newTableCache("./", 2, blocks)
+	defer c.close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				index := uint32((r+i)%4 + 1)
+				value, _, ok, err := c.search(index, []byte(fmt.Sprintf("key %d", i)), latest)
+				if err != nil || !ok || !bytes.Equal(value, []byte(fmt.Sprintf("%d", i))) {
+					errs <- fmt.Errorf("expected value %d in table %d but got %s %v", i, index, value, err)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
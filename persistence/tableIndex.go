@@ -0,0 +1,102 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// tableIndex is the index saved in a table's footer, it's searched right where it's mmapped.
+// it's saved as count(4) + (hash(4) + position(4)) for every entry in ascending checksum order,
+// the entries of different keys with the same checksum are next to each other,
+// the versions of a key are kept from the newest to the oldest.
+type tableIndex struct {
+	buf   []byte
+	count int
+}
+
+// encodeTableIndex lay idx out as a table index
+func encodeTableIndex(idx *hashIndex) []byte {
+	type slot struct{ hash, position uint32 }
+	slots := make([]slot, 0, idx.len())
+	idx.forEach(func(hash uint32, position uint32) {
+		slots = append(slots, slot{hash, position})
+	})
+	sort.Slice(slots, func(i, j int) bool {
+		if slots[i].hash != slots[j].hash {
+			return slots[i].hash < slots[j].hash
+		}
+		return slots[i].position < slots[j].position
+	})
+	buf := make([]byte, 4+8*len(slots))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(slots)))
+	for i, s := range slots {
+		binary.BigEndian.PutUint32(buf[4+8*i:], s.hash)
+		binary.BigEndian.PutUint32(buf[8+8*i:], s.position)
+	}
+	return buf
+}
+
+func decodeTableIndex(buf []byte) (*tableIndex, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("table index: %d bytes are too short", len(buf))
+	}
+	count := binary.BigEndian.Uint32(buf[0:4])
+	if uint32(len(buf)-4)/8 != count || (len(buf)-4)%8 != 0 {
+		return nil, fmt.Errorf("table index: %d entries don't match %d bytes", count, len(buf))
+	}
+	return &tableIndex{buf: buf[4:], count: int(count)}, nil
+}
+
+func (ti *tableIndex) hash(i int) uint32 {
+	return binary.BigEndian.Uint32(ti.buf[8*i:])
+}
+
+func (ti *tableIndex) position(i int) uint32 {
+	return binary.BigEndian.Uint32(ti.buf[8*i+4:])
+}
+
+// findEntry return the position of key's entry, entries are read by read
+func (ti *tableIndex) findEntry(hash uint32, key []byte, read entryReader) (uint32, bool) {
+	i := sort.Search(ti.count, func(i int) bool {
+		return ti.hash(i) >= hash
+	})
+	for ; i < ti.count && ti.hash(i) == hash; i++ {
+		if k, _, _ := read(ti.position(i)); bytes.Equal(k, key) {
+			return ti.position(i), true
+		}
+	}
+	return 0, false
+}
+
+// findVersion return the position of key's newest entry up to sequence, entries are read by record
+func (ti *tableIndex) findVersion(hash uint32, key []byte, sequence uint64, record func(position uint32) []byte) (uint32, bool) {
+	i := sort.Search(ti.count, func(i int) bool {
+		return ti.hash(i) >= hash
+	})
+	for ; i < ti.count && ti.hash(i) == hash; i++ {
+		e := record(ti.position(i))
+		if k, _, _ := decodeEntry(e, 0); bytes.Equal(k, key) && entrySequence(e) <= sequence {
+			return ti.position(i), true
+		}
+	}
+	return 0, false
+}
+
+// forEach call fn for every entry's checksum and position in ascending checksum order
+func (ti *tableIndex) forEach(fn func(hash uint32, position uint32)) {
+	for i := 0; i < ti.count; i++ {
+		fn(ti.hash(i), ti.position(i))
+	}
+}
+
+// scanEntries return the positions of the keys in [start, end) in ascending key order, see hashIndex.scan
+func (ti *tableIndex) scanEntries(start, end []byte, read entryReader) []uint32 {
+	return scanKeys(ti, start, end, read)
+}
+
+// len return the number of entries
+func (ti *tableIndex) len() int {
+	return ti.count
+}
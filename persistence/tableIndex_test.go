@@ -0,0 +1,44 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+func TestTableIndex(t *testing.T) {
+	hashMap := newHashMap(1 << 20)
+	for i := 0; i < 1000; i++ {
+		hashMap.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	ti, err := decodeTableIndex(encodeTableIndex(hashMap.concurrentMap.(*hashIndex)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.len() != 1000 {
+		t.Fatalf("expected 1000 entries but got %d", ti.len())
+	}
+	last := uint32(0)
+	ti.forEach(func(hash uint32, _ uint32) {
+		if hash < last {
+			t.Fatalf("expected the checksums in ascending order but %d follows %d", hash, last)
+		}
+		last = hash
+	})
+	read := bufferReader(hashMap.buf)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key %d", i))
+		position, ok := ti.findEntry(util.Hashing(key), key, read)
+		if _, v, _ := read(position); !ok || !bytes.Equal(v, []byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("expected value %d but got %s", i, v)
+		}
+	}
+	if _, ok := ti.findEntry(util.Hashing([]byte("key 1000")), []byte("key 1000"), read); ok {
+		t.Fatal("expected key 1000 to be missing")
+	}
+	if _, err = decodeTableIndex(make([]byte, 10)); err == nil {
+		t.Fatal("expected a truncated index to be refused")
+	}
+}
@@ -0,0 +1,155 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+// tableWriter stream the entries of a new table to disk, the entries are added in ascending checksum order.
+// a data block is compressed and written once it's full, so only the block being filled and the index
+// are kept in memory. a sorted table has to be laid out in key order instead, its entries are kept
+// until finish, the caller caps how large a table grows.
+// the table is written next to its file and renamed into place once it's synced.
+type tableWriter struct {
+	index   uint32
+	file    string
+	fp      *os.File
+	writer  *bufio.Writer
+	codec   codec
+	sorted  bool
+	block   bytes.Buffer // entries of the block being filled, every entry of a sorted table
+	handles *blockHandles
+	offsets *hashIndex
+	written uint32 // bytes of blocks written behind the header
+	size    uint32 // uncompressed size of the entries added
+	added   bool   // an entry has been added, min and max hold checksums
+	min     uint32
+	max     uint32
+}
+
+func newTableWriter(path string, index uint32, c codec, sorted bool) (*tableWriter, error) {
+	file := util.TablePath(path, index)
+	fp, err := os.Create(file + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := &tableWriter{
+		index:   index,
+		file:    file,
+		fp:      fp,
+		writer:  bufio.NewWriter(fp),
+		codec:   c,
+		sorted:  sorted,
+		handles: &blockHandles{handles: make([]blockHandle, 0)},
+		offsets: newHashIndex(),
+	}
+	if _, err = w.writer.Write(encodeHeader(tableFile)); err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// add append entry of checksum hash, the entry is copied
+func (w *tableWriter) add(entry []byte, hash uint32) error {
+	if !w.added || hash < w.min {
+		w.min = hash
+	}
+	if !w.added || hash > w.max {
+		w.max = hash
+	}
+	w.added = true
+	w.offsets.insert(hash, w.size)
+	w.block.Write(entry)
+	w.size += uint32(len(entry))
+	if !w.sorted && w.block.Len() >= blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// flushBlock compress and write the block being filled
+func (w *tableWriter) flushBlock() error {
+	block := w.codec.compress(w.block.Bytes())
+	w.handles.handles = append(w.handles.handles, blockHandle{
+		start:    w.size - uint32(w.block.Len()),
+		offset:   w.written,
+		length:   uint32(len(block)),
+		checksum: crc32.Checksum(block, CrcTable),
+	})
+	w.block.Reset()
+	if _, err := w.writer.Write(block); err != nil {
+		return err
+	}
+	w.written += uint32(len(block))
+	return nil
+}
+
+// finish write the footer, sync the table and rename it into place
+func (w *tableWriter) finish() error {
+	var blocks *blockIndex
+	if w.sorted {
+		var content []byte
+		content, w.offsets, blocks = sortEntries(w.block.Bytes(), w.offsets)
+		data, handles := compressBlocks(content, w.codec)
+		w.block.Reset()
+		w.handles = handles
+		if _, err := w.writer.Write(data); err != nil {
+			return err
+		}
+		w.written = uint32(len(data))
+	} else if w.block.Len() > 0 {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+	w.handles.size = w.size
+	fi := &fileInfo{
+		metaOffset: int(w.written),
+		entries:    w.offsets.len(),
+		minRange:   w.min,
+		maxRange:   w.max,
+		codec:      w.codec,
+		flags:      binaryIndex | bloomFilter,
+	}
+	footer := bytes.NewBuffer(encodeTableIndex(w.offsets))
+	if blocks != nil {
+		fi.blockOffset = fi.metaOffset + footer.Len()
+		footer.Write(blocks.encode())
+	}
+	fi.handleOffset = fi.metaOffset + footer.Len()
+	footer.Write(w.handles.encode())
+	footer.Write(newTableFilter(w.offsets))
+	fib := make([]byte, 32)
+	fi.Encode(fib)
+	footer.Write(fib)
+	sealFooter(footer.Bytes())
+	if _, err := w.writer.Write(footer.Bytes()); err != nil {
+		return err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	// the manifest mustn't refer to a table which isn't on disk yet
+	if err := w.fp.Sync(); err != nil {
+		return err
+	}
+	if err := w.fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.file+".tmp", w.file); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(w.file))
+}
+
+// abort drop the table being written
+func (w *tableWriter) abort() {
+	w.fp.Close()
+	os.Remove(w.file + ".tmp")
+}
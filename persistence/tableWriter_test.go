@@ -0,0 +1,197 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
+	"github.com/Pheomenon/frozra/v1/persistence/util"
+)
+
+func TestTableWriter(t *testing.T) {
+	type entry struct {
+		hash uint32
+		key  []byte
+	}
+	entries := make([]entry, 0)
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key %d", i))
+		entries = append(entries, entry{util.Hashing(key), key})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+	for _, sorted := range []bool{false, true} {
+		dir := t.TempDir()
+		w, err := newTableWriter(dir, 1, snappyCompression, sorted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			h := newHashMap(1024)
+			h.Set(e.key, []byte("Phenom"))
+			if err = w.add(entryAt(h.buf, 0), e.hash); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = w.finish(); err != nil {
+			t.Fatal(err)
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) != 1 || files[0].Name() != "1.fza" {
+			t.Fatalf("expected only the table to be left but got %v", files)
+		}
+		tb := readTable(dir, 1)
+		if len(tb.handles.handles) < 2 || (tb.blocks != nil) != sorted {
+			t.Fatalf("expected a table of several blocks but got %d", len(tb.handles.handles))
+		}
+		for _, e := range entries {
+			if value, _, ok, err := searchKey(tb, e.key, latest); !ok || err != nil || !bytes.Equal(value, []byte("Phenom")) {
+				t.Fatalf("expected value of %s but got %s %v", e.key, value, err)
+			}
+		}
+		tb.close()
+		tb.release()
+	}
+}
+
+func TestStreamMerge(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tables := make([]*table, 0)
+	// the newest table goes first
+	for version := 3; version > 0; version-- {
+		h := l.newMemoryTable()
+		for i := 0; i < 1000*(4-version); i++ {
+			h.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("%d-%d", i, version)))
+		}
+		if version == 3 {
+			h.Delete([]byte("key 2500"))
+		}
+		index := l.metadata.nextFileID()
+		h.persistence(l.absPath, index)
+		tables = append(tables, readTable(l.absPath, index))
+	}
+	edit := &versionEdit{}
+	if err = l.stream(1, tables, 16<<10, edit); err != nil {
+		t.Fatal(err)
+	}
+	if len(edit.adds) < 2 {
+		t.Fatalf("expected the merge to be cut into several tables but got %d", len(edit.adds))
+	}
+	for i, add := range edit.adds[1:] {
+		if add.file.MinRange <= edit.adds[i].file.MaxRange {
+			t.Fatalf("expected the new tables not to overlap but got %+v", edit.adds)
+		}
+	}
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key %d", i))
+		version := 3 - i/1000
+		found := false
+		for _, add := range edit.adds {
+			value, _, ok, err := l.tableCache.search(add.file.Index, key, latest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				found = true
+				if !bytes.Equal(value, []byte(fmt.Sprintf("%d-%d", i, version))) {
+					t.Fatalf("expected version %d of key %d but got %s", version, i, value)
+				}
+			}
+		}
+		if found != (i != 2500) {
+			t.Fatalf("expected key %d to be found %v", i, i != 2500)
+		}
+	}
+	for _, tb := range tables {
+		tb.close()
+		tb.release()
+	}
+	l.commit(edit)
+}
+
+func TestStreamMergeFailure(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	h := l.newMemoryTable()
+	for i := 0; i < 1000; i++ {
+		h.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	index := l.metadata.nextFileID()
+	h.persistence(l.absPath, index)
+	tb := readTable(l.absPath, index)
+	defer func() {
+		tb.close()
+		tb.release()
+	}()
+	// the new tables can't be created, the merge fails instead of the process
+	l.compactMutex.Lock()
+	absPath := l.absPath
+	l.absPath = filepath.Join(absPath, "missing")
+	edit := &versionEdit{}
+	err = l.stream(1, []*table{tb}, 0, edit)
+	l.absPath = absPath
+	l.compactMutex.Unlock()
+	if err == nil || len(edit.adds) != 0 {
+		t.Fatalf("expected the merge to fail without new tables but got %v %+v", err, edit.adds)
+	}
+}
+
+func TestMergeLimit(t *testing.T) {
+	for _, sorted := range []bool{false, true} {
+		setting := conf.LoadConfigure()
+		setting.Persistence.Path = t.TempDir()
+		setting.Persistence.SortedTable = sorted
+		setting.Persistence.L1TableSize = 16 << 10
+		l, err := New(setting.Persistence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables := make([]*table, 0)
+		for version := 2; version > 0; version-- {
+			h := l.newMemoryTable()
+			for i := 0; i < 2000; i++ {
+				h.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("%d-%d", i, version)))
+			}
+			index := l.metadata.nextFileID()
+			h.persistence(l.absPath, index)
+			tables = append(tables, readTable(l.absPath, index))
+		}
+		// even a merge into level 0 is cut at the max table size
+		edit := &versionEdit{}
+		l.compactMutex.Lock()
+		err = l.merge(0, tables, edit)
+		l.compactMutex.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(edit.adds) < 2 {
+			t.Fatalf("expected the merge to be cut into several tables but got %d", len(edit.adds))
+		}
+		records := uint32(0)
+		for _, add := range edit.adds {
+			records += add.file.Records
+		}
+		if records != 2000 {
+			t.Fatalf("expected 2000 entries but got %d", records)
+		}
+		for _, tb := range tables {
+			tb.close()
+			tb.release()
+		}
+		l.commit(edit)
+		l.Close()
+	}
+}
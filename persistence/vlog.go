@@ -0,0 +1,414 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+	"github.com/sirupsen/logrus"
+)
+
+// valuePointer is set on the value length of an entry whose value is kept in the value log,
+// the value of such an entry is a pointer to the record holding it.
+const valuePointer uint32 = 1 << 30
+
+// a value pointer is segment(4) + offset(4) + length(4) of its record
+const valuePointerSize = 12
+
+// a record of the value log is laid out as a wal record, crc(4) + klen(4) + vlen(4) + key + value
+// and the expiry of a value which expires.
+// the key lets the gc tell whether the value is still the newest one of its key.
+const vlogHeaderSize = 12
+
+// valueLogGCInterval is how often the gc looks for segments to collect
+const valueLogGCInterval = time.Minute
+
+// valueLog keep the values larger than the value threshold out of the tables, so compaction
+// only copies their pointers. values are appended to the head segment and a segment is
+// sealed once it's larger than maxSize. segments are never modified, the gc rewrites
+// the live values of a segment and deletes it.
+type valueLog struct {
+	absPath  string
+	maxSize  int64
+	segments map[uint32]*os.File // every segment open for reads
+	head     *os.File            // nil until the first value is appended
+	headID   uint32
+	headSize int64
+	nextID   uint32
+	// collected segments are deleted by the next gc, readers which found
+	// a pointer to them before their values were rewritten can still read them
+	obsolete []uint32
+	sync.RWMutex
+}
+
+func vlogPath(absPath string, segment uint32) string {
+	return fmt.Sprintf("%s/%d.vlog", absPath, segment)
+}
+
+func openValueLog(absPath string, maxSize int64) (*valueLog, error) {
+	ids, err := vlogSegments(absPath)
+	if err != nil {
+		return nil, err
+	}
+	v := &valueLog{
+		absPath:  absPath,
+		maxSize:  maxSize,
+		segments: map[uint32]*os.File{},
+		nextID:   1,
+	}
+	for _, id := range ids {
+		fp, err := os.Open(vlogPath(absPath, id))
+		if err != nil {
+			v.close()
+			return nil, err
+		}
+		v.segments[id] = fp
+		v.nextID = id + 1
+	}
+	return v, nil
+}
+
+// vlogSegments return every segment's id in the directory in ascending order
+func vlogSegments(absPath string) ([]uint32, error) {
+	infos, err := ioutil.ReadDir(absPath)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]uint32, 0)
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".vlog") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".vlog"), 10, 32)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, uint32(id))
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// append write a record of key and value which expires at expires to the head segment and return
+// the pointer to it, it's not durable until sync.
+func (v *valueLog) append(key, value []byte, expires int64) ([]byte, error) {
+	v.Lock()
+	defer v.Unlock()
+	if v.head == nil || v.headSize >= v.maxSize {
+		if err := v.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	value, flag := withExpiry(value, expires)
+	record := make([]byte, vlogHeaderSize+len(key)+len(value))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(value))|flag)
+	copy(record[vlogHeaderSize:], key)
+	copy(record[vlogHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(record[0:4], crc32.Checksum(record[4:], CrcTable))
+	if _, err := v.head.Write(record); err != nil {
+		return nil, err
+	}
+	pointer := newValuePointer(v.headID, uint32(v.headSize), uint32(len(record)))
+	v.headSize += int64(len(record))
+	return pointer, nil
+}
+
+// newValuePointer return the pointer to the record of length bytes at offset of segment,
+// laid out as segment(4) + offset(4) + length(4)
+func newValuePointer(segment, offset, length uint32) []byte {
+	pointer := make([]byte, valuePointerSize)
+	binary.BigEndian.PutUint32(pointer[0:4], segment)
+	binary.BigEndian.PutUint32(pointer[4:8], offset)
+	binary.BigEndian.PutUint32(pointer[8:12], length)
+	return pointer
+}
+
+// rotate seal the head segment and start a new one, the caller holds the lock
+func (v *valueLog) rotate() error {
+	if v.head != nil {
+		if err := v.head.Sync(); err != nil {
+			return err
+		}
+	}
+	fp, err := os.OpenFile(vlogPath(v.absPath, v.nextID), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(encodeHeader(valueLogFile)); err != nil {
+		fp.Close()
+		return err
+	}
+	v.head, v.headID, v.headSize = fp, v.nextID, headerSize
+	v.segments[v.headID] = fp
+	v.nextID++
+	return nil
+}
+
+// sync fsync the head segment, a table must not refer to a value which isn't on disk yet
+func (v *valueLog) sync() error {
+	v.Lock()
+	defer v.Unlock()
+	if v.head == nil {
+		return nil
+	}
+	return v.head.Sync()
+}
+
+// read return the value pointer points to
+func (v *valueLog) read(pointer []byte) ([]byte, error) {
+	if len(pointer) != valuePointerSize {
+		return nil, fmt.Errorf("vlog: value pointer of %d bytes", len(pointer))
+	}
+	segment := binary.BigEndian.Uint32(pointer[0:4])
+	offset := binary.BigEndian.Uint32(pointer[4:8])
+	length := binary.BigEndian.Uint32(pointer[8:12])
+	v.RLock()
+	defer v.RUnlock()
+	fp, ok := v.segments[segment]
+	if !ok {
+		return nil, fmt.Errorf("vlog: segment %d.vlog is missing", segment)
+	}
+	if length < vlogHeaderSize {
+		return nil, fmt.Errorf("vlog: record of %d.vlog at %d is corrupt", segment, offset)
+	}
+	record := make([]byte, length)
+	if _, err := fp.ReadAt(record, int64(offset)); err != nil {
+		return nil, fmt.Errorf("vlog: unable to read %d.vlog at %d %v", segment, offset, err)
+	}
+	keyLength := binary.BigEndian.Uint32(record[4:8])
+	valLength := binary.BigEndian.Uint32(record[8:12])
+	flags := valLength & expiring
+	valLength &^= expiring
+	if uint64(keyLength)+uint64(valLength)+vlogHeaderSize != uint64(length) ||
+		crc32.Checksum(record[4:], CrcTable) != binary.BigEndian.Uint32(record[0:4]) {
+		return nil, fmt.Errorf("vlog: record of %d.vlog at %d is corrupt", segment, offset)
+	}
+	value, _ := splitExpiry(record[vlogHeaderSize+keyLength:], flags)
+	return value, nil
+}
+
+// sealed return the segments values are no longer appended to in ascending order
+func (v *valueLog) sealed() []uint32 {
+	v.RLock()
+	defer v.RUnlock()
+	ids := make([]uint32, 0, len(v.segments))
+	for id := range v.segments {
+		if v.head == nil || id != v.headID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// forEach call fn for every record of sealed segment with the pointer to the record, a torn or corrupt
+// record is reported as an error after the records in front of it, the segment can't be told apart
+// from its live values then. the total size of the records is returned.
+func (v *valueLog) forEach(segment uint32, fn func(key, value []byte, expires int64, pointer []byte)) (int64, error) {
+	fp, err := os.Open(vlogPath(v.absPath, segment))
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+	reader := bufio.NewReader(fp)
+	err = readHeader(reader, vlogPath(v.absPath, segment), valueLogFile)
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	status, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	left := status.Size() - headerSize
+	total := int64(0)
+	header := make([]byte, vlogHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, fmt.Errorf("vlog: segment %d.vlog ends with a torn record at %d", segment, headerSize+total)
+		}
+		keyLength := binary.BigEndian.Uint32(header[4:8])
+		valLength := binary.BigEndian.Uint32(header[8:12])
+		flags := valLength & expiring
+		valLength &^= expiring
+		left -= vlogHeaderSize
+		// a damaged length must not make us allocate more than the segment holds
+		if int64(keyLength)+int64(valLength) > left {
+			return total, fmt.Errorf("vlog: segment %d.vlog ends with a torn record at %d", segment, headerSize+total)
+		}
+		left -= int64(keyLength) + int64(valLength)
+		kv := make([]byte, keyLength+valLength)
+		if _, err := io.ReadFull(reader, kv); err != nil {
+			return total, fmt.Errorf("vlog: segment %d.vlog ends with a torn record at %d", segment, headerSize+total)
+		}
+		c := crc32.New(CrcTable)
+		_, _ = c.Write(header[4:])
+		_, _ = c.Write(kv)
+		if c.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+			return total, fmt.Errorf("vlog: record of %d.vlog at %d is corrupt", segment, headerSize+total)
+		}
+		pointer := newValuePointer(segment, uint32(headerSize+total), uint32(vlogHeaderSize+len(kv)))
+		total += vlogHeaderSize + int64(len(kv))
+		value, expires := splitExpiry(kv[keyLength:], flags)
+		fn(kv[:keyLength], value, expires, pointer)
+	}
+}
+
+// retire mark segment to be deleted by the next gc, its live values have been rewritten
+func (v *valueLog) retire(segment uint32) {
+	v.Lock()
+	defer v.Unlock()
+	v.obsolete = append(v.obsolete, segment)
+}
+
+// purge delete the segments retired before
+func (v *valueLog) purge() {
+	v.Lock()
+	defer v.Unlock()
+	for _, segment := range v.obsolete {
+		if fp, ok := v.segments[segment]; ok {
+			fp.Close()
+			delete(v.segments, segment)
+		}
+		err := os.Remove(vlogPath(v.absPath, segment))
+		if err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("vlog: unable to remove segment %d.vlog %v", segment, err)
+		}
+	}
+	v.obsolete = nil
+}
+
+// close delete the retired segments and close every segment, the head is synced first
+func (v *valueLog) close() error {
+	v.purge()
+	v.Lock()
+	defer v.Unlock()
+	var err error
+	if v.head != nil {
+		err = v.head.Sync()
+	}
+	for id, fp := range v.segments {
+		fp.Close()
+		delete(v.segments, id)
+	}
+	v.head = nil
+	return err
+}
+
+func (l *Lsm) runValueLogGC(closer *y.Closer) {
+	gcTicker := time.NewTicker(valueLogGCInterval)
+loop:
+	for {
+		select {
+		case <-closer.HasBeenClosed():
+			break loop
+		case <-gcTicker.C:
+			l.collectValueLog()
+		}
+	}
+	closer.Done()
+}
+
+// collectValueLog rewrite the live values of every sealed segment whose live ratio dropped below
+// the gc ratio and retire the segment. a value is live while the newest entry of its key points to
+// its record, see pointsTo. a live value is written again as the newest version of its key
+// unless the key has changed meanwhile, it goes to the head segment once its memory table is flushed.
+// the number of segments collected is returned. older versions of the values are left behind,
+// so nothing is collected while a snapshot which may still read them is live.
+func (l *Lsm) collectValueLog() int {
+	l.vlogMutex.Lock()
+	defer l.vlogMutex.Unlock()
+	if len(l.snapshots.sequences()) > 0 {
+		return 0
+	}
+	l.vlog.purge()
+	collected := 0
+	for _, segment := range l.vlog.sealed() {
+		live := int64(0)
+		total, err := l.vlog.forEach(segment, func(key, value []byte, expires int64, pointer []byte) {
+			// an expired value reads as deleted, so it's dropped with the segment
+			if l.pointsTo(key, pointer) {
+				live += vlogHeaderSize + int64(len(key)+len(value))
+				if expires != 0 {
+					live += expirySize
+				}
+			}
+		})
+		if err != nil {
+			// the values behind the damage may still be live, the segment is kept
+			logrus.Errorf("vlog: unable to collect segment %d.vlog %s", segment, err.Error())
+			continue
+		}
+		if total > 0 && float64(live)/float64(total) >= l.setting.ValueLogGCRatio {
+			continue
+		}
+		requests := make([]*request, 0)
+		if live > 0 {
+			_, err = l.vlog.forEach(segment, func(key, value []byte, expires int64, pointer []byte) {
+				if !l.pointsTo(key, pointer) {
+					return
+				}
+				r := &request{entries: []batchEntry{{key: key, value: value, expires: expires}}, rewrite: pointer}
+				r.wg.Add(1)
+				l.writeChan <- r
+				requests = append(requests, r)
+			})
+		}
+		for _, r := range requests {
+			r.wg.Wait()
+		}
+		if err != nil {
+			logrus.Errorf("vlog: unable to collect segment %d.vlog %s", segment, err.Error())
+			continue
+		}
+		// the rewritten values must survive a crash before the segment goes away
+		err = l.wal.sync()
+		if err != nil {
+			logrus.Fatalf("wal: unable to commit writes %s", err.Error())
+		}
+		l.vlog.retire(segment)
+		logrus.Infof("vlog: segment %d.vlog is collected, %d of its %d bytes were live", segment, live, total)
+		collected++
+	}
+	return collected
+}
+
+// pointsTo report whether the newest entry of key points to the value log record at pointer.
+// an entry of a memory table holds its value, so the key has been written again since the record.
+func (l *Lsm) pointsTo(key, pointer []byte) bool {
+	l.RLock()
+	memoryTable, immutables := l.memoryTable, l.immutables
+	l.RUnlock()
+	if _, _, ok := memoryTable.lookup(key, latest); ok {
+		return false
+	}
+	for _, immutable := range immutables {
+		if _, _, ok := immutable.lookup(key, latest); ok {
+			return false
+		}
+	}
+	current, _, ok := l.searchLevels(key, latest, l.tableCache.searchPointer)
+	return ok && bytes.Equal(current, pointer)
+}
+
+// isValuePointer report the whole entry e holds a value pointer
+func isValuePointer(e []byte) bool {
+	return binary.BigEndian.Uint32(e[4:8])&valuePointer != 0
+}
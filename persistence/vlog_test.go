@@ -0,0 +1,262 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Pheomenon/frozra/v1/conf"
+)
+
+func TestValueLog(t *testing.T) {
+	dir := t.TempDir()
+	// every segment is sealed after a single record
+	v, err := openValueLog(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pointers := make([][]byte, 0)
+	for i := 0; i < 3; i++ {
+		pointer, err := v.append([]byte(fmt.Sprintf("key %d", i)), bytes.Repeat([]byte{byte(i)}, 100), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pointers = append(pointers, pointer)
+	}
+	if err = v.sync(); err != nil {
+		t.Fatal(err)
+	}
+	for i, pointer := range pointers {
+		value, err := v.read(pointer)
+		if err != nil || !bytes.Equal(value, bytes.Repeat([]byte{byte(i)}, 100)) {
+			t.Fatalf("expected value %d but got %v %v", i, value, err)
+		}
+	}
+	if fmt.Sprint(v.sealed()) != fmt.Sprint([]uint32{1, 2}) {
+		t.Fatalf("expected segments 1 and 2 to be sealed but got %v", v.sealed())
+	}
+	keys := make([]string, 0)
+	total, err := v.forEach(2, func(key, value []byte, _ int64, pointer []byte) {
+		keys = append(keys, string(key))
+		if !bytes.Equal(pointer, pointers[1]) {
+			t.Fatalf("expected pointer %v but got %v", pointers[1], pointer)
+		}
+	})
+	if err != nil || total != vlogHeaderSize+5+100 || fmt.Sprint(keys) != "[key 1]" {
+		t.Fatalf("unexpected records %v of %d bytes %v", keys, total, err)
+	}
+	// a pointer which doesn't point to a record is reported
+	broken := append([]byte{}, pointers[0]...)
+	binary.BigEndian.PutUint32(broken[4:8], headerSize+1)
+	if _, err = v.read(broken); err == nil {
+		t.Fatal("expected a broken pointer to be reported")
+	}
+	v.retire(1)
+	if err = v.close(); err != nil {
+		t.Fatal(err)
+	}
+	v, err = openValueLog(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.close()
+	if _, err = v.read(pointers[0]); err == nil {
+		t.Fatal("expected a retired segment to be deleted")
+	}
+	if value, err := v.read(pointers[2]); err != nil || len(value) != 100 {
+		t.Fatalf("expected the value to survive a reopen but got %v", err)
+	}
+}
+
+func TestLsm_ValueLog(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.ValueThreshold = 64
+	setting.Persistence.ValueLogFileSize = 4 << 10
+	// values are flushed in hash order, so any segment holding an overwritten value is collected
+	setting.Persistence.ValueLogGCRatio = 0.99
+	value := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d-%d ", i, version)), 64)
+	}
+	write := func(start, end, version int) {
+		l, err := New(setting.Persistence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := start; i < end; i++ {
+			l.Set([]byte(fmt.Sprintf("key %d", i)), value(i, version))
+		}
+		// small values stay in the tables
+		l.Set([]byte("small"), []byte("Phenom"))
+		l.Close()
+	}
+	write(0, 100, 1)
+	first, _ := vlogSegments(setting.Persistence.Path)
+	if len(first) < 2 {
+		t.Fatalf("expected the values to be kept in the value log but got %d segments", len(first))
+	}
+	// the first values are pushed down to level 1, the newer l0 table overrides them
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.compactMutex.Lock()
+	l.move(0, l.metadata.copyLevel(0)[0])
+	l.compactMutex.Unlock()
+	l.Close()
+	// most of the first values are overwritten
+	write(0, 90, 2)
+
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collected := l.collectValueLog(); collected == 0 {
+		t.Fatal("expected the segments of overwritten values to be collected")
+	}
+	check := func(l *Lsm) {
+		for i := 0; i < 100; i++ {
+			version := 2
+			if i >= 90 {
+				version = 1
+			}
+			val, ok := l.Get([]byte(fmt.Sprintf("key %d", i)))
+			if !ok || !bytes.Equal(val, value(i, version)) {
+				t.Fatalf("expected version %d of key %d but got %.20s", version, i, val)
+			}
+		}
+		if val, _ := l.Get([]byte("small")); !bytes.Equal(val, []byte("Phenom")) {
+			t.Fatalf("expected value Phenom but got %s", val)
+		}
+		scanned := 0
+		l.Scan([]byte("key 95"), []byte("key 96"), func(key, val []byte) bool {
+			if !bytes.Equal(val, value(95, 1)) {
+				t.Fatalf("expected version 1 of key 95 but got %.20s", val)
+			}
+			scanned++
+			return true
+		})
+		if scanned != 1 {
+			t.Fatalf("expected key 95 to be scanned but got %d keys", scanned)
+		}
+	}
+	check(l)
+	l.Close()
+
+	// collected segments are gone once the node is closed
+	for _, segment := range first[:len(first)-1] {
+		if _, err := ioutil.ReadFile(vlogPath(l.absPath, segment)); err == nil {
+			t.Fatalf("expected segment %d.vlog to be collected", segment)
+		}
+	}
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(l)
+	l.Close()
+}
+
+func TestValueLogRewrittenValue(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.ValueThreshold = 64
+	setting.Persistence.ValueLogFileSize = 4 << 10
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d ", i)), 64)
+	}
+	for round := 0; round < 2; round++ {
+		l, err := New(setting.Persistence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			l.Set([]byte(fmt.Sprintf("key %d", i)), value(i))
+		}
+		l.Close()
+	}
+	first, _ := vlogSegments(setting.Persistence.Path)
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the values were set again with the same bytes, the first records are no longer pointed to
+	if collected := l.collectValueLog(); collected < len(first)/2-1 {
+		t.Fatalf("expected the segments of the first round to be collected but got %d of %d", collected, len(first))
+	}
+	for i := 0; i < 100; i++ {
+		if val, ok := l.Get([]byte(fmt.Sprintf("key %d", i))); !ok || !bytes.Equal(val, value(i)) {
+			t.Fatalf("expected value %d but got %.20s", i, val)
+		}
+	}
+}
+
+func TestValueLogCorruptSegment(t *testing.T) {
+	setting := conf.LoadConfigure()
+	setting.Persistence.Path = t.TempDir()
+	setting.Persistence.ValueThreshold = 64
+	setting.Persistence.ValueLogFileSize = 4 << 10
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d ", i)), 64)
+	}
+	l, err := New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		l.Set([]byte(fmt.Sprintf("key %d", i)), value(i))
+	}
+	l.Close()
+	segments, _ := vlogSegments(setting.Persistence.Path)
+	// an unsorted memory table is flushed in hash order, so the keys of the first records are looked up
+	v, err := openValueLog(setting.Persistence.Path, int64(setting.Persistence.ValueLogFileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0)
+	v.forEach(segments[0], func(key, value []byte, _ int64, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	v.close()
+	if len(keys) < 2 {
+		t.Fatalf("expected more than a record in %d.vlog but got %v", segments[0], keys)
+	}
+	// flip a byte in the value of the first record, the records behind it are intact
+	path := vlogPath(setting.Persistence.Path, segments[0])
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[headerSize+vlogHeaderSize+len(keys[0])+1] ^= 0xff
+	if err = ioutil.WriteFile(path, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.vlog.forEach(segments[0], func(key, value []byte, _ int64, _ []byte) {}); err == nil {
+		t.Fatal("expected the corrupt record to be reported")
+	}
+	// the live values can't be told from the segment, so it mustn't be collected
+	if collected := l.collectValueLog(); collected != 0 {
+		t.Fatalf("expected the corrupt segment to be kept but %d segments were collected", collected)
+	}
+	l.Close()
+	if _, err = ioutil.ReadFile(path); err != nil {
+		t.Fatalf("expected segment %d.vlog to be kept", segments[0])
+	}
+	l, err = New(setting.Persistence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var i int
+	fmt.Sscanf(keys[1], "key %d", &i)
+	if val, ok := l.Get([]byte(keys[1])); !ok || !bytes.Equal(val, value(i)) {
+		t.Fatalf("expected the value behind the corrupt record but got %.20s", val)
+	}
+}
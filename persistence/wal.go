@@ -0,0 +1,312 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// WalSyncAlways fsync the log after every single write
+	WalSyncAlways = "always"
+	// WalSyncGroup collect the writes queued at the same time and fsync them together
+	WalSyncGroup = "group"
+	// WalSyncNone leave the log in the page cache, it only survives a process crash
+	WalSyncNone = "none"
+)
+
+// every wal record is crc(4) + klen(4) + vlen(4) + key + value,
+// vlen carries the tombstone and expiring flags as entries do and the checksum
+// covers everything behind it. the value of an expiring record is followed by its expiry.
+const walHeaderSize = 12
+
+// walBatchFollows is set on the vlen of every record of a batch but its last one,
+// the records of a batch are only replayed once its last one is found intact.
+const walBatchFollows uint32 = 1 << 30
+
+// wal is an append-only log of the writes accepted by the memory table.
+// every memory table owns one segment, the segment is removed once the
+// memory table has been persisted as a l0 table.
+type wal struct {
+	absPath  string
+	syncMode string
+	segment  uint32
+	fp       *os.File
+	buf      bytes.Buffer
+	sync.Mutex
+}
+
+func walPath(absPath string, segment uint32) string {
+	return fmt.Sprintf("%s/%d.wal", absPath, segment)
+}
+
+func newWal(absPath string, segment uint32, syncMode string) (*wal, error) {
+	switch syncMode {
+	case "":
+		syncMode = WalSyncGroup
+	case WalSyncAlways, WalSyncGroup, WalSyncNone:
+	default:
+		return nil, fmt.Errorf("wal: unknown sync mode %q", syncMode)
+	}
+	fp, err := createSegment(absPath, segment)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{
+		absPath:  absPath,
+		syncMode: syncMode,
+		segment:  segment,
+		fp:       fp,
+	}, nil
+}
+
+// createSegment create an empty segment which holds only the format header
+func createSegment(absPath string, segment uint32) (*os.File, error) {
+	fp, err := os.OpenFile(walPath(absPath, segment), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fp.Write(encodeHeader(walFile))
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return fp, nil
+}
+
+// appendBatch encode the records of a batch to the pending buffer, it's not durable until commit.
+// every record but the last one is marked, so replay can tell a batch which was torn by a crash and drop it as a whole.
+func (w *wal) appendBatch(entries []batchEntry) {
+	w.Lock()
+	defer w.Unlock()
+	for i, e := range entries {
+		w.encode(e, i < len(entries)-1)
+	}
+}
+
+// encode a record to the pending buffer, the caller holds the lock
+func (w *wal) encode(e batchEntry, follows bool) {
+	key := e.key
+	value, flag := withExpiry(e.value, e.expires)
+	header := make([]byte, walHeaderSize)
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(key)))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(value))|flag)
+	if e.deleted {
+		binary.BigEndian.PutUint32(header[8:12], tombstone)
+	}
+	if follows {
+		binary.BigEndian.PutUint32(header[8:12], binary.BigEndian.Uint32(header[8:12])|walBatchFollows)
+	}
+	c := crc32.New(CrcTable)
+	_, _ = c.Write(header[4:])
+	_, _ = c.Write(key)
+	_, _ = c.Write(value)
+	binary.BigEndian.PutUint32(header[0:4], c.Sum32())
+	w.buf.Write(header)
+	w.buf.Write(key)
+	w.buf.Write(value)
+}
+
+// commit write every pending record to the segment and fsync it unless sync mode is none
+func (w *wal) commit() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.commitLocked()
+}
+
+func (w *wal) commitLocked() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.fp.Write(w.buf.Bytes())
+	w.buf.Reset()
+	if err != nil {
+		return err
+	}
+	if w.syncMode == WalSyncNone {
+		return nil
+	}
+	return w.fp.Sync()
+}
+
+// sync commit every pending record and fsync the segment whatever the sync mode is
+func (w *wal) sync() error {
+	w.Lock()
+	defer w.Unlock()
+	if err := w.commitLocked(); err != nil {
+		return err
+	}
+	return w.fp.Sync()
+}
+
+// rotate commit the current segment and start a new one, the old segment's id is returned
+func (w *wal) rotate() (uint32, error) {
+	w.Lock()
+	defer w.Unlock()
+	if err := w.commitLocked(); err != nil {
+		return 0, err
+	}
+	if err := w.fp.Close(); err != nil {
+		return 0, err
+	}
+	old := w.segment
+	fp, err := createSegment(w.absPath, old+1)
+	if err != nil {
+		return 0, err
+	}
+	w.fp = fp
+	w.segment = old + 1
+	return old, nil
+}
+
+// current return the id of the segment that receives new records
+func (w *wal) current() uint32 {
+	w.Lock()
+	defer w.Unlock()
+	return w.segment
+}
+
+// remove drop a segment whose memory table is already on disk
+func (w *wal) remove(segment uint32) {
+	err := os.Remove(walPath(w.absPath, segment))
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("wal: unable to remove segment %d.wal %v", segment, err)
+	}
+}
+
+// close commit pending records and close the segment,
+// an empty segment is removed because there is nothing to replay.
+func (w *wal) close() error {
+	w.Lock()
+	defer w.Unlock()
+	if err := w.commitLocked(); err != nil {
+		return err
+	}
+	status, err := w.fp.Stat()
+	if err != nil {
+		return err
+	}
+	if err := w.fp.Close(); err != nil {
+		return err
+	}
+	if status.Size() <= headerSize {
+		w.remove(w.segment)
+	}
+	return nil
+}
+
+// walSegments return every segment's id in the directory in ascending order
+func walSegments(absPath string) ([]uint32, error) {
+	infos, err := ioutil.ReadDir(absPath)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]uint32, 0)
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".wal") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".wal"), 10, 32)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, uint32(id))
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// replaySegment call apply for every intact record of the segment.
+// a torn or corrupted record means the process crashed while writing it,
+// so replay stops there.
+func replaySegment(absPath string, segment uint32, apply func(e batchEntry)) error {
+	fp, err := os.Open(walPath(absPath, segment))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	status, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	left := status.Size() - headerSize
+	reader := bufio.NewReader(fp)
+	// a crash right after the segment is created may leave it without a complete header
+	err = readHeader(reader, walPath(absPath, segment), walFile)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		if left >= 0 {
+			return err
+		}
+		logrus.Warnf("wal: segment %d.wal ends with a torn header", segment)
+		return nil
+	}
+	header := make([]byte, walHeaderSize)
+	// records of a batch whose last record hasn't been read yet
+	pending := make([]batchEntry, 0)
+	torn := func() {
+		if len(pending) > 0 {
+			logrus.Warnf("wal: segment %d.wal ends with a torn batch of %d records, drop it", segment, len(pending))
+		}
+	}
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF {
+				logrus.Warnf("wal: segment %d.wal ends with a torn record header", segment)
+			}
+			torn()
+			return nil
+		}
+		keyLength := binary.BigEndian.Uint32(header[4:8])
+		valLength := binary.BigEndian.Uint32(header[8:12])
+		deleted := valLength&tombstone != 0
+		follows := valLength&walBatchFollows != 0
+		flags := valLength & expiring
+		valLength &^= tombstone | walBatchFollows | expiring
+		left -= walHeaderSize
+		// a damaged length must not make us allocate more than the segment holds
+		if int64(keyLength)+int64(valLength) > left {
+			logrus.Warnf("wal: segment %d.wal ends with a torn record", segment)
+			torn()
+			return nil
+		}
+		left -= int64(keyLength) + int64(valLength)
+		kv := make([]byte, keyLength+valLength)
+		if _, err := io.ReadFull(reader, kv); err != nil {
+			logrus.Warnf("wal: segment %d.wal ends with a torn record", segment)
+			torn()
+			return nil
+		}
+		c := crc32.New(CrcTable)
+		_, _ = c.Write(header[4:])
+		_, _ = c.Write(kv)
+		if c.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+			logrus.Warnf("wal: checksum mismatch in segment %d.wal, drop the rest of it", segment)
+			torn()
+			return nil
+		}
+		value, expires := splitExpiry(kv[keyLength:], flags)
+		pending = append(pending, batchEntry{key: kv[:keyLength], value: value, deleted: deleted, expires: expires})
+		if follows {
+			continue
+		}
+		for _, e := range pending {
+			apply(e)
+		}
+		pending = pending[:0]
+	}
+}
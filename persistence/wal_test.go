@@ -0,0 +1,98 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestWalReplay(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newWal(dir, 1, WalSyncAlways)
+	if err != nil {
+		t.Fatalf("wal is expected to open but got error %s", err.Error())
+	}
+	for i := 0; i < 100; i++ {
+		w.appendBatch([]batchEntry{{key: []byte(fmt.Sprintf("key %d", i)), value: []byte(fmt.Sprintf("%d", i))}})
+	}
+	if err = w.close(); err != nil {
+		t.Fatalf("wal is expected to close but got error %s", err.Error())
+	}
+	records := 0
+	err = replaySegment(dir, 1, func(e batchEntry) {
+		key, value := e.key, e.value
+		if !bytes.Equal(key, []byte(fmt.Sprintf("key %d", records))) {
+			t.Fatalf("expected key %d but got %s", records, key)
+		}
+		if !bytes.Equal(value, []byte(fmt.Sprintf("%d", records))) {
+			t.Fatalf("expected value %d but got %s", records, value)
+		}
+		records++
+	})
+	if err != nil {
+		t.Fatalf("unable to replay wal %s", err.Error())
+	}
+	if records != 100 {
+		t.Fatalf("expected 100 records but got %d", records)
+	}
+}
+
+func TestWalTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := newWal(dir, 1, WalSyncNone)
+	w.appendBatch([]batchEntry{{key: []byte("phenom"), value: []byte("froza")}})
+	w.appendBatch([]batchEntry{{key: []byte("xonlab"), deleted: true}})
+	w.close()
+	// cut the last record in half as if the process crashed while writing it
+	status, _ := os.Stat(walPath(dir, 1))
+	os.Truncate(walPath(dir, 1), status.Size()-4)
+	records := 0
+	replaySegment(dir, 1, func(e batchEntry) {
+		records++
+	})
+	if records != 1 {
+		t.Fatalf("expected 1 record but got %d", records)
+	}
+}
+
+func TestWalTornBatch(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := newWal(dir, 1, WalSyncNone)
+	w.appendBatch([]batchEntry{{key: []byte("phenom"), value: []byte("froza")}})
+	w.appendBatch([]batchEntry{{key: []byte("key 1"), value: []byte("1"), expires: 42}, {key: []byte("key 2"), deleted: true}})
+	w.appendBatch([]batchEntry{{key: []byte("key 3"), value: []byte("3")}, {key: []byte("key 4"), value: []byte("4")}})
+	w.close()
+	// the last batch is torn, its first record is intact but it must not be replayed alone
+	status, _ := os.Stat(walPath(dir, 1))
+	os.Truncate(walPath(dir, 1), status.Size()-4)
+	keys := make([]string, 0)
+	replaySegment(dir, 1, func(e batchEntry) {
+		keys = append(keys, fmt.Sprintf("%s %s %v %d", e.key, e.value, e.deleted, e.expires))
+	})
+	if fmt.Sprint(keys) != "[phenom froza false 0 key 1 1 false 42 key 2  true 0]" {
+		t.Fatalf("expected the torn batch to be dropped but got %v", keys)
+	}
+}
+
+func TestLsmRecoverFromWal(t *testing.T) {
+	dir := t.TempDir()
+	l := initLSM(t, dir)
+	produceEntry(l, 0, 100)
+	// stop every goroutine without flushing the memory table, just like a crash
+	l.loadBalanceCloser.SignalAndWait()
+	l.compactCloser.SignalAndWait()
+	l.writeCloser.SignalAndWait()
+	l.flushDiskCloser.SignalAndWait()
+	l = initLSM(t, dir)
+	for i := 0; i <= 100; i++ {
+		val, exist := l.Get([]byte(fmt.Sprintf("key %d", i)))
+		if !exist {
+			t.Fatalf("key %d is lost after crash", i)
+		}
+		if !bytes.Equal(val, []byte(fmt.Sprintf("%d", i))) {
+			t.Fatalf("Lsm get a unexpected value %s", val)
+		}
+	}
+	l.Close()
+}